@@ -0,0 +1,316 @@
+/*
+Authenticated endpoints for the operators of the broker.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// adminAuth decides which requests may use the admin endpoints: those bearing
+// token, if set, and those presenting a client certificate verified against
+// the admin CAs, if clientCerts is set.
+type adminAuth struct {
+	token       string
+	clientCerts bool
+}
+
+// enabled reports whether any request may be authorized at all.
+func (a adminAuth) enabled() bool {
+	return a.token != "" || a.clientCerts
+}
+
+// authorized reports whether the request bears the admin token or a verified
+// client certificate.
+func (a adminAuth) authorized(r *http.Request) bool {
+	if a.clientCerts && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && a.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+// AdminHandler serves an administration endpoint to authorized requests. It
+// implements the http.Handler interface.
+type AdminHandler struct {
+	*IPC
+	auth   adminAuth
+	handle func(*IPC, http.ResponseWriter, *http.Request)
+}
+
+func (ah AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !ah.auth.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="snowflake-broker"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ah.handle(ah.IPC, w, r)
+}
+
+// adminHandlers maps the paths of the admin endpoints to their handlers.
+var adminHandlers = map[string]func(*IPC, http.ResponseWriter, *http.Request){
+	"/admin/proxies":            proxiesHandler,
+	"/admin/matching":           matchingHandler,
+	"/admin/reload-bridge-list": reloadBridgeListHandler,
+	"/admin/reload-geoip":       reloadGeoipHandler,
+	"/admin/timeouts":           timeoutsHandler,
+	"/admin/metrics":            metricsSnapshotHandler,
+}
+
+// writeJSON writes v as the JSON response to an admin request.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("writing admin response returned error: %v", err)
+	}
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// requireMethod responds with an error and returns false unless the request
+// uses one of the allowed methods.
+func requireMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, adminError{strings.Join(methods, " or ") + " required"})
+	return false
+}
+
+// decodeJSON decodes the body of an admin request into v, responding with an
+// error and returning false if it is not valid.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, readLimit))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{err.Error()})
+		return false
+	}
+	return true
+}
+
+// inMemory responds with an error and returns false if the matching state is
+// not kept by this broker, but shared with others.
+func inMemory(i *IPC, w http.ResponseWriter) bool {
+	if _, ok := i.ctx.store.(*memoryStore); !ok {
+		writeJSON(w, http.StatusNotImplemented, adminError{"only available when the matching state is kept in memory"})
+		return false
+	}
+	return true
+}
+
+type adminProxy struct {
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	NAT          string `json:"nat"`
+	Clients      int    `json:"clients"`
+	Country      string `json:"country,omitempty"`
+	RelayPattern string `json:"relayPattern,omitempty"`
+	Waiting      string `json:"waiting"`
+	// Addr is only shown with --unsafe-logging.
+	Addr string `json:"addr,omitempty"`
+}
+
+// proxiesHandler lists the proxies waiting for a client, longest waiting
+// first.
+func proxiesHandler(i *IPC, w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) || !inMemory(i, w) {
+		return
+	}
+	now := time.Now()
+	i.ctx.snowflakeLock.Lock()
+	snowflakes := make([]*Snowflake, 0, len(i.ctx.idToSnowflake))
+	for _, snowflake := range i.ctx.idToSnowflake {
+		// Matched snowflakes stay in the map until their rendezvous is over.
+		if snowflake.index != -1 {
+			snowflakes = append(snowflakes, snowflake)
+		}
+	}
+	sort.Slice(snowflakes, func(a, b int) bool { return snowflakes[a].seq < snowflakes[b].seq })
+	proxies := make([]adminProxy, len(snowflakes))
+	for n, snowflake := range snowflakes {
+		proxies[n] = adminProxy{
+			ID:           snowflake.id,
+			Type:         snowflake.proxyType,
+			NAT:          snowflake.natType,
+			Clients:      snowflake.clients,
+			Country:      snowflake.country,
+			RelayPattern: snowflake.relayPattern,
+			Waiting:      now.Sub(snowflake.added).Round(time.Millisecond).String(),
+		}
+		if i.ctx.unsafeLogging {
+			proxies[n].Addr = snowflake.addr
+		}
+	}
+	i.ctx.snowflakeLock.Unlock()
+	writeJSON(w, http.StatusOK, proxies)
+}
+
+type matchingState struct {
+	// Paused stops clients from being matched with proxies.
+	Paused *bool `json:"paused"`
+	// Draining stops proxies from being registered, while the proxies
+	// already waiting may still be matched.
+	Draining *bool `json:"draining"`
+}
+
+// matchingHandler shows whether matching is paused and the broker draining,
+// and changes either on POST.
+func matchingHandler(i *IPC, w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		var state matchingState
+		if !decodeJSON(w, r, &state) {
+			return
+		}
+		if state.Paused != nil {
+			i.ctx.matchingPaused.Store(*state.Paused)
+			log.Printf("Matching paused set to %t by admin request", *state.Paused)
+		}
+		if state.Draining != nil {
+			i.ctx.draining.Store(*state.Draining)
+			log.Printf("Draining set to %t by admin request", *state.Draining)
+		}
+	}
+	paused, draining := i.ctx.matchingPaused.Load(), i.ctx.draining.Load()
+	writeJSON(w, http.StatusOK, matchingState{&paused, &draining})
+}
+
+// reloadBridgeListHandler reloads the bridge list file and responds with the
+// fingerprints of the bridges added, removed and changed.
+func reloadBridgeListHandler(i *IPC, w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	diff, err := i.ctx.ReloadBridgeList("admin request")
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, adminError{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, diff)
+}
+
+// reloadGeoipHandler reloads the geoip databases.
+func reloadGeoipHandler(i *IPC, w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	if err := i.ctx.ReloadGeoipDatabases(); err != nil {
+		log.Printf("Reloading geoip databases (admin request) failed, keeping the current ones: %v", err)
+		writeJSON(w, http.StatusUnprocessableEntity, adminError{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// adminTimeouts holds durations in the format of time.ParseDuration.
+type adminTimeouts struct {
+	Proxy  string `json:"proxy,omitempty"`
+	Client string `json:"client,omitempty"`
+}
+
+// timeoutsHandler shows how long proxies wait for a client and clients for
+// the answer of their proxy, and changes either on POST.
+func timeoutsHandler(i *IPC, w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	proxy, client := i.ctx.Timeouts()
+	if r.Method == http.MethodPost {
+		if !inMemory(i, w) {
+			return
+		}
+		var timeouts adminTimeouts
+		if !decodeJSON(w, r, &timeouts) {
+			return
+		}
+		for _, timeout := range []struct {
+			value string
+			set   *time.Duration
+		}{{timeouts.Proxy, &proxy}, {timeouts.Client, &client}} {
+			if timeout.value == "" {
+				continue
+			}
+			d, err := time.ParseDuration(timeout.value)
+			if err == nil && d <= 0 {
+				err = fmt.Errorf("timeout %s is not positive", timeout.value)
+			}
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, adminError{err.Error()})
+				return
+			}
+			*timeout.set = d
+		}
+		i.ctx.SetTimeouts(proxy, client)
+		log.Printf("Timeouts set by admin request: proxy %s, client %s", proxy, client)
+	}
+	writeJSON(w, http.StatusOK, adminTimeouts{proxy.String(), client.String()})
+}
+
+type adminSample struct {
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// metricsSnapshotHandler responds with the current values of the Prometheus
+// metrics, by name. Histograms and summaries are given by their sample count.
+func metricsSnapshotHandler(i *IPC, w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	families, err := i.ctx.metrics.promMetrics.registry.Gather()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, adminError{err.Error()})
+		return
+	}
+	snapshot := make(map[string][]adminSample)
+	for _, family := range families {
+		samples := make([]adminSample, 0, len(family.GetMetric()))
+		for _, metric := range family.GetMetric() {
+			sample := adminSample{Value: metricValue(metric)}
+			if len(metric.GetLabel()) > 0 {
+				sample.Labels = make(map[string]string)
+				for _, label := range metric.GetLabel() {
+					sample.Labels[label.GetName()] = label.GetValue()
+				}
+			}
+			samples = append(samples, sample)
+		}
+		snapshot[family.GetName()] = samples
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+func metricValue(metric *dto.Metric) float64 {
+	switch {
+	case metric.Counter != nil:
+		return metric.Counter.GetValue()
+	case metric.Gauge != nil:
+		return metric.Gauge.GetValue()
+	case metric.Untyped != nil:
+		return metric.Untyped.GetValue()
+	case metric.Histogram != nil:
+		return float64(metric.Histogram.GetSampleCount())
+	case metric.Summary != nil:
+		return float64(metric.Summary.GetSampleCount())
+	}
+	return 0
+}
@@ -0,0 +1,237 @@
+/*
+Probing the bridges of the bridge list, so that clients are not matched with
+proxies for a bridge that is down.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgelist"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/task"
+)
+
+const (
+	// DefaultBridgeProbeInterval is how often the bridges are probed.
+	DefaultBridgeProbeInterval = time.Minute
+	// bridgeProbeTimeout bounds the WebSocket handshake of a probe.
+	bridgeProbeTimeout = 10 * time.Second
+	// bridgeDownAfter is the number of failed probes in a row after which
+	// a bridge is marked down, and bridgeUpAfter the number of successful
+	// probes in a row after which it is marked up again, so that a single
+	// probe does not flip the state of a bridge.
+	bridgeDownAfter = 3
+	bridgeUpAfter   = 2
+)
+
+// ErrBridgeDown is returned to clients asking for a bridge that is marked
+// down when there is no fallback bridge to give them.
+var ErrBridgeDown = errors.New("the requested bridge is currently unavailable")
+
+type bridgeState struct {
+	displayName string
+	up          bool
+	// streak is the number of probes in a row that disagreed with up.
+	streak    int
+	lastError string
+	since     time.Time
+}
+
+// BridgeHealth tracks whether the bridges of the bridge list are up, from
+// periodic WebSocket handshakes with their relay URLs. A bridge with several
+// relays passes a probe if any of them accepts the handshake. Bridges are up
+// until probed otherwise.
+type BridgeHealth struct {
+	bridgeList bridgelist.BridgeListHolderFileBased
+	// probe performs the handshake with the relay URL of a bridge.
+	probe func(ctx context.Context, url string) error
+
+	lock   sync.Mutex
+	states map[string]*bridgeState
+
+	bridgeUp     *prometheus.GaugeVec
+	probesTotal  *prometheus.CounterVec
+	prober       *task.Periodic
+	proberAccess sync.Mutex
+}
+
+func NewBridgeHealth(bridgeList bridgelist.BridgeListHolderFileBased) *BridgeHealth {
+	return &BridgeHealth{
+		bridgeList: bridgeList,
+		probe:      websocketHandshake,
+		states:     make(map[string]*bridgeState),
+		bridgeUp: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: prometheusNamespace,
+				Name:      "bridge_up",
+				Help:      "Whether the bridge is considered up by the bridge prober",
+			},
+			[]string{"fingerprint"},
+		),
+		probesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: prometheusNamespace,
+				Name:      "bridge_probes_total",
+				Help:      "The number of WebSocket handshakes with the bridges, by result",
+			},
+			[]string{"status"},
+		),
+	}
+}
+
+// websocketHandshake opens and closes a WebSocket connection to url.
+func websocketHandshake(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, bridgeProbeTimeout)
+	defer cancel()
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("%v (HTTP status %s)", err, resp.Status)
+		}
+		return err
+	}
+	return conn.Close()
+}
+
+func (h *BridgeHealth) Describe(ch chan<- *prometheus.Desc) {
+	h.bridgeUp.Describe(ch)
+	h.probesTotal.Describe(ch)
+}
+
+func (h *BridgeHealth) Collect(ch chan<- prometheus.Metric) {
+	h.bridgeUp.Collect(ch)
+	h.probesTotal.Collect(ch)
+}
+
+// Start probes the bridges every interval until Close is called.
+func (h *BridgeHealth) Start(interval time.Duration) {
+	h.proberAccess.Lock()
+	defer h.proberAccess.Unlock()
+	h.prober = &task.Periodic{
+		Interval: interval,
+		Execute: func() error {
+			h.ProbeAll(context.Background())
+			return nil
+		},
+	}
+	go h.prober.Start()
+}
+
+func (h *BridgeHealth) Close() error {
+	h.proberAccess.Lock()
+	defer h.proberAccess.Unlock()
+	if h.prober == nil {
+		return nil
+	}
+	return h.prober.Close()
+}
+
+// ProbeAll probes every bridge of the list at once, and forgets the bridges
+// no longer listed.
+func (h *BridgeHealth) ProbeAll(ctx context.Context) {
+	bridges := h.bridgeList.AllBridgeInfo()
+	errs := make([]error, len(bridges))
+	var wg sync.WaitGroup
+	for i, bridge := range bridges {
+		wg.Add(1)
+		go func(i int, urls []string) {
+			defer wg.Done()
+			for _, url := range urls {
+				if errs[i] = h.probe(ctx, url); errs[i] == nil {
+					break
+				}
+			}
+		}(i, bridge.RelayURLs())
+	}
+	wg.Wait()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	listed := make(map[string]bool)
+	for i, bridge := range bridges {
+		fingerprint := strings.ToUpper(bridge.Fingerprint)
+		listed[fingerprint] = true
+		h.record(fingerprint, bridge.DisplayName, errs[i])
+	}
+	for fingerprint := range h.states {
+		if !listed[fingerprint] {
+			delete(h.states, fingerprint)
+			h.bridgeUp.DeleteLabelValues(fingerprint)
+		}
+	}
+}
+
+// record updates the state of a bridge with the result of a probe. It must
+// be called with the lock held.
+func (h *BridgeHealth) record(fingerprint, displayName string, err error) {
+	state, ok := h.states[fingerprint]
+	if !ok {
+		state = &bridgeState{up: true, since: time.Now()}
+		h.states[fingerprint] = state
+	}
+	state.displayName = displayName
+
+	status := "success"
+	if err != nil {
+		status = "failure"
+		state.lastError = err.Error()
+	}
+	h.probesTotal.With(prometheus.Labels{"status": status}).Inc()
+
+	if (err == nil) == state.up {
+		state.streak = 0
+	} else {
+		state.streak++
+	}
+	if state.up && state.streak >= bridgeDownAfter {
+		state.up, state.streak, state.since = false, 0, time.Now()
+		log.Printf("Bridge %s (%s) is down: %s", displayName, fingerprint, state.lastError)
+	} else if !state.up && state.streak >= bridgeUpAfter {
+		state.up, state.streak, state.since = true, 0, time.Now()
+		log.Printf("Bridge %s (%s) is up again", displayName, fingerprint)
+	}
+
+	up := 0.0
+	if state.up {
+		up = 1
+	}
+	h.bridgeUp.With(prometheus.Labels{"fingerprint": fingerprint}).Set(up)
+}
+
+// IsUp reports whether the bridge with the given hex fingerprint is
+// considered up.
+func (h *BridgeHealth) IsUp(fingerprint string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	state, ok := h.states[strings.ToUpper(fingerprint)]
+	return !ok || state.up
+}
+
+// String summarizes the state of the probed bridges for /debug.
+func (h *BridgeHealth) String() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s := "Bridges:"
+	for _, bridge := range h.bridgeList.AllBridgeInfo() {
+		fingerprint := strings.ToUpper(bridge.Fingerprint)
+		state, ok := h.states[fingerprint]
+		switch {
+		case !ok:
+			s += fmt.Sprintf("\n\t%s (%s): not probed yet", bridge.DisplayName, fingerprint)
+		case state.up:
+			s += fmt.Sprintf("\n\t%s (%s): up since %s", bridge.DisplayName, fingerprint, state.since.UTC().Format(time.RFC3339))
+		default:
+			s += fmt.Sprintf("\n\t%s (%s): down since %s: %s", bridge.DisplayName, fingerprint, state.since.UTC().Format(time.RFC3339), state.lastError)
+		}
+	}
+	return s
+}
@@ -1,94 +1,105 @@
-/* (*BridgeListHolderFileBased).LoadBridgeInfo loads a Snowflake Server bridge info description file,
-   its format is as follows:
-
-   This file should be in newline-delimited JSON format(https://jsonlines.org/).
-   For each line, the format of json data should be in the format of:
-   {"displayName":"default", "webSocketAddress":"wss://snowflake.torproject.net/", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80A72"}
-
-   displayName:string is the name of this bridge. This value is not currently used programmatically.
-
-   webSocketAddress:string is the WebSocket URL of this bridge.
-   This will be the address proxy used to connect to this snowflake server.
-
-   fingerprint:string is the identifier of the bridge.
-   This will be used by a client to identify the bridge it wishes to connect to.
-
-   The existence of ANY other fields is NOT permitted.
-
-   The file will be considered invalid if there is at least one invalid json record.
-   In this case, an error will be returned, and none of the records will be loaded.
+/*
+Reloading the bridge list while the broker runs.
 */
 
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"encoding/json"
 	"errors"
-	"io"
-	"sync"
-
-	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgefingerprint"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgelist"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/task"
 )
 
-var ErrBridgeNotFound = errors.New("bridge with requested fingerprint is unknown to the broker")
-
-func NewBridgeListHolder() BridgeListHolderFileBased {
-	return &bridgeListHolder{}
-}
-
-type bridgeListHolder struct {
-	bridgeInfo       map[bridgefingerprint.Fingerprint]BridgeInfo
-	accessBridgeInfo sync.RWMutex
-}
-
-type BridgeListHolder interface {
-	GetBridgeInfo(bridgefingerprint.Fingerprint) (BridgeInfo, error)
-}
-
-type BridgeListHolderFileBased interface {
-	BridgeListHolder
-	LoadBridgeInfo(reader io.Reader) error
-}
-
-type BridgeInfo struct {
-	DisplayName      string `json:"displayName"`
-	WebSocketAddress string `json:"webSocketAddress"`
-	Fingerprint      string `json:"fingerprint"`
+var errNoBridgeListFile = errors.New("no bridge list file configured")
+
+// ReloadBridgeList loads the bridge list file again, replacing the bridge list
+// only if the whole file is valid, and reports what changed in the log and
+// metrics. Rendezvous in progress are not affected. The reason is logged.
+func (ctx *BrokerContext) ReloadBridgeList(reason string) (bridgelist.Diff, error) {
+	ctx.bridgeListLock.Lock()
+	defer ctx.bridgeListLock.Unlock()
+
+	diff, err := ctx.reloadBridgeList()
+	status := "success"
+	if err != nil {
+		status = "failure"
+		log.Printf("Reloading bridge list (%s) failed, keeping the current list: %v", reason, err)
+	} else {
+		log.Printf("Reloaded bridge list (%s): %s", reason, diff)
+		for change, fingerprints := range map[string][]string{
+			"added":   diff.Added,
+			"removed": diff.Removed,
+			"changed": diff.Changed,
+		} {
+			ctx.metrics.promMetrics.BridgeListChangesTotal.With(prometheus.Labels{"change": change}).Add(float64(len(fingerprints)))
+		}
+	}
+	ctx.metrics.promMetrics.BridgeListReloadsTotal.With(prometheus.Labels{"status": status}).Inc()
+	return diff, err
 }
 
-func (h *bridgeListHolder) GetBridgeInfo(fingerprint bridgefingerprint.Fingerprint) (BridgeInfo, error) {
-	h.accessBridgeInfo.RLock()
-	defer h.accessBridgeInfo.RUnlock()
-	if bridgeInfo, ok := h.bridgeInfo[fingerprint]; ok {
-		return bridgeInfo, nil
+func (ctx *BrokerContext) reloadBridgeList() (bridgelist.Diff, error) {
+	if ctx.bridgeListPath == "" {
+		return bridgelist.Diff{}, errNoBridgeListFile
+	}
+	info, err := os.Stat(ctx.bridgeListPath)
+	if err != nil {
+		return bridgelist.Diff{}, err
 	}
-	return BridgeInfo{}, ErrBridgeNotFound
+	data, err := os.ReadFile(ctx.bridgeListPath)
+	if err != nil {
+		return bridgelist.Diff{}, err
+	}
+	// Remember the file even if it turns out to be invalid, so that the
+	// watcher does not try the same file again until it changes.
+	ctx.bridgeListStat = fileStat{info.ModTime(), info.Size()}
+	// An empty file is more likely to be half written than meant to
+	// remove every bridge.
+	if len(bytes.TrimSpace(data)) == 0 {
+		return bridgelist.Diff{}, fmt.Errorf("bridge list file %s is empty", ctx.bridgeListPath)
+	}
+	return ctx.bridgeList.ReloadBridgeInfo(bytes.NewReader(data))
 }
 
-func (h *bridgeListHolder) LoadBridgeInfo(reader io.Reader) error {
-	bridgeInfoMap := map[bridgefingerprint.Fingerprint]BridgeInfo{}
-	inputScanner := bufio.NewScanner(reader)
-	for inputScanner.Scan() {
-		inputLine := inputScanner.Bytes()
-		bridgeInfo := BridgeInfo{}
-		decoder := json.NewDecoder(bytes.NewReader(inputLine))
-		decoder.DisallowUnknownFields()
-		if err := decoder.Decode(&bridgeInfo); err != nil {
-			return err
-		}
-
-		var bridgeFingerprint bridgefingerprint.Fingerprint
-		var err error
-		if bridgeFingerprint, err = bridgefingerprint.FingerprintFromHexString(bridgeInfo.Fingerprint); err != nil {
-			return err
-		}
+// fileStat is what tells the bridge list watcher that the file changed.
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
 
-		bridgeInfoMap[bridgeFingerprint] = bridgeInfo
+// WatchBridgeList checks the bridge list file for changes every interval, and
+// reloads it once a change has settled, so that a file being written is not
+// loaded half way.
+func (ctx *BrokerContext) WatchBridgeList(interval time.Duration) *task.Periodic {
+	var seen fileStat
+	watcher := &task.Periodic{
+		Interval: interval,
+		Execute: func() error {
+			info, err := os.Stat(ctx.bridgeListPath)
+			if err != nil {
+				return err
+			}
+			stat := fileStat{info.ModTime(), info.Size()}
+			ctx.bridgeListLock.Lock()
+			loaded := ctx.bridgeListStat
+			ctx.bridgeListLock.Unlock()
+			if stat != loaded && stat == seen {
+				ctx.ReloadBridgeList("file changed")
+			}
+			seen = stat
+			return nil
+		},
+		OnError: func(err error) {
+			log.Printf("Watching bridge list: %v", err)
+		},
 	}
-	h.accessBridgeInfo.Lock()
-	defer h.accessBridgeInfo.Unlock()
-	h.bridgeInfo = bridgeInfoMap
-	return nil
+	watcher.Start()
+	return watcher
 }
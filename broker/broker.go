@@ -10,7 +10,10 @@ import (
 	"container/heap"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -18,17 +21,21 @@ import (
 	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgefingerprint"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgelist"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/go-redis/redis/v8"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/ptutil/safelog"
-	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/namematcher"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/matchstore"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/ratelimit"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -36,26 +43,73 @@ type BrokerContext struct {
 	snowflakes           *SnowflakeHeap
 	restrictedSnowflakes *SnowflakeHeap
 	// Maps keeping track of snowflakeIDs required to match SDP answers from
-	// the second http POST. Restricted snowflakes can only be matched up with
-	// clients behind an unrestricted NAT.
+	// the second http POST. Which snowflakes a client may be matched up
+	// with is decided by matchPolicy.
 	idToSnowflake map[string]*Snowflake
+	matchPolicy   *matchstore.MatchPolicy
+	// selector chooses which snowflake of a pool a client is matched
+	// with. Snowflakes whose prefix scores below minReputation are only
+	// considered when no other snowflake of the pool is waiting.
+	selector      ProxySelector
+	reputation    *ProxyReputation
+	minReputation float64
+	snowflakeSeq  uint64
 	// Synchronization for the snowflake map and heap
 	snowflakeLock sync.Mutex
 	proxyPolls    chan *ProxyPoll
 	metrics       *Metrics
-
-	bridgeList                     BridgeListHolderFileBased
-	allowedRelayPattern            string
+	// The store through which clients are matched with proxies. It is
+	// backed by the heaps above unless the broker shares its matching
+	// state with other brokers.
+	store matchstore.MatchStore
+
+	bridgeList bridgelist.BridgeListHolderFileBased
+	// bridgeListPath is the file the bridge list is reloaded from, and
+	// bridgeListStat what the file looked like when it was last tried.
+	bridgeListPath string
+	bridgeListStat fileStat
+	bridgeListLock sync.Mutex
+	// bridgeHealth tracks which bridges are up. Clients asking for a bridge
+	// that is down are given bridgeFallback instead, if it is set and up.
+	bridgeHealth   *BridgeHealth
+	bridgeFallback string
+	// relayRegions sends proxies to the relays of a bridge meant for their
+	// country, if there are any.
+	relayRegions bool
+
+	// presumedPatternForLegacyClient is the relay pattern of proxies too
+	// old to send an AcceptedRelayPattern.
 	presumedPatternForLegacyClient string
+
+	// rateLimiter limits how often a host may use each endpoint. Requests
+	// are not limited if it is nil.
+	rateLimiter *ratelimit.Limiter
+
+	// geoipDatabase and geoip6Database are the files the geoip databases
+	// are reloaded from, if geoip is enabled.
+	geoipDatabase  string
+	geoip6Database string
+	// unsafeLogging lets the admin API show the addresses of proxies.
+	unsafeLogging bool
+
+	// The admin API may pause matching, so that clients get no proxy, or
+	// drain the broker, so that proxies are no longer registered.
+	matchingPaused atomic.Bool
+	draining       atomic.Bool
+	// proxyTimeout is how long a proxy waits for a client, and
+	// clientTimeout how long a client waits for the proxy's answer. The
+	// admin API may change them.
+	timeoutLock   sync.RWMutex
+	proxyTimeout  time.Duration
+	clientTimeout time.Duration
 }
 
-func (ctx *BrokerContext) GetBridgeInfo(fingerprint bridgefingerprint.Fingerprint) (BridgeInfo, error) {
+func (ctx *BrokerContext) GetBridgeInfo(fingerprint bridgefingerprint.Fingerprint) (bridgelist.BridgeInfo, error) {
 	return ctx.bridgeList.GetBridgeInfo(fingerprint)
 }
 
 func NewBrokerContext(
 	metricsLogger *log.Logger,
-	allowedRelayPattern,
 	presumedPatternForLegacyClient string,
 ) *BrokerContext {
 	snowflakes := new(SnowflakeHeap)
@@ -72,22 +126,33 @@ func NewBrokerContext(
 		panic("Failed to create metrics")
 	}
 
-	bridgeListHolder := NewBridgeListHolder()
+	reputation := NewProxyReputation(DefaultReputationHalfLife)
+	metrics.promMetrics.registry.MustRegister(reputation)
 
-	const DefaultBridges = `{"displayName":"default", "webSocketAddress":"wss://snowflake.torproject.net/", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80A72"}
-`
-	bridgeListHolder.LoadBridgeInfo(bytes.NewReader([]byte(DefaultBridges)))
+	bridgeListHolder := bridgelist.NewBridgeListHolder()
+	bridgeListHolder.LoadBridgeInfo(bytes.NewReader([]byte(bridgelist.DefaultBridgeList)))
 
-	return &BrokerContext{
+	bridgeHealth := NewBridgeHealth(bridgeListHolder)
+	metrics.promMetrics.registry.MustRegister(bridgeHealth)
+
+	ctx := &BrokerContext{
 		snowflakes:                     snowflakes,
 		restrictedSnowflakes:           rSnowflakes,
 		idToSnowflake:                  make(map[string]*Snowflake),
+		matchPolicy:                    matchstore.DefaultMatchPolicy,
+		selector:                       leastLoadedSelector{},
+		reputation:                     reputation,
 		proxyPolls:                     make(chan *ProxyPoll),
 		metrics:                        metrics,
 		bridgeList:                     bridgeListHolder,
-		allowedRelayPattern:            allowedRelayPattern,
+		bridgeHealth:                   bridgeHealth,
+		relayRegions:                   true,
+		proxyTimeout:                   ProxyTimeout * time.Second,
+		clientTimeout:                  ClientTimeout * time.Second,
 		presumedPatternForLegacyClient: presumedPatternForLegacyClient,
 	}
+	ctx.store = &memoryStore{ctx}
+	return ctx
 }
 
 // Proxies may poll for client offers concurrently.
@@ -96,17 +161,18 @@ type ProxyPoll struct {
 	proxyType    string
 	natType      string
 	clients      int
+	addr         string
+	relayPattern string
 	offerChannel chan *ClientOffer
 }
 
 // Registers a Snowflake and waits for some Client to send an offer,
 // as part of the polling logic of the proxy handler.
 func (ctx *BrokerContext) RequestOffer(id string, proxyType string, natType string, clients int) *ClientOffer {
-	request := new(ProxyPoll)
-	request.id = id
-	request.proxyType = proxyType
-	request.natType = natType
-	request.clients = clients
+	return ctx.requestOffer(&ProxyPoll{id: id, proxyType: proxyType, natType: natType, clients: clients})
+}
+
+func (ctx *BrokerContext) requestOffer(request *ProxyPoll) *ClientOffer {
 	request.offerChannel = make(chan *ClientOffer)
 	ctx.proxyPolls <- request
 	// Block until an offer is available, or timeout which sends a nil offer.
@@ -119,13 +185,14 @@ func (ctx *BrokerContext) RequestOffer(id string, proxyType string, natType stri
 // client offer or nil on timeout / none are available.
 func (ctx *BrokerContext) Broker() {
 	for request := range ctx.proxyPolls {
-		snowflake := ctx.AddSnowflake(request.id, request.proxyType, request.natType, request.clients)
+		snowflake := ctx.addSnowflake(request)
+		proxyTimeout, _ := ctx.Timeouts()
 		// Wait for a client to avail an offer to the snowflake.
 		go func(request *ProxyPoll) {
 			select {
 			case offer := <-snowflake.offerChannel:
 				request.offerChannel <- offer
-			case <-time.After(time.Second * ProxyTimeout):
+			case <-time.After(proxyTimeout):
 				// This snowflake is no longer available to serve clients.
 				ctx.snowflakeLock.Lock()
 				defer ctx.snowflakeLock.Unlock()
@@ -148,25 +215,58 @@ func (ctx *BrokerContext) Broker() {
 // Required to keep track of proxies between providing them
 // with an offer and awaiting their second POST with an answer.
 func (ctx *BrokerContext) AddSnowflake(id string, proxyType string, natType string, clients int) *Snowflake {
+	return ctx.addSnowflake(&ProxyPoll{id: id, proxyType: proxyType, natType: natType, clients: clients})
+}
+
+func (ctx *BrokerContext) addSnowflake(request *ProxyPoll) *Snowflake {
 	snowflake := new(Snowflake)
-	snowflake.id = id
-	snowflake.clients = clients
-	snowflake.proxyType = proxyType
-	snowflake.natType = natType
+	snowflake.id = request.id
+	snowflake.clients = request.clients
+	snowflake.proxyType = request.proxyType
+	snowflake.natType = request.natType
+	snowflake.addr = request.addr
+	snowflake.added = time.Now()
+	snowflake.relayPattern = request.relayPattern
+	snowflake.country = ctx.metrics.lookupCountry(request.addr)
 	snowflake.offerChannel = make(chan *ClientOffer)
 	snowflake.answerChannel = make(chan string)
 	ctx.snowflakeLock.Lock()
-	if natType == NATUnrestricted {
+	ctx.snowflakeSeq++
+	snowflake.seq = ctx.snowflakeSeq
+	if snowflake.natType == NATUnrestricted {
 		heap.Push(ctx.snowflakes, snowflake)
 	} else {
 		heap.Push(ctx.restrictedSnowflakes, snowflake)
 	}
-	ctx.metrics.promMetrics.AvailableProxies.With(prometheus.Labels{"nat": natType, "type": proxyType}).Inc()
-	ctx.idToSnowflake[id] = snowflake
+	ctx.metrics.promMetrics.AvailableProxies.With(prometheus.Labels{"nat": snowflake.natType, "type": snowflake.proxyType}).Inc()
+	ctx.idToSnowflake[snowflake.id] = snowflake
 	ctx.snowflakeLock.Unlock()
 	return snowflake
 }
 
+// Timeouts returns how long proxies wait for a client and clients wait for
+// the answer of their proxy.
+func (ctx *BrokerContext) Timeouts() (proxy, client time.Duration) {
+	ctx.timeoutLock.RLock()
+	defer ctx.timeoutLock.RUnlock()
+	return ctx.proxyTimeout, ctx.clientTimeout
+}
+
+func (ctx *BrokerContext) SetTimeouts(proxy, client time.Duration) {
+	ctx.timeoutLock.Lock()
+	defer ctx.timeoutLock.Unlock()
+	ctx.proxyTimeout, ctx.clientTimeout = proxy, client
+}
+
+// ReloadGeoipDatabases loads the geoip databases again, keeping the current
+// ones if they cannot be loaded.
+func (ctx *BrokerContext) ReloadGeoipDatabases() error {
+	if ctx.geoipDatabase == "" && ctx.geoip6Database == "" {
+		return errors.New("geoip is disabled")
+	}
+	return ctx.metrics.LoadGeoipDatabases(ctx.geoipDatabase, ctx.geoip6Database)
+}
+
 func (ctx *BrokerContext) InstallBridgeListProfile(reader io.Reader) error {
 	if err := ctx.bridgeList.LoadBridgeInfo(reader); err != nil {
 		return err
@@ -174,13 +274,25 @@ func (ctx *BrokerContext) InstallBridgeListProfile(reader io.Reader) error {
 	return nil
 }
 
-func (ctx *BrokerContext) CheckProxyRelayPattern(pattern string, nonSupported bool) bool {
+// ProxyRelayPattern returns the relay pattern of a proxy: the one it sent, or
+// the presumed one if it is too old to send one.
+func (ctx *BrokerContext) ProxyRelayPattern(pattern string, nonSupported bool) string {
 	if nonSupported {
-		pattern = ctx.presumedPatternForLegacyClient
+		return ctx.presumedPatternForLegacyClient
 	}
-	proxyPattern := namematcher.NewNameMatcher(pattern)
-	brokerPattern := namematcher.NewNameMatcher(ctx.allowedRelayPattern)
-	return proxyPattern.IsSupersetOf(brokerPattern)
+	return pattern
+}
+
+// CheckProxyRelayPattern reports whether a proxy with the given relay pattern
+// accepts a relay of at least one bridge of the list, and so can ever be
+// matched with a client.
+func (ctx *BrokerContext) CheckProxyRelayPattern(pattern string) bool {
+	for _, info := range ctx.bridgeList.AllBridgeInfo() {
+		if matchstore.AcceptsRelay(pattern, info.RelayHosts()) {
+			return true
+		}
+	}
+	return false
 }
 
 // Client offer contains an SDP, bridge fingerprint and the NAT type of the client
@@ -204,6 +316,18 @@ func main() {
 	var disableGeoip bool
 	var metricsFilename string
 	var unsafeLogging bool
+	var redisAddress string
+	var rateLimit string
+	var matchingPolicy string
+	var bridgeListWatchInterval time.Duration
+	var adminTokenFile string
+	var adminClientCA string
+	var bridgeProbeInterval time.Duration
+	var bridgeFallback string
+	var relayRegions bool
+	var proxySelector string
+	var reputationHalfLife time.Duration
+	var minReputation float64
 
 	flag.StringVar(&acmeEmail, "acme-email", "", "optional contact email for Let's Encrypt notifications")
 	flag.StringVar(&acmeHostnamesCommas, "acme-hostnames", "", "comma-separated hostnames for TLS certificate")
@@ -214,7 +338,13 @@ func main() {
 	flag.StringVar(&geoipDatabase, "geoipdb", "/usr/local/Cellar/tor/0.4.8.13/share/tor/geoip", "path to correctly formatted geoip database mapping IPv4 address ranges to country codes")
 	flag.StringVar(&geoip6Database, "geoip6db", "/usr/local/Cellar/tor/0.4.8.13/share/tor/geoip6", "path to correctly formatted geoip database mapping IPv6 address ranges to country codes")
 	flag.StringVar(&bridgeListFilePath, "bridge-list-path", "", "file path for bridgeListFile")
-	flag.StringVar(&allowedRelayPattern, "allowed-relay-pattern", "", "allowed pattern for relay host name. The broker will reject proxies whose AcceptedRelayPattern is more restrictive than this")
+	flag.DurationVar(&bridgeListWatchInterval, "bridge-list-watch-interval", 10*time.Second, "how often to check the bridge list file for changes to reload; 0 to only reload it on SIGHUP or admin request")
+	flag.DurationVar(&bridgeProbeInterval, "bridge-probe-interval", DefaultBridgeProbeInterval, "how often to check that the bridges accept WebSocket connections; 0 to never check, and consider every bridge up")
+	flag.StringVar(&bridgeFallback, "bridge-fallback", "", "fingerprint of the bridge to give clients asking for a bridge that is down, such as another frontend of the same bridge; without it, these clients get an error")
+	flag.BoolVar(&relayRegions, "relay-regions", true, "send proxies to the relays of a bridge whose regions include the proxy's country, if there are any; otherwise relays are only chosen by weight")
+	flag.StringVar(&adminTokenFile, "admin-token-file", "", "file holding the bearer token of the /admin/ endpoints; they are disabled without it or --admin-client-ca")
+	flag.StringVar(&adminClientCA, "admin-client-ca", "", "PEM file of the certificate authorities whose client certificates may use the /admin/ endpoints instead of the bearer token; requires TLS")
+	flag.StringVar(&allowedRelayPattern, "allowed-relay-pattern", "", "deprecated and ignored: proxies are only matched with clients of the bridges whose relays their AcceptedRelayPattern accepts, and rejected if it accepts none")
 	flag.StringVar(&presumedPatternForLegacyClient, "default-relay-pattern", "", "presumed pattern for legacy client")
 	flag.StringVar(&brokerSQSQueueName, "broker-sqs-name", "", "name of broker SQS queue to listen for incoming messages on")
 	flag.StringVar(&brokerSQSQueueRegion, "broker-sqs-region", "", "name of AWS region of broker SQS queue")
@@ -222,6 +352,12 @@ func main() {
 	flag.BoolVar(&disableGeoip, "disable-geoip", false, "don't use geoip for stats collection")
 	flag.StringVar(&metricsFilename, "metrics-log", "", "path to metrics logging output")
 	flag.BoolVar(&unsafeLogging, "unsafe-logging", false, "prevent logs from being scrubbed")
+	flag.StringVar(&redisAddress, "redis-address", "", "address of a Redis server in which to keep the matching state, so that several brokers can serve the same proxies and clients")
+	flag.StringVar(&matchingPolicy, "matching-policy", matchstore.DefaultMatchPolicy.Name, "which proxies clients are matched with: \"prefer-restricted\" gives unrestricted clients restricted proxies first, \"strict\" gives every client an unrestricted proxy first, \"fallback\" also gives restricted clients a restricted proxy when no unrestricted one is left, and the experimental \"barebones\" ignores NAT types")
+	flag.StringVar(&proxySelector, "proxy-selector", "least-loaded", "how clients are matched with one of the waiting proxies: \"least-loaded\", \"round-robin\", \"geo-diverse\" (avoid proxies in the client's country), \"success-weighted\" (favour proxies that answered their clients), or \"prefer-type\" with an optional list of proxy types such as \"prefer-type:standalone,webext\"; only used when the matching state is kept in memory")
+	flag.DurationVar(&reputationHalfLife, "reputation-half-life", DefaultReputationHalfLife, "how long it takes for the answers and timeouts of proxies to count half as much in the reputation of their IP prefix")
+	flag.Float64Var(&minReputation, "min-proxy-reputation", 0, "reputation score, between 0 and 1, under which proxies are only matched when no better proxy is waiting")
+	flag.StringVar(&rateLimit, "rate-limit", "", "comma-separated endpoint=rate:burst budgets of the requests a host may make to the client, proxy, answer and amp endpoints, with rates in requests per second, such as \"client=0.2:10,proxy=1:30\"; endpoints without a budget are not limited")
 	flag.Parse()
 
 	var err error
@@ -248,22 +384,102 @@ func main() {
 
 	metricsLogger := log.New(metricsFile, "", 0)
 
-	ctx := NewBrokerContext(metricsLogger, allowedRelayPattern, presumedPatternForLegacyClient)
+	if allowedRelayPattern != "" {
+		log.Println("Warning: --allowed-relay-pattern is deprecated and ignored")
+	}
+
+	ctx := NewBrokerContext(metricsLogger, presumedPatternForLegacyClient)
 
 	if bridgeListFilePath != "" {
-		bridgeListFile, err := os.Open(bridgeListFilePath)
+		ctx.bridgeListPath = bridgeListFilePath
+		if _, err := ctx.reloadBridgeList(); err != nil {
+			log.Fatal(err.Error())
+		}
+		if bridgeListWatchInterval > 0 {
+			ctx.WatchBridgeList(bridgeListWatchInterval)
+		}
+	}
+
+	if bridgeFallback != "" {
+		if _, err := bridgefingerprint.FingerprintFromHexString(bridgeFallback); err != nil {
+			log.Fatalf("invalid bridge fallback fingerprint %q: %v", bridgeFallback, err)
+		}
+		ctx.bridgeFallback = bridgeFallback
+	}
+	ctx.relayRegions = relayRegions
+	if bridgeProbeInterval > 0 {
+		ctx.bridgeHealth.Start(bridgeProbeInterval)
+	}
+
+	var auth adminAuth
+	if adminTokenFile != "" {
+		token, err := os.ReadFile(adminTokenFile)
 		if err != nil {
 			log.Fatal(err.Error())
 		}
-		err = ctx.InstallBridgeListProfile(bridgeListFile)
+		auth.token = strings.TrimSpace(string(token))
+		if auth.token == "" {
+			log.Fatalf("admin token file %s is empty", adminTokenFile)
+		}
+	}
+	var adminClientCAs *x509.CertPool
+	if adminClientCA != "" {
+		if disableTLS {
+			log.Fatal("the --admin-client-ca option requires TLS")
+		}
+		pem, err := os.ReadFile(adminClientCA)
 		if err != nil {
 			log.Fatal(err.Error())
 		}
+		adminClientCAs = x509.NewCertPool()
+		if !adminClientCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("no certificate found in admin client CA file %s", adminClientCA)
+		}
+		auth.clientCerts = true
+	}
+	ctx.unsafeLogging = unsafeLogging
+
+	ctx.matchPolicy, err = matchstore.ParseMatchPolicy(matchingPolicy)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if reputationHalfLife <= 0 {
+		log.Fatalf("invalid reputation half-life %v: it must be positive", reputationHalfLife)
+	}
+	ctx.reputation.halfLife = reputationHalfLife
+	ctx.minReputation = minReputation
+	ctx.selector, err = ParseProxySelector(proxySelector, ctx.reputation)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	budgets, err := ratelimit.ParseBudgets(rateLimit)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	var rateLimitStore ratelimit.Store = ratelimit.NewMemoryStore()
+
+	if redisAddress != "" {
+		log.Printf("Keeping matching state in Redis at %s", redisAddress)
+		redisClient := redis.NewClient(&redis.Options{
+			Addr: redisAddress,
+		})
+		redisStore := matchstore.NewRedisStore(redisClient)
+		redisStore.Policy = ctx.matchPolicy
+		redisStore.ProxyTimeout, redisStore.AnswerTimeout = ctx.Timeouts()
+		ctx.store = redisStore
+		// Brokers sharing proxies and clients share their rate limits too.
+		rateLimitStore = ratelimit.NewRedisStore(redisClient)
+	}
+
+	if len(budgets) > 0 {
+		ctx.rateLimiter = ratelimit.NewLimiter(rateLimitStore, budgets)
 	}
 
 	if !disableGeoip {
-		err = ctx.metrics.LoadGeoipDatabases(geoipDatabase, geoip6Database)
-		if err != nil {
+		ctx.geoipDatabase, ctx.geoip6Database = geoipDatabase, geoip6Database
+		if err = ctx.ReloadGeoipDatabases(); err != nil {
 			log.Fatal(err.Error())
 		}
 	}
@@ -274,18 +490,33 @@ func main() {
 
 	http.HandleFunc("/robots.txt", robotsTxtHandler)
 
-	http.Handle("/proxy", SnowflakeHandler{i, proxyPolls})
-	http.Handle("/client", SnowflakeHandler{i, clientOffers})
-	http.Handle("/answer", SnowflakeHandler{i, proxyAnswers})
-	http.Handle("/debug", SnowflakeHandler{i, debugHandler})
+	http.Handle("/proxy", SnowflakeHandler{i, proxyPolls, ratelimit.EndpointProxy})
+	http.Handle("/client", SnowflakeHandler{i, clientOffers, ratelimit.EndpointClient})
+	http.Handle("/answer", SnowflakeHandler{i, proxyAnswers, ratelimit.EndpointAnswer})
+	// The messages of a WebSocket connection are limited one by one.
+	http.Handle("/proxy-ws", SnowflakeHandler{i, proxyWebSocket, ""})
+	http.Handle("/debug", SnowflakeHandler{i, debugHandler, ""})
 	http.Handle("/metrics", MetricsHandler{metricsFilename, metricsHandler})
 	http.Handle("/prometheus", promhttp.HandlerFor(ctx.metrics.promMetrics.registry, promhttp.HandlerOpts{}))
 
-	http.Handle("/amp/client/", SnowflakeHandler{i, ampClientOffers})
+	http.Handle("/amp/client/", SnowflakeHandler{i, ampClientOffers, ratelimit.EndpointAmp})
+
+	if auth.enabled() {
+		for path, handle := range adminHandlers {
+			http.Handle(path, AdminHandler{i, auth, handle})
+		}
+	}
 
 	server := http.Server{
 		Addr: addr,
 	}
+	if adminClientCAs != nil {
+		// Client certificates are only required by the admin endpoints.
+		server.TLSConfig = &tls.Config{
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  adminClientCAs,
+		}
+	}
 
 	// Run SQS Handler to continuously poll and process messages from SQS
 	if brokerSQSQueueName != "" && brokerSQSQueueRegion != "" {
@@ -307,14 +538,19 @@ func main() {
 	signal.Notify(sigChan, syscall.SIGHUP)
 
 	// go routine to handle a SIGHUP signal to allow the broker operator to send
-	// a SIGHUP signal when the geoip database files are updated, without requiring
-	// a restart of the broker
+	// a SIGHUP signal when the geoip database files or the bridge list are
+	// updated, without requiring a restart of the broker
 	go func() {
 		for {
 			signal := <-sigChan
 			log.Printf("Received signal: %s. Reloading geoip databases.", signal)
-			if err = ctx.metrics.LoadGeoipDatabases(geoipDatabase, geoip6Database); err != nil {
-				log.Fatalf("reload of Geo IP databases on signal %s returned error: %v", signal, err)
+			if !disableGeoip {
+				if err = ctx.ReloadGeoipDatabases(); err != nil {
+					log.Fatalf("reload of Geo IP databases on signal %s returned error: %v", signal, err)
+				}
+			}
+			if ctx.bridgeListPath != "" {
+				ctx.ReloadBridgeList(fmt.Sprintf("signal %s", signal))
 			}
 		}
 	}()
@@ -348,7 +584,10 @@ func main() {
 			log.Fatal(http.ListenAndServe(":80", certManager.HTTPHandler(nil)))
 		}()
 
-		server.TLSConfig = &tls.Config{GetCertificate: certManager.GetCertificate}
+		if server.TLSConfig == nil {
+			server.TLSConfig = &tls.Config{}
+		}
+		server.TLSConfig.GetCertificate = certManager.GetCertificate
 		err = server.ListenAndServeTLS("", "")
 	} else if certFilename != "" && keyFilename != "" {
 		if acmeEmail != "" || acmeHostnamesCommas != "" {
@@ -2,14 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/ratelimit"
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/util"
 )
 
@@ -21,6 +27,9 @@ const (
 type SnowflakeHandler struct {
 	*IPC
 	handle func(*IPC, http.ResponseWriter, *http.Request)
+	// endpoint is the endpoint whose rate limit applies to the requests,
+	// or empty if they are not limited.
+	endpoint string
 }
 
 func (sh SnowflakeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -30,6 +39,10 @@ func (sh SnowflakeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if "OPTIONS" == r.Method {
 		return
 	}
+	if sh.endpoint != "" && !sh.IPC.allowRequest(sh.endpoint, util.GetClientIp(r)) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
 	sh.handle(sh.IPC, w, r)
 }
 
@@ -49,6 +62,16 @@ func (mh MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	mh.handle(mh.logFilename, w, r)
 }
 
+// allowRequest reports whether a request of the host at addr to endpoint is
+// within the rate limit of the endpoint, and counts the requests that are not.
+func (i *IPC) allowRequest(endpoint, addr string) bool {
+	if i.ctx.rateLimiter.Allow(context.Background(), endpoint, addr) {
+		return true
+	}
+	i.ctx.metrics.promMetrics.RateLimitedTotal.With(prometheus.Labels{"endpoint": endpoint}).Inc()
+	return false
+}
+
 func robotsTxtHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	if _, err := w.Write([]byte("User-agent: *\nDisallow: /\n")); err != nil {
@@ -126,6 +149,90 @@ func proxyPolls(i *IPC, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+var upgrader = websocket.Upgrader{
+	// Proxies are not browsers, and the HTTP endpoints allow any origin too.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+/*
+For snowflake proxies to keep a WebSocket connection to the Broker, over which
+they send their polls and answers. Polls are answered as soon as a client is
+matched, like those of proxyPolls.
+*/
+func proxyWebSocket(i *IPC, w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an error status.
+		log.Printf("proxyWebSocket unable to upgrade connection: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(readLimit)
+
+	remoteAddr := util.GetClientIp(r)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("proxyWebSocket unable to read message: %v", err)
+			}
+			return
+		}
+
+		kind, body, err := messages.DecodeProxySignalingMessage(data)
+		if err != nil {
+			// Without a type, the reply could not be matched with the
+			// request, so close the connection and let the proxy fall
+			// back to HTTP.
+			log.Printf("proxyWebSocket invalid signaling message: %v", err)
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseUnsupportedData, messages.ErrBadRequest.Error()),
+				time.Now().Add(time.Second))
+			return
+		}
+
+		var response []byte
+		arg := messages.Arg{
+			Body:       body,
+			RemoteAddr: remoteAddr,
+		}
+		switch kind {
+		case messages.ProxySignalingPoll:
+			if !i.allowRequest(ratelimit.EndpointProxy, remoteAddr) {
+				err = messages.ErrRateLimited
+			} else {
+				err = i.ProxyPolls(arg, &response)
+			}
+		case messages.ProxySignalingAnswer:
+			if !i.allowRequest(ratelimit.EndpointAnswer, remoteAddr) {
+				err = messages.ErrRateLimited
+			} else if err = validateSDP(body); err != nil {
+				log.Println("Error proxy SDP: ", err.Error())
+				err = messages.ErrBadRequest
+			} else {
+				err = i.ProxyAnswers(arg, &response)
+			}
+		}
+		switch {
+		case err == nil:
+		case errors.Is(err, messages.ErrBadRequest), errors.Is(err, messages.ErrRateLimited):
+		default:
+			log.Println(err)
+			err = messages.ErrInternal
+		}
+
+		reply, err := messages.EncodeProxySignalingMessage(kind, response, err)
+		if err != nil {
+			log.Printf("proxyWebSocket unable to encode response: %v", err)
+			return
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, reply); err != nil {
+			log.Printf("proxyWebSocket unable to write response: %v", err)
+			return
+		}
+	}
+}
+
 /*
 Expects a WebRTC SDP offer in the Request to give to an assigned
 snowflake proxy, which responds with the SDP answer to be sent in
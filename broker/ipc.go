@@ -2,12 +2,16 @@ package main
 
 import (
 	"container/heap"
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgefingerprint"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgelist"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/matchstore"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
@@ -61,6 +65,8 @@ func (i *IPC) Debug(_ interface{}, response *string) error {
 	s += fmt.Sprintf("\n\trestricted: %d", natRestricted)
 	s += fmt.Sprintf("\n\tunrestricted: %d", natUnrestricted)
 	s += fmt.Sprintf("\n\tunknown: %d", natUnknown)
+	s += "\n" + i.ctx.reputation.String()
+	s += "\n" + i.ctx.bridgeHealth.String()
 
 	*response = s
 	return nil
@@ -84,7 +90,8 @@ func (i *IPC) ProxyPolls(arg messages.Arg, response *[]byte) error {
 		i.ctx.metrics.lock.Unlock()
 	}
 
-	if !i.ctx.CheckProxyRelayPattern(relayPattern, !relayPatternSupported) {
+	relayPattern = i.ctx.ProxyRelayPattern(relayPattern, !relayPatternSupported)
+	if !i.ctx.CheckProxyRelayPattern(relayPattern) {
 		i.ctx.metrics.lock.Lock()
 		i.ctx.metrics.proxyPollRejectedWithRelayURLExtension++
 		i.ctx.metrics.promMetrics.ProxyPollRejectedForRelayURLExtensionTotal.With(prometheus.Labels{"nat": natType, "type": proxyType}).Inc()
@@ -108,11 +115,36 @@ func (i *IPC) ProxyPolls(arg messages.Arg, response *[]byte) error {
 		i.ctx.metrics.UpdateCountryStats(remoteIP, proxyType, natType)
 		i.ctx.metrics.lock.Unlock()
 	}
+	i.ctx.reputation.Record(remoteIP, outcomePoll)
 
 	var b []byte
 
+	// A draining broker sends proxies away as if no client came.
+	if i.ctx.draining.Load() {
+		b, err = messages.EncodePollResponse("", false, "")
+		if err != nil {
+			return messages.ErrInternal
+		}
+		*response = b
+		return nil
+	}
+
 	// Wait for a client to avail an offer to the snowflake, or timeout if nil.
-	offer := i.ctx.RequestOffer(sid, proxyType, natType, clients)
+	offer, err := i.ctx.store.RegisterProxy(context.Background(), &matchstore.Proxy{
+		ID:           sid,
+		ProxyType:    proxyType,
+		NATType:      natType,
+		Clients:      clients,
+		Addr:         remoteIP,
+		RelayPattern: relayPattern,
+	})
+	if errors.Is(err, matchstore.ErrProxyBusy) {
+		log.Printf("Proxy %s polled again while registered", sid)
+		return messages.ErrBadRequest
+	} else if err != nil {
+		log.Println(err)
+		return messages.ErrInternal
+	}
 
 	if offer == nil {
 		i.ctx.metrics.lock.Lock()
@@ -131,16 +163,22 @@ func (i *IPC) ProxyPolls(arg messages.Arg, response *[]byte) error {
 
 	i.ctx.metrics.promMetrics.ProxyPollTotal.With(prometheus.Labels{"nat": natType, "status": "matched"}).Inc()
 	var relayURL string
-	bridgeFingerprint, err := bridgefingerprint.FingerprintFromBytes(offer.fingerprint)
+	bridgeFingerprint, err := bridgefingerprint.FingerprintFromBytes(offer.Fingerprint)
 	if err != nil {
 		return messages.ErrBadRequest
 	}
 	if info, err := i.ctx.bridgeList.GetBridgeInfo(bridgeFingerprint); err != nil {
 		return err
 	} else {
-		relayURL = info.WebSocketAddress
+		var country string
+		if i.ctx.relayRegions {
+			country = i.ctx.metrics.lookupCountry(remoteIP)
+		}
+		relayURL = info.PickAcceptedRelay(country, func(relayURL string) bool {
+			return matchstore.AcceptsRelay(relayPattern, []string{bridgelist.RelayHost(relayURL)})
+		})
 	}
-	b, err = messages.EncodePollResponseWithRelayURL(string(offer.sdp), true, offer.natType, relayURL, "")
+	b, err = messages.EncodePollResponseWithRelayURL(string(offer.SDP), true, offer.NATType, relayURL, "")
 	if err != nil {
 		return messages.ErrInternal
 	}
@@ -169,9 +207,9 @@ func (i *IPC) ClientOffers(arg messages.Arg, response *[]byte) error {
 		return sendClientResponse(&messages.ClientPollResponse{Error: err.Error()}, response)
 	}
 
-	offer := &ClientOffer{
-		natType: req.NAT,
-		sdp:     []byte(req.Offer),
+	offer := &matchstore.Offer{
+		NATType: req.NAT,
+		SDP:     []byte(req.Offer),
 	}
 
 	fingerprint, err := hex.DecodeString(req.Fingerprint)
@@ -184,69 +222,145 @@ func (i *IPC) ClientOffers(arg messages.Arg, response *[]byte) error {
 		return sendClientResponse(&messages.ClientPollResponse{Error: err.Error()}, response)
 	}
 
-	if _, err := i.ctx.GetBridgeInfo(BridgeFingerprint); err != nil {
+	info, err := i.ctx.GetBridgeInfo(BridgeFingerprint)
+	if err != nil {
 		return sendClientResponse(
 			&messages.ClientPollResponse{Error: err.Error()},
 			response,
 		)
 	}
 
-	offer.fingerprint = BridgeFingerprint.ToBytes()
+	if !i.ctx.bridgeHealth.IsUp(req.Fingerprint) {
+		BridgeFingerprint, err = i.ctx.fallbackBridge()
+		if err == nil {
+			info, err = i.ctx.GetBridgeInfo(BridgeFingerprint)
+		}
+		if err != nil {
+			return sendClientResponse(&messages.ClientPollResponse{Error: err.Error()}, response)
+		}
+	}
 
-	snowflake := i.matchSnowflake(offer.natType)
-	if snowflake != nil {
-		snowflake.offerChannel <- offer
-	} else {
+	offer.Fingerprint = BridgeFingerprint.ToBytes()
+
+	// Only proxies willing to connect to a relay of the bridge will do.
+	ctx := context.Background()
+	claimCtx := matchstore.WithRelayHosts(withClientAddr(ctx, arg.RemoteAddr), info.RelayHosts())
+	var proxy *matchstore.Proxy
+	if !i.ctx.matchingPaused.Load() {
+		proxy, err = i.ctx.store.ClaimProxy(claimCtx, offer.NATType)
+		if err != nil {
+			log.Println(err)
+			return messages.ErrInternal
+		}
+	}
+	if proxy == nil {
 		i.ctx.metrics.lock.Lock()
-		i.ctx.metrics.UpdateRendezvousStats(arg.RemoteAddr, arg.RendezvousMethod, offer.natType, false)
+		i.ctx.metrics.UpdateRendezvousStats(arg.RemoteAddr, arg.RendezvousMethod, offer.NATType, false)
 		i.ctx.metrics.lock.Unlock()
 		resp := &messages.ClientPollResponse{Error: messages.StrNoProxies}
 		return sendClientResponse(resp, response)
 	}
+	defer i.ctx.store.Expire(ctx, proxy)
+	i.ctx.reputation.Record(proxy.Addr, outcomeMatch)
+
+	if err := i.ctx.store.DeliverOffer(ctx, proxy, offer); err != nil {
+		log.Println(err)
+		return messages.ErrInternal
+	}
 
-	// Wait for the answer to be returned on the channel or timeout.
-	select {
-	case answer := <-snowflake.answerChannel:
+	// Wait for the answer to be returned by the proxy or timeout.
+	answer, err := i.ctx.store.WaitForAnswer(ctx, proxy)
+	switch {
+	case err == nil:
+		i.ctx.reputation.Record(proxy.Addr, outcomeAnswer)
 		i.ctx.metrics.lock.Lock()
-		i.ctx.metrics.UpdateRendezvousStats(arg.RemoteAddr, arg.RendezvousMethod, offer.natType, true)
+		i.ctx.metrics.UpdateRendezvousStats(arg.RemoteAddr, arg.RendezvousMethod, offer.NATType, true)
 		i.ctx.metrics.lock.Unlock()
 		resp := &messages.ClientPollResponse{Answer: answer}
 		err = sendClientResponse(resp, response)
 		// Initial tracking of elapsed time.
 		i.ctx.metrics.clientRoundtripEstimate = time.Since(startTime) / time.Millisecond
-	case <-time.After(time.Second * ClientTimeout):
+	case errors.Is(err, matchstore.ErrTimeout):
+		i.ctx.reputation.Record(proxy.Addr, outcomeTimeout)
 		log.Println("Client: Timed out.")
 		resp := &messages.ClientPollResponse{Error: messages.StrTimedOut}
 		err = sendClientResponse(resp, response)
+	default:
+		log.Println(err)
+		err = messages.ErrInternal
 	}
 
-	i.ctx.snowflakeLock.Lock()
-	i.ctx.metrics.promMetrics.AvailableProxies.With(prometheus.Labels{"nat": snowflake.natType, "type": snowflake.proxyType}).Dec()
-	delete(i.ctx.idToSnowflake, snowflake.id)
-	i.ctx.snowflakeLock.Unlock()
-
 	return err
 }
 
-func (i *IPC) matchSnowflake(natType string) *Snowflake {
-	i.ctx.snowflakeLock.Lock()
-	defer i.ctx.snowflakeLock.Unlock()
+// fallbackBridge returns the bridge to give clients asking for a bridge that
+// is down, or ErrBridgeDown if there is none available.
+func (ctx *BrokerContext) fallbackBridge() (bridgefingerprint.Fingerprint, error) {
+	if ctx.bridgeFallback == "" || !ctx.bridgeHealth.IsUp(ctx.bridgeFallback) {
+		return "", ErrBridgeDown
+	}
+	fingerprint, err := bridgefingerprint.FingerprintFromHexString(ctx.bridgeFallback)
+	if err != nil {
+		return "", ErrBridgeDown
+	}
+	if _, err := ctx.GetBridgeInfo(fingerprint); err != nil {
+		return "", ErrBridgeDown
+	}
+	return fingerprint, nil
+}
 
-	// Proiritize known restricted snowflakes for unrestricted clients
-	if natType == NATUnrestricted && i.ctx.restrictedSnowflakes.Len() > 0 {
-		return heap.Pop(i.ctx.restrictedSnowflakes).(*Snowflake)
+// matchSnowflake takes a snowflake for the client out of the heaps, trying
+// the heaps in the order given by the matching policy and leaving the choice
+// within a heap to the proxy selector. Only snowflakes accepting a relay of
+// the client's bridge are considered.
+func (ctx *BrokerContext) matchSnowflake(client *clientInfo) *Snowflake {
+	ctx.snowflakeLock.Lock()
+	defer ctx.snowflakeLock.Unlock()
+
+	for _, pool := range ctx.matchPolicy.Pools(client.natType) {
+		snowflakes := ctx.restrictedSnowflakes
+		if pool == NATUnrestricted {
+			snowflakes = ctx.snowflakes
+		}
+		if candidates := acceptingRelay(*snowflakes, client.relayHosts); len(candidates) > 0 {
+			snowflake := ctx.selector.Select(ctx.reputable(candidates), client)
+			return heap.Remove(snowflakes, snowflake.index).(*Snowflake)
+		}
 	}
+	return nil
+}
 
-	if i.ctx.restrictedSnowflakes.Len() > 0 {
-		log.Println("matched restricted snowflake")
-		return heap.Pop(i.ctx.restrictedSnowflakes).(*Snowflake)
+// acceptingRelay returns the snowflakes whose relay pattern accepts one of the
+// relay host names, or all of them if hosts is nil.
+func acceptingRelay(snowflakes []*Snowflake, hosts []string) []*Snowflake {
+	if hosts == nil {
+		return snowflakes
 	}
+	var accepting []*Snowflake
+	for _, snowflake := range snowflakes {
+		if matchstore.AcceptsRelay(snowflake.relayPattern, hosts) {
+			accepting = append(accepting, snowflake)
+		}
+	}
+	return accepting
+}
 
-	// if i.ctx.snowflakes.Len() > 0 {
-	// 	return heap.Pop(i.ctx.snowflakes).(*Snowflake)
-	// }
-	log.Println("unable to match snowflake")
-	return nil
+// reputable returns the snowflakes whose prefix has at least the minimum
+// reputation, or all of them if there are none.
+func (ctx *BrokerContext) reputable(snowflakes []*Snowflake) []*Snowflake {
+	if ctx.minReputation <= 0 {
+		return snowflakes
+	}
+	var reputable []*Snowflake
+	for _, snowflake := range snowflakes {
+		if ctx.reputation.Score(snowflake.addr) >= ctx.minReputation {
+			reputable = append(reputable, snowflake)
+		}
+	}
+	if len(reputable) == 0 {
+		return snowflakes
+	}
+	return reputable
 }
 
 func (i *IPC) ProxyAnswers(arg messages.Arg, response *[]byte) error {
@@ -256,14 +370,13 @@ func (i *IPC) ProxyAnswers(arg messages.Arg, response *[]byte) error {
 	}
 
 	var success = true
-	i.ctx.snowflakeLock.Lock()
-	snowflake, ok := i.ctx.idToSnowflake[id]
-	i.ctx.snowflakeLock.Unlock()
-	if !ok || snowflake == nil {
-		// The snowflake took too long to respond with an answer, so its client
-		// disappeared / the snowflake is no longer recognized by the Broker.
+	err = i.ctx.store.DeliverAnswer(context.Background(), id, answer)
+	if errors.Is(err, matchstore.ErrClientGone) {
 		success = false
 		log.Printf("Warning: matching with snowflake client failed")
+	} else if err != nil {
+		log.Println(err)
+		return messages.ErrInternal
 	}
 
 	b, err := messages.EncodeAnswerResponse(success)
@@ -273,9 +386,5 @@ func (i *IPC) ProxyAnswers(arg messages.Arg, response *[]byte) error {
 	}
 	*response = b
 
-	if success {
-		snowflake.answerChannel <- answer
-	}
-
 	return nil
 }
@@ -0,0 +1,112 @@
+/*
+In-memory MatchStore backed by the broker's snowflake heaps.
+*/
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/matchstore"
+)
+
+// memoryStore implements matchstore.MatchStore on top of a BrokerContext.
+// Proxies are kept in the snowflake heaps and offers and answers travel over
+// the channels of each Snowflake.
+type memoryStore struct {
+	ctx *BrokerContext
+}
+
+func (s *memoryStore) RegisterProxy(_ context.Context, proxy *matchstore.Proxy) (*matchstore.Offer, error) {
+	offer := s.ctx.requestOffer(&ProxyPoll{
+		id:           proxy.ID,
+		proxyType:    proxy.ProxyType,
+		natType:      proxy.NATType,
+		clients:      proxy.Clients,
+		addr:         proxy.Addr,
+		relayPattern: proxy.RelayPattern,
+	})
+	if offer == nil {
+		return nil, nil
+	}
+	return &matchstore.Offer{
+		NATType:     offer.natType,
+		SDP:         offer.sdp,
+		Fingerprint: offer.fingerprint,
+	}, nil
+}
+
+func (s *memoryStore) ClaimProxy(ctx context.Context, natType string) (*matchstore.Proxy, error) {
+	snowflake := s.ctx.matchSnowflake(&clientInfo{
+		natType:    natType,
+		country:    s.ctx.metrics.lookupCountry(clientAddrFrom(ctx)),
+		relayHosts: matchstore.RelayHosts(ctx),
+	})
+	if snowflake == nil {
+		return nil, nil
+	}
+	return &matchstore.Proxy{
+		ID:           snowflake.id,
+		ProxyType:    snowflake.proxyType,
+		NATType:      snowflake.natType,
+		Clients:      snowflake.clients,
+		Addr:         snowflake.addr,
+		RelayPattern: snowflake.relayPattern,
+	}, nil
+}
+
+func (s *memoryStore) DeliverOffer(_ context.Context, proxy *matchstore.Proxy, offer *matchstore.Offer) error {
+	snowflake := s.lookup(proxy.ID)
+	if snowflake == nil {
+		return matchstore.ErrProxyGone
+	}
+	snowflake.offerChannel <- &ClientOffer{
+		natType:     offer.NATType,
+		sdp:         offer.SDP,
+		fingerprint: offer.Fingerprint,
+	}
+	return nil
+}
+
+func (s *memoryStore) WaitForAnswer(_ context.Context, proxy *matchstore.Proxy) (string, error) {
+	snowflake := s.lookup(proxy.ID)
+	if snowflake == nil {
+		return "", matchstore.ErrTimeout
+	}
+	_, clientTimeout := s.ctx.Timeouts()
+	select {
+	case answer := <-snowflake.answerChannel:
+		return answer, nil
+	case <-time.After(clientTimeout):
+		return "", matchstore.ErrTimeout
+	}
+}
+
+func (s *memoryStore) DeliverAnswer(_ context.Context, id string, answer string) error {
+	snowflake := s.lookup(id)
+	if snowflake == nil {
+		// The snowflake took too long to respond with an answer, so its client
+		// disappeared / the snowflake is no longer recognized by the Broker.
+		return matchstore.ErrClientGone
+	}
+	snowflake.answerChannel <- answer
+	return nil
+}
+
+func (s *memoryStore) Expire(_ context.Context, proxy *matchstore.Proxy) error {
+	s.ctx.snowflakeLock.Lock()
+	defer s.ctx.snowflakeLock.Unlock()
+	if _, ok := s.ctx.idToSnowflake[proxy.ID]; ok {
+		s.ctx.metrics.promMetrics.AvailableProxies.With(prometheus.Labels{"nat": proxy.NATType, "type": proxy.ProxyType}).Dec()
+		delete(s.ctx.idToSnowflake, proxy.ID)
+	}
+	return nil
+}
+
+func (s *memoryStore) lookup(id string) *Snowflake {
+	s.ctx.snowflakeLock.Lock()
+	defer s.ctx.snowflakeLock.Unlock()
+	return s.ctx.idToSnowflake[id]
+}
@@ -147,6 +147,24 @@ func (m *Metrics) UpdateCountryStats(addr string, proxyType string, natType stri
 	}
 }
 
+// lookupCountry returns the country code of addr, or "" if it is unknown.
+func (m *Metrics) lookupCountry(addr string) string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.geoipdb == nil || addr == "" {
+		return ""
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	country, ok := m.geoipdb.GetCountryByAddr(ip)
+	if !ok {
+		return ""
+	}
+	return country
+}
+
 func (m *Metrics) UpdateRendezvousStats(addr string, rendezvousMethod messages.RendezvousMethod, natType string, matched bool) {
 	ip := net.ParseIP(addr)
 	country := "??"
@@ -202,11 +220,16 @@ func (m *Metrics) DisplayRendezvousStatsByCountry(rendezvoudMethod messages.Rend
 
 func (m *Metrics) LoadGeoipDatabases(geoipDB string, geoip6DB string) error {
 
-	// Load geoip databases
-	var err error
+	// Load geoip databases, keeping the current ones on failure
 	log.Println("Loading geoip databases")
-	m.geoipdb, err = geoip.New(geoipDB, geoip6DB)
-	return err
+	geoipdb, err := geoip.New(geoipDB, geoip6DB)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	m.geoipdb = geoipdb
+	m.lock.Unlock()
+	return nil
 }
 
 func NewMetrics(metricsLogger *log.Logger) (*Metrics, error) {
@@ -339,6 +362,11 @@ type PromMetrics struct {
 	ProxyPollWithoutRelayURLExtensionTotal *safeprom.CounterVec
 
 	ProxyPollRejectedForRelayURLExtensionTotal *safeprom.CounterVec
+
+	RateLimitedTotal *prometheus.CounterVec
+
+	BridgeListReloadsTotal *prometheus.CounterVec
+	BridgeListChangesTotal *prometheus.CounterVec
 }
 
 // Initialize metrics for prometheus exporter
@@ -410,6 +438,33 @@ func initPrometheus() *PromMetrics {
 		[]string{"nat", "status", "cc", "rendezvous_method"},
 	)
 
+	promMetrics.RateLimitedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "rate_limited_total",
+			Help:      "The number of requests refused for exceeding the rate limit of their endpoint",
+		},
+		[]string{"endpoint"},
+	)
+
+	promMetrics.BridgeListReloadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "bridge_list_reloads_total",
+			Help:      "The number of reloads of the bridge list file",
+		},
+		[]string{"status"},
+	)
+
+	promMetrics.BridgeListChangesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "bridge_list_changes_total",
+			Help:      "The number of bridges added, removed or changed by reloads of the bridge list file",
+		},
+		[]string{"change"},
+	)
+
 	// We need to register our metrics so they can be exported.
 	promMetrics.registry.MustRegister(
 		promMetrics.ClientPollTotal, promMetrics.ProxyPollTotal,
@@ -417,6 +472,8 @@ func initPrometheus() *PromMetrics {
 		promMetrics.ProxyPollWithRelayURLExtensionTotal,
 		promMetrics.ProxyPollWithoutRelayURLExtensionTotal,
 		promMetrics.ProxyPollRejectedForRelayURLExtensionTotal,
+		promMetrics.RateLimitedTotal,
+		promMetrics.BridgeListReloadsTotal, promMetrics.BridgeListChangesTotal,
 	)
 
 	return promMetrics
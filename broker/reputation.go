@@ -0,0 +1,222 @@
+/*
+Tracking the reputation of proxies from the outcomes of their polls.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The outcomes recorded for a proxy.
+const (
+	// outcomePoll is recorded when a proxy polls for a client.
+	outcomePoll = "poll"
+	// outcomeMatch is recorded when a proxy is matched with a client.
+	outcomeMatch = "match"
+	// outcomeAnswer is recorded when a matched proxy answers its client in
+	// time.
+	outcomeAnswer = "answer"
+	// outcomeTimeout is recorded when the client of a matched proxy gives
+	// up waiting for its answer.
+	outcomeTimeout = "timeout"
+)
+
+const (
+	// DefaultReputationHalfLife is how long it takes for the outcomes of a
+	// prefix to count half as much.
+	DefaultReputationHalfLife = 6 * time.Hour
+	// reputationSweepInterval is how often forgotten prefixes are removed.
+	reputationSweepInterval = time.Hour
+	// reputationForgotten is the weight under which the outcomes of a
+	// prefix are forgotten.
+	reputationForgotten = 0.01
+)
+
+// reputationBuckets are the upper bounds of the score ranges the prefixes are
+// counted in by /debug and Prometheus.
+var reputationBuckets = []float64{0.25, 0.5, 0.75, 1}
+
+// proxyPrefix returns the prefix proxies polling from addr are tracked by: the
+// /24 of IPv4 addresses and the /64 of IPv6 addresses. Several proxies behind
+// the same network usually share their fate.
+func proxyPrefix(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// reputationRecord holds the decayed counts of the outcomes of a prefix as of
+// updated.
+type reputationRecord struct {
+	outcomes map[string]float64
+	updated  time.Time
+}
+
+// ProxyReputation records the outcomes of the proxies of each IP prefix, with
+// older outcomes counting exponentially less, and scores the prefixes by how
+// often their proxies answered the clients they were matched with.
+//
+// ProxyReputation is a prometheus.Collector exporting the number of prefixes
+// in each score range and the number of recorded outcomes; the prefixes
+// themselves are never exported.
+type ProxyReputation struct {
+	lock      sync.Mutex
+	halfLife  time.Duration
+	prefixes  map[string]*reputationRecord
+	lastSweep time.Time
+	now       func() time.Time
+
+	outcomesTotal *prometheus.CounterVec
+	prefixesDesc  *prometheus.Desc
+}
+
+func NewProxyReputation(halfLife time.Duration) *ProxyReputation {
+	return &ProxyReputation{
+		halfLife: halfLife,
+		prefixes: make(map[string]*reputationRecord),
+		now:      time.Now,
+		outcomesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: prometheusNamespace,
+				Name:      "proxy_outcomes_total",
+				Help:      "The number of proxy polls, matches, answers and timeouts recorded for proxy reputation",
+			},
+			[]string{"outcome"},
+		),
+		prefixesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(prometheusNamespace, "", "proxy_reputation_prefixes"),
+			"The number of proxy IP prefixes by reputation score range, labelled by the upper bound of the range",
+			[]string{"score"}, nil,
+		),
+	}
+}
+
+// decay brings the counts of record up to now. It must be called with the
+// lock held.
+func (r *ProxyReputation) decay(record *reputationRecord, now time.Time) {
+	elapsed := now.Sub(record.updated)
+	if elapsed <= 0 {
+		return
+	}
+	factor := math.Pow(0.5, float64(elapsed)/float64(r.halfLife))
+	for outcome, count := range record.outcomes {
+		record.outcomes[outcome] = count * factor
+	}
+	record.updated = now
+}
+
+// forgotten reports whether the counts of record are all too small to matter.
+func forgotten(record *reputationRecord) bool {
+	for _, count := range record.outcomes {
+		if count >= reputationForgotten {
+			return false
+		}
+	}
+	return true
+}
+
+// Record records an outcome for the proxy polling from addr.
+func (r *ProxyReputation) Record(addr string, outcome string) {
+	prefix := proxyPrefix(addr)
+	if prefix == "" {
+		return
+	}
+	r.outcomesTotal.With(prometheus.Labels{"outcome": outcome}).Inc()
+
+	now := r.now()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if now.Sub(r.lastSweep) >= reputationSweepInterval {
+		for prefix, record := range r.prefixes {
+			r.decay(record, now)
+			if forgotten(record) {
+				delete(r.prefixes, prefix)
+			}
+		}
+		r.lastSweep = now
+	}
+
+	record, ok := r.prefixes[prefix]
+	if !ok {
+		record = &reputationRecord{outcomes: make(map[string]float64), updated: now}
+		r.prefixes[prefix] = record
+	}
+	r.decay(record, now)
+	record.outcomes[outcome]++
+}
+
+// score returns the score of a record: the estimated chance that a matched
+// proxy answers, starting at one half without outcomes. It must be called with
+// the lock held.
+func (r *ProxyReputation) score(record *reputationRecord, now time.Time) float64 {
+	if record == nil {
+		return 0.5
+	}
+	r.decay(record, now)
+	answers, timeouts := record.outcomes[outcomeAnswer], record.outcomes[outcomeTimeout]
+	return (answers + 1) / (answers + timeouts + 2)
+}
+
+// Score returns the score of the prefix of the proxy polling from addr,
+// between 0 and 1.
+func (r *ProxyReputation) Score(addr string) float64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.score(r.prefixes[proxyPrefix(addr)], r.now())
+}
+
+// Distribution returns the number of prefixes in each score range, one for each
+// of reputationBuckets.
+func (r *ProxyReputation) Distribution() []int {
+	now := r.now()
+	counts := make([]int, len(reputationBuckets))
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, record := range r.prefixes {
+		score := r.score(record, now)
+		for i, bound := range reputationBuckets {
+			if score <= bound {
+				counts[i]++
+				break
+			}
+		}
+	}
+	return counts
+}
+
+// String summarizes the distribution of scores for /debug.
+func (r *ProxyReputation) String() string {
+	s := "Proxy reputation (prefixes by score):"
+	lower := 0.0
+	for i, count := range r.Distribution() {
+		s += fmt.Sprintf("\n\t%.2f-%.2f: %d", lower, reputationBuckets[i], count)
+		lower = reputationBuckets[i]
+	}
+	return s
+}
+
+func (r *ProxyReputation) Describe(ch chan<- *prometheus.Desc) {
+	r.outcomesTotal.Describe(ch)
+	ch <- r.prefixesDesc
+}
+
+func (r *ProxyReputation) Collect(ch chan<- prometheus.Metric) {
+	r.outcomesTotal.Collect(ch)
+	for i, count := range r.Distribution() {
+		ch <- prometheus.MustNewConstMetric(r.prefixesDesc, prometheus.GaugeValue,
+			float64(count), fmt.Sprintf("%g", reputationBuckets[i]))
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Strategies for choosing which of the waiting snowflakes a client is matched
+with.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// clientInfo describes the client a snowflake is selected for.
+type clientInfo struct {
+	natType string
+	// country is the country code of the client, or "" if unknown.
+	country string
+	// relayHosts are the host names of the relays of the bridge the client
+	// asked for, or nil if any snowflake will do.
+	relayHosts []string
+}
+
+type clientAddrKey struct{}
+
+// withClientAddr returns a context carrying the address of the client a proxy
+// is claimed for, so that the in-memory store can select a proxy for it.
+func withClientAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+func clientAddrFrom(ctx context.Context) string {
+	addr, _ := ctx.Value(clientAddrKey{}).(string)
+	return addr
+}
+
+// ProxySelector chooses which of the snowflakes waiting in a NAT pool is
+// matched with a client. The snowflakes are in no particular order, and there
+// is at least one. Selectors are called with the snowflake lock held.
+type ProxySelector interface {
+	Select(snowflakes []*Snowflake, client *clientInfo) *Snowflake
+}
+
+// selectBest returns the snowflake with the lowest rank, breaking ties in
+// favour of the least loaded one.
+func selectBest(snowflakes []*Snowflake, rank func(*Snowflake) int) *Snowflake {
+	var best *Snowflake
+	bestRank := 0
+	for _, snowflake := range snowflakes {
+		r := rank(snowflake)
+		if best == nil || r < bestRank || (r == bestRank && snowflake.clients < best.clients) {
+			best, bestRank = snowflake, r
+		}
+	}
+	return best
+}
+
+// leastLoadedSelector selects the snowflake serving the fewest clients. It is
+// the default.
+type leastLoadedSelector struct{}
+
+func (leastLoadedSelector) Select(snowflakes []*Snowflake, _ *clientInfo) *Snowflake {
+	return selectBest(snowflakes, func(*Snowflake) int { return 0 })
+}
+
+// roundRobinSelector selects the snowflake that has been waiting the longest,
+// so that every polling proxy gets its turn.
+type roundRobinSelector struct{}
+
+func (roundRobinSelector) Select(snowflakes []*Snowflake, _ *clientInfo) *Snowflake {
+	oldest := snowflakes[0]
+	for _, snowflake := range snowflakes[1:] {
+		if snowflake.seq < oldest.seq {
+			oldest = snowflake
+		}
+	}
+	return oldest
+}
+
+// geoDiverseSelector avoids matching clients with proxies in their own
+// country, where both are more likely to be behind the same censor. Proxies of
+// unknown country come after those known to be elsewhere.
+type geoDiverseSelector struct{}
+
+func (geoDiverseSelector) Select(snowflakes []*Snowflake, client *clientInfo) *Snowflake {
+	return selectBest(snowflakes, func(snowflake *Snowflake) int {
+		if client.country == "" {
+			return 0
+		}
+		switch snowflake.country {
+		case client.country:
+			return 2
+		case "":
+			return 1
+		default:
+			return 0
+		}
+	})
+}
+
+// DefaultProxyTypePreference is the order in which proxy types are preferred
+// by the "prefer-type" selector, most reliable first. Unlisted types come
+// last.
+var DefaultProxyTypePreference = []string{"standalone", "iptproxy", "webext", "badge"}
+
+// typePreferenceSelector selects proxies by type, in order of preference.
+type typePreferenceSelector struct {
+	types []string
+}
+
+func (s typePreferenceSelector) Select(snowflakes []*Snowflake, _ *clientInfo) *Snowflake {
+	return selectBest(snowflakes, func(snowflake *Snowflake) int {
+		for i, proxyType := range s.types {
+			if snowflake.proxyType == proxyType {
+				return i
+			}
+		}
+		return len(s.types)
+	})
+}
+
+// successWeightedSelector selects proxies at random, weighted by the
+// reputation of their IP prefix.
+type successWeightedSelector struct {
+	reputation *ProxyReputation
+	rand       *rand.Rand
+}
+
+func (s *successWeightedSelector) Select(snowflakes []*Snowflake, _ *clientInfo) *Snowflake {
+	weights := make([]float64, len(snowflakes))
+	var total float64
+	for i, snowflake := range snowflakes {
+		weights[i] = s.reputation.Score(snowflake.addr)
+		total += weights[i]
+	}
+	x := s.rand.Float64() * total
+	for i, weight := range weights {
+		if x < weight {
+			return snowflakes[i]
+		}
+		x -= weight
+	}
+	return snowflakes[len(snowflakes)-1]
+}
+
+// ParseProxySelector returns the selector described by spec: "least-loaded",
+// "round-robin", "geo-diverse", "success-weighted", or "prefer-type", which
+// may be followed by a colon and a comma-separated list of proxy types in
+// order of preference, such as "prefer-type:standalone,webext".
+func ParseProxySelector(spec string, reputation *ProxyReputation) (ProxySelector, error) {
+	name, arg, hasArg := strings.Cut(spec, ":")
+	if hasArg && name != "prefer-type" {
+		return nil, fmt.Errorf("proxy selector %q takes no argument", name)
+	}
+	switch name {
+	case "", "least-loaded":
+		return leastLoadedSelector{}, nil
+	case "round-robin":
+		return roundRobinSelector{}, nil
+	case "geo-diverse":
+		return geoDiverseSelector{}, nil
+	case "success-weighted":
+		return &successWeightedSelector{
+			reputation: reputation,
+			rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		}, nil
+	case "prefer-type":
+		types := DefaultProxyTypePreference
+		if hasArg {
+			types = nil
+			for _, proxyType := range strings.Split(arg, ",") {
+				if proxyType = strings.TrimSpace(proxyType); proxyType != "" {
+					types = append(types, proxyType)
+				}
+			}
+		}
+		return typePreferenceSelector{types}, nil
+	}
+	return nil, fmt.Errorf("unknown proxy selector %q", name)
+}
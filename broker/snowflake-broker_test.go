@@ -3,20 +3,34 @@ package main
 import (
 	"bytes"
 	"container/heap"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	. "github.com/smartystreets/goconvey/convey"
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/amp"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgefingerprint"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgelist"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/matchstore"
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/ratelimit"
 )
 
 func NullLogger() *log.Logger {
@@ -89,7 +103,7 @@ func TestBroker(t *testing.T) {
 
 	Convey("Context", t, func() {
 		buf := new(bytes.Buffer)
-		ctx := NewBrokerContext(log.New(buf, "", 0), "", "")
+		ctx := NewBrokerContext(log.New(buf, "", 0), "")
 		i := &IPC{ctx}
 
 		Convey("Adds Snowflake", func() {
@@ -131,6 +145,31 @@ func TestBroker(t *testing.T) {
 			So(offer.sdp, ShouldResemble, []byte("test offer"))
 		})
 
+		Convey("Matches through the in-memory MatchStore", func() {
+			bg := context.Background()
+			snowflake := ctx.AddSnowflake("test", "", NATRestricted, 0)
+
+			proxy, err := ctx.store.ClaimProxy(bg, NATUnrestricted)
+			So(err, ShouldBeNil)
+			So(proxy, ShouldNotBeNil)
+			So(proxy.ID, ShouldEqual, "test")
+			So(proxy.NATType, ShouldEqual, NATRestricted)
+			So(ctx.restrictedSnowflakes.Len(), ShouldEqual, 0)
+
+			go ctx.store.DeliverOffer(bg, proxy, &matchstore.Offer{SDP: []byte("test offer")})
+			offer := <-snowflake.offerChannel
+			So(offer.sdp, ShouldResemble, []byte("test offer"))
+
+			go ctx.store.DeliverAnswer(bg, "test", "test answer")
+			answer, err := ctx.store.WaitForAnswer(bg, proxy)
+			So(err, ShouldBeNil)
+			So(answer, ShouldEqual, "test answer")
+
+			So(ctx.store.Expire(bg, proxy), ShouldBeNil)
+			So(ctx.idToSnowflake["test"], ShouldBeNil)
+			So(ctx.store.DeliverAnswer(bg, "test", "late answer"), ShouldEqual, matchstore.ErrClientGone)
+		})
+
 		Convey("Responds to HTTP client offers...", func() {
 			w := httptest.NewRecorder()
 			data, err := createClientOffer(sdp, NATUnknown, "")
@@ -484,10 +523,102 @@ client-sqs-ips
 
 		})
 
+		Convey("Responds to proxy polls and answers over a WebSocket...", func() {
+			server := httptest.NewServer(SnowflakeHandler{i, proxyWebSocket, ""})
+			defer server.Close()
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+
+			exchange := func(kind string, body []byte) (string, []byte, error) {
+				message, err := messages.EncodeProxySignalingMessage(kind, body, nil)
+				So(err, ShouldBeNil)
+				So(conn.WriteMessage(websocket.TextMessage, message), ShouldBeNil)
+				_, reply, err := conn.ReadMessage()
+				So(err, ShouldBeNil)
+				return messages.DecodeProxySignalingMessage(reply)
+			}
+
+			Convey("with a client offer if available, then the client's answer.", func() {
+				go func() {
+					p := <-ctx.proxyPolls
+					p.offerChannel <- &ClientOffer{sdp: []byte("fake offer"), fingerprint: defaultBridge[:]}
+				}()
+				kind, body, err := exchange(messages.ProxySignalingPoll, []byte(`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.0"}`))
+				So(err, ShouldBeNil)
+				So(kind, ShouldEqual, messages.ProxySignalingPoll)
+				So(string(body), ShouldEqual, `{"Status":"client match","Offer":"fake offer","NAT":"","RelayURL":"wss://snowflake.torproject.net/"}`)
+
+				s := ctx.AddSnowflake(sid, "", NATUnrestricted, 0)
+				answer, err := messages.EncodeAnswerRequest(sdp, sid)
+				So(err, ShouldBeNil)
+				go func() {
+					<-s.answerChannel
+				}()
+				kind, body, err = exchange(messages.ProxySignalingAnswer, answer)
+				So(err, ShouldBeNil)
+				So(kind, ShouldEqual, messages.ProxySignalingAnswer)
+				So(string(body), ShouldEqual, `{"Status":"success"}`)
+			})
+
+			Convey("with an error if the proxy sends an invalid answer.", func() {
+				kind, _, err := exchange(messages.ProxySignalingAnswer, []byte(`{}`))
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, messages.ErrBadRequest.Error())
+				So(kind, ShouldEqual, messages.ProxySignalingAnswer)
+			})
+
+			Convey("by closing the connection if the proxy sends an invalid message.", func() {
+				for _, message := range []string{`{`, `{"Type":"offer"}`} {
+					conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+					So(err, ShouldBeNil)
+					defer conn.Close()
+					So(conn.WriteMessage(websocket.TextMessage, []byte(message)), ShouldBeNil)
+					_, _, err = conn.ReadMessage()
+					So(websocket.IsCloseError(err, websocket.CloseUnsupportedData), ShouldBeTrue)
+				}
+			})
+		})
+
+		Convey("Limits the rate of requests...", func() {
+			ctx.rateLimiter = ratelimit.NewLimiter(ratelimit.NewMemoryStore(), ratelimit.Budgets{
+				ratelimit.EndpointProxy: {Rate: 0.001, Burst: 1},
+			})
+			handler := SnowflakeHandler{i, proxyPolls, ratelimit.EndpointProxy}
+			poll := func(remoteAddr string) int {
+				r, err := http.NewRequest("POST", "snowflake.broker/proxy", bytes.NewReader(nil))
+				So(err, ShouldBeNil)
+				r.RemoteAddr = remoteAddr
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				return w.Code
+			}
+
+			Convey("with 429 once a host is over its budget.", func() {
+				So(poll("192.0.2.1:1234"), ShouldEqual, http.StatusBadRequest)
+				So(poll("192.0.2.1:5678"), ShouldEqual, http.StatusTooManyRequests)
+				So(poll("192.0.2.2:1234"), ShouldEqual, http.StatusBadRequest)
+				So(testutil.ToFloat64(ctx.metrics.promMetrics.RateLimitedTotal.With(prometheus.Labels{"endpoint": "proxy"})), ShouldEqual, 1)
+			})
+
+			Convey("of IPv6 hosts by /64.", func() {
+				So(poll("[2001:db8::1]:1234"), ShouldEqual, http.StatusBadRequest)
+				So(poll("[2001:db8::2]:1234"), ShouldEqual, http.StatusTooManyRequests)
+			})
+
+			Convey("but not of endpoints without a budget.", func() {
+				handler.endpoint = ratelimit.EndpointAnswer
+				handler.handle = proxyAnswers
+				for n := 0; n < 3; n++ {
+					So(poll("192.0.2.1:1234"), ShouldEqual, http.StatusBadRequest)
+				}
+			})
+		})
+
 	})
 
 	Convey("End-To-End", t, func() {
-		ctx := NewBrokerContext(NullLogger(), "", "")
+		ctx := NewBrokerContext(NullLogger(), "")
 		i := &IPC{ctx}
 
 		Convey("Check for client/proxy data race", func() {
@@ -594,6 +725,620 @@ client-sqs-ips
 	})
 }
 
+func TestMatchPolicies(t *testing.T) {
+	r, u := NATRestricted, NATUnrestricted
+	Convey("Matches snowflakes according to the matching policy", t, func() {
+		for _, test := range []struct {
+			policy *matchstore.MatchPolicy
+			client string
+			// NAT pools the client may be matched from, in order of
+			// preference.
+			pools []string
+		}{
+			{matchstore.PolicyPreferRestricted, NATUnrestricted, []string{r, u}},
+			{matchstore.PolicyPreferRestricted, NATRestricted, []string{u}},
+			{matchstore.PolicyPreferRestricted, NATUnknown, []string{u}},
+			{matchstore.PolicyStrict, NATUnrestricted, []string{u, r}},
+			{matchstore.PolicyStrict, NATRestricted, []string{u}},
+			{matchstore.PolicyStrict, NATUnknown, []string{u}},
+			{matchstore.PolicyFallback, NATUnrestricted, []string{r, u}},
+			{matchstore.PolicyFallback, NATRestricted, []string{u, r}},
+			{matchstore.PolicyFallback, NATUnknown, []string{u, r}},
+			{matchstore.PolicyBarebones, NATUnrestricted, []string{r, u}},
+			{matchstore.PolicyBarebones, NATRestricted, []string{r, u}},
+			{matchstore.PolicyBarebones, NATUnknown, []string{r, u}},
+		} {
+			for _, proxies := range [][]string{
+				nil,
+				{NATRestricted},
+				{NATUnknown},
+				{NATUnrestricted},
+				{NATRestricted, NATUnrestricted},
+				{NATUnknown, NATUnrestricted},
+			} {
+				ctx := NewBrokerContext(NullLogger(), "")
+				ctx.matchPolicy = test.policy
+				waiting := make(map[string]string)
+				for _, natType := range proxies {
+					ctx.AddSnowflake("proxy-"+natType, "", natType, 0)
+					pool := NATRestricted
+					if natType == NATUnrestricted {
+						pool = NATUnrestricted
+					}
+					waiting[pool] = natType
+				}
+				var expected string
+				for _, pool := range test.pools {
+					if natType, ok := waiting[pool]; ok {
+						expected = natType
+						break
+					}
+				}
+
+				snowflake := ctx.matchSnowflake(&clientInfo{natType: test.client})
+				if expected == "" {
+					So(snowflake, ShouldBeNil)
+					So(ctx.snowflakes.Len()+ctx.restrictedSnowflakes.Len(), ShouldEqual, len(proxies))
+				} else {
+					So(snowflake, ShouldNotBeNil)
+					So(snowflake.natType, ShouldEqual, expected)
+					So(ctx.snowflakes.Len()+ctx.restrictedSnowflakes.Len(), ShouldEqual, len(proxies)-1)
+				}
+			}
+		}
+	})
+}
+
+func TestProxySelectors(t *testing.T) {
+	Convey("Proxy selectors", t, func() {
+		ctx := NewBrokerContext(NullLogger(), "")
+		// Reputation is kept by /24, so each proxy polls from its own.
+		prefixes := []string{"192.0.2.", "198.51.100.", "203.0.113."}
+		add := func(id, proxyType, country string, clients int) *Snowflake {
+			s := ctx.AddSnowflake(id, proxyType, NATUnrestricted, clients)
+			s.country = country
+			s.addr = prefixes[s.seq-1] + "1"
+			return s
+		}
+		first := add("first", "webext", "CA", 2)
+		second := add("second", "standalone", "DE", 1)
+		third := add("third", "badge", "", 0)
+		client := &clientInfo{natType: NATRestricted, country: "DE"}
+		match := func(spec string) *Snowflake {
+			selector, err := ParseProxySelector(spec, ctx.reputation)
+			So(err, ShouldBeNil)
+			ctx.selector = selector
+			return ctx.matchSnowflake(client)
+		}
+
+		Convey("least-loaded takes the snowflake with the fewest clients", func() {
+			So(match("least-loaded"), ShouldEqual, third)
+			So(match(""), ShouldEqual, second)
+		})
+
+		Convey("round-robin takes the snowflake waiting the longest", func() {
+			So(match("round-robin"), ShouldEqual, first)
+			So(match("round-robin"), ShouldEqual, second)
+			So(ctx.snowflakes.Len(), ShouldEqual, 1)
+			So((*ctx.snowflakes)[0], ShouldEqual, third)
+		})
+
+		Convey("geo-diverse avoids the client's country", func() {
+			So(match("geo-diverse"), ShouldEqual, first)
+			So(match("geo-diverse"), ShouldEqual, third)
+			So(match("geo-diverse"), ShouldEqual, second)
+		})
+
+		Convey("geo-diverse takes the least loaded for clients of unknown country", func() {
+			client.country = ""
+			So(match("geo-diverse"), ShouldEqual, third)
+		})
+
+		Convey("prefer-type takes proxy types in order of preference", func() {
+			So(match("prefer-type"), ShouldEqual, second)
+			So(match("prefer-type"), ShouldEqual, first)
+			So(match("prefer-type:badge"), ShouldEqual, third)
+		})
+
+		Convey("success-weighted favours hosts that answered their clients", func() {
+			for i := 0; i < 50; i++ {
+				ctx.reputation.Record(first.addr, outcomeTimeout)
+				ctx.reputation.Record(third.addr, outcomeTimeout)
+			}
+			So(ctx.reputation.Score(first.addr), ShouldBeLessThan, 0.05)
+			So(ctx.reputation.Score(second.addr), ShouldEqual, 0.5)
+			selector, err := ParseProxySelector("success-weighted", ctx.reputation)
+			So(err, ShouldBeNil)
+			counts := make(map[*Snowflake]int)
+			for i := 0; i < 1000; i++ {
+				counts[selector.Select(*ctx.snowflakes, client)]++
+			}
+			So(counts[second], ShouldBeGreaterThan, 800)
+			So(counts[first]+counts[third], ShouldBeGreaterThan, 0)
+		})
+
+		Convey("rejects unknown selectors", func() {
+			_, err := ParseProxySelector("best", ctx.reputation)
+			So(err, ShouldNotBeNil)
+			_, err = ParseProxySelector("round-robin:fast", ctx.reputation)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestProxyReputation(t *testing.T) {
+	Convey("Proxy reputation", t, func() {
+		ctx := NewBrokerContext(NullLogger(), "")
+		r := ctx.reputation
+		now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		r.now = func() time.Time { return now }
+
+		Convey("groups proxies by prefix", func() {
+			So(proxyPrefix("192.0.2.7"), ShouldEqual, "192.0.2.0/24")
+			So(proxyPrefix("2001:db8:1:2:3:4:5:6"), ShouldEqual, "2001:db8:1:2::/64")
+			So(proxyPrefix("not an address"), ShouldEqual, "")
+
+			for i := 0; i < 3; i++ {
+				r.Record("192.0.2.1", outcomeMatch)
+				r.Record("192.0.2.1", outcomeTimeout)
+			}
+			So(r.Score("192.0.2.200"), ShouldEqual, 0.2)
+			So(r.Score("198.51.100.1"), ShouldEqual, 0.5)
+			r.Record("192.0.2.2", outcomeAnswer)
+			So(r.Score("192.0.2.1"), ShouldAlmostEqual, 2.0/6)
+		})
+
+		Convey("forgets old outcomes", func() {
+			for i := 0; i < 8; i++ {
+				r.Record("192.0.2.1", outcomeTimeout)
+			}
+			So(r.Score("192.0.2.1"), ShouldEqual, 0.1)
+			now = now.Add(DefaultReputationHalfLife)
+			So(r.Score("192.0.2.1"), ShouldAlmostEqual, 1.0/6)
+			now = now.Add(20 * DefaultReputationHalfLife)
+			r.Record("198.51.100.1", outcomePoll)
+			So(len(r.prefixes), ShouldEqual, 1)
+		})
+
+		Convey("deprioritizes proxies of unreliable prefixes", func() {
+			ctx.minReputation = 0.3
+			for i := 0; i < 4; i++ {
+				r.Record("192.0.2.1", outcomeTimeout)
+			}
+			unreliable := ctx.addSnowflake(&ProxyPoll{id: "unreliable", natType: NATUnrestricted, addr: "192.0.2.1"})
+			unknown := ctx.addSnowflake(&ProxyPoll{id: "unknown", natType: NATUnrestricted, clients: 5, addr: "198.51.100.1"})
+			client := &clientInfo{natType: NATRestricted}
+			So(ctx.matchSnowflake(client), ShouldEqual, unknown)
+			So(ctx.matchSnowflake(client), ShouldEqual, unreliable)
+		})
+
+		Convey("is summarized in /debug and Prometheus", func() {
+			r.Record("192.0.2.1", outcomeAnswer)
+			r.Record("198.51.100.1", outcomeTimeout)
+			r.Record("203.0.113.1", outcomePoll)
+			So(r.Distribution(), ShouldResemble, []int{0, 2, 1, 0})
+
+			var response string
+			So((&IPC{ctx}).Debug(nil, &response), ShouldBeNil)
+			So(response, ShouldContainSubstring, "Proxy reputation (prefixes by score):\n\t0.00-0.25: 0\n\t0.25-0.50: 2\n\t0.50-0.75: 1\n\t0.75-1.00: 0")
+
+			So(testutil.ToFloat64(r.outcomesTotal.With(prometheus.Labels{"outcome": outcomePoll})), ShouldEqual, 1)
+			So(testutil.CollectAndCount(r, "snowflake_proxy_reputation_prefixes"), ShouldEqual, 4)
+		})
+	})
+}
+
+func TestBridgeListReload(t *testing.T) {
+	const first = `{"displayName":"flakey", "webSocketAddress":"wss://snowflake.torproject.net", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80A72"}
+`
+	const second = `{"displayName":"second", "webSocketAddress":"wss://02.snowflake.torproject.net", "fingerprint":"8838024498816A039FCBBAB14E6F40A0843051FA"}
+`
+	Convey("Reloads the bridge list", t, func() {
+		ctx := NewBrokerContext(NullLogger(), "")
+		i := &IPC{ctx}
+		ctx.bridgeListPath = filepath.Join(t.TempDir(), "bridge-list.json")
+		So(os.WriteFile(ctx.bridgeListPath, []byte(first), 0644), ShouldBeNil)
+		_, err := ctx.reloadBridgeList()
+		So(err, ShouldBeNil)
+		fingerprint, err := bridgefingerprint.FingerprintFromHexString("8838024498816A039FCBBAB14E6F40A0843051FA")
+		So(err, ShouldBeNil)
+		reloads := func(status string) float64 {
+			return testutil.ToFloat64(ctx.metrics.promMetrics.BridgeListReloadsTotal.With(prometheus.Labels{"status": status}))
+		}
+
+		Convey("and reports the changes", func() {
+			So(os.WriteFile(ctx.bridgeListPath, []byte(second), 0644), ShouldBeNil)
+			diff, err := ctx.ReloadBridgeList("test")
+			So(err, ShouldBeNil)
+			So(diff.Added, ShouldResemble, []string{"8838024498816A039FCBBAB14E6F40A0843051FA"})
+			So(diff.Removed, ShouldResemble, []string{"2B280B23E1107BB62ABFC40DDCC8824814F80A72"})
+			_, err = ctx.GetBridgeInfo(fingerprint)
+			So(err, ShouldBeNil)
+			So(reloads("success"), ShouldEqual, 1)
+			So(testutil.ToFloat64(ctx.metrics.promMetrics.BridgeListChangesTotal.With(prometheus.Labels{"change": "removed"})), ShouldEqual, 1)
+		})
+
+		Convey("and keeps the current list if the file is invalid or empty", func() {
+			for _, content := range []string{second + "{", " \n"} {
+				So(os.WriteFile(ctx.bridgeListPath, []byte(content), 0644), ShouldBeNil)
+				_, err := ctx.ReloadBridgeList("test")
+				So(err, ShouldNotBeNil)
+				_, err = ctx.GetBridgeInfo(fingerprint)
+				So(err, ShouldEqual, bridgelist.ErrBridgeNotFound)
+			}
+			So(reloads("failure"), ShouldEqual, 2)
+		})
+
+		Convey("when the file changes", func() {
+			watcher := ctx.WatchBridgeList(10 * time.Millisecond)
+			defer watcher.Close()
+			So(os.WriteFile(ctx.bridgeListPath, []byte(first+second), 0644), ShouldBeNil)
+			for n := 0; n < 100 && reloads("success") == 0; n++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(reloads("success"), ShouldEqual, 1)
+			_, err := ctx.GetBridgeInfo(fingerprint)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("but tries an invalid file only once", func() {
+			watcher := ctx.WatchBridgeList(10 * time.Millisecond)
+			defer watcher.Close()
+			So(os.WriteFile(ctx.bridgeListPath, []byte(second+"{"), 0644), ShouldBeNil)
+			for n := 0; n < 100 && reloads("failure") == 0; n++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			time.Sleep(100 * time.Millisecond)
+			So(reloads("failure"), ShouldEqual, 1)
+		})
+
+		Convey("on admin request", func() {
+			handler := AdminHandler{i, adminAuth{token: "secret"}, reloadBridgeListHandler}
+			So(os.WriteFile(ctx.bridgeListPath, []byte(first+second), 0644), ShouldBeNil)
+			for _, auth := range []string{"", "Bearer wrong", "secret"} {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest("POST", "/admin/reload-bridge-list", nil)
+				if auth != "" {
+					r.Header.Set("Authorization", auth)
+				}
+				handler.ServeHTTP(w, r)
+				So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/admin/reload-bridge-list", nil)
+			r.Header.Set("Authorization", "Bearer secret")
+			handler.ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, http.StatusMethodNotAllowed)
+
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest("POST", "/admin/reload-bridge-list", nil)
+			r.Header.Set("Authorization", "Bearer secret")
+			handler.ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, `{"added":["8838024498816A039FCBBAB14E6F40A0843051FA"],"removed":null,"changed":null}`+"\n")
+		})
+
+		Convey("but not without a token", func() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/admin/reload-bridge-list", nil)
+			r.Header.Set("Authorization", "Bearer ")
+			AdminHandler{i, adminAuth{}, reloadBridgeListHandler}.ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+	})
+}
+
+func TestBridgeHealth(t *testing.T) {
+	const (
+		flakey = "2B280B23E1107BB62ABFC40DDCC8824814F80A72"
+		second = "8838024498816A039FCBBAB14E6F40A0843051FA"
+	)
+	Convey("Bridge health", t, func() {
+		ctx := NewBrokerContext(NullLogger(), "")
+		i := &IPC{ctx}
+		bridgeList, err := os.ReadFile("test_bridgeList.txt")
+		So(err, ShouldBeNil)
+		So(ctx.bridgeList.LoadBridgeInfo(bytes.NewReader(bridgeList)), ShouldBeNil)
+		h := ctx.bridgeHealth
+		failing := map[string]bool{}
+		h.probe = func(_ context.Context, url string) error {
+			if failing[url] {
+				return errors.New("connection refused")
+			}
+			return nil
+		}
+		up := func(fingerprint string) float64 {
+			return testutil.ToFloat64(h.bridgeUp.With(prometheus.Labels{"fingerprint": fingerprint}))
+		}
+		clientRequest := func(fingerprint string) *http.Request {
+			data, err := createClientOffer(sdp, NATUnknown, fingerprint)
+			So(err, ShouldBeNil)
+			r, err := http.NewRequest("POST", "snowflake.broker/client", data)
+			So(err, ShouldBeNil)
+			return r
+		}
+		// serve may run on another goroutine, unlike clientRequest.
+		serve := func(r *http.Request) string {
+			w := httptest.NewRecorder()
+			clientOffers(i, w, r)
+			return w.Body.String()
+		}
+		clientOffer := func(fingerprint string) string {
+			return serve(clientRequest(fingerprint))
+		}
+
+		So(h.IsUp(flakey), ShouldBeTrue)
+		So(h.String(), ShouldContainSubstring, "not probed yet")
+
+		Convey("marks bridges down and up with hysteresis", func() {
+			failing["wss://02.snowflake.torproject.net"] = true
+			for n := 0; n < bridgeDownAfter-1; n++ {
+				h.ProbeAll(context.Background())
+			}
+			So(h.IsUp(second), ShouldBeTrue)
+			So(up(second), ShouldEqual, 1)
+			h.ProbeAll(context.Background())
+			So(h.IsUp(second), ShouldBeFalse)
+			So(h.IsUp(strings.ToLower(second)), ShouldBeFalse)
+			So(up(second), ShouldEqual, 0)
+			So(h.IsUp(flakey), ShouldBeTrue)
+			So(up(flakey), ShouldEqual, 1)
+
+			var response string
+			So(i.Debug(nil, &response), ShouldBeNil)
+			So(response, ShouldContainSubstring, "second ("+second+"): down since ")
+			So(response, ShouldContainSubstring, "connection refused")
+			So(testutil.ToFloat64(h.probesTotal.With(prometheus.Labels{"status": "failure"})), ShouldEqual, bridgeDownAfter)
+
+			failing["wss://02.snowflake.torproject.net"] = false
+			for n := 0; n < bridgeUpAfter-1; n++ {
+				h.ProbeAll(context.Background())
+			}
+			So(h.IsUp(second), ShouldBeFalse)
+			h.ProbeAll(context.Background())
+			So(h.IsUp(second), ShouldBeTrue)
+		})
+
+		Convey("forgets bridges removed from the list", func() {
+			failing["wss://02.snowflake.torproject.net"] = true
+			for n := 0; n < bridgeDownAfter; n++ {
+				h.ProbeAll(context.Background())
+			}
+			So(ctx.bridgeList.LoadBridgeInfo(bytes.NewReader([]byte(bridgelist.DefaultBridgeList))), ShouldBeNil)
+			h.ProbeAll(context.Background())
+			So(h.IsUp(second), ShouldBeTrue)
+			So(testutil.CollectAndCount(h.bridgeUp), ShouldEqual, 1)
+		})
+
+		Convey("refuses clients asking for a bridge that is down", func() {
+			failing["wss://snowflake.torproject.net"] = true
+			for n := 0; n < bridgeDownAfter; n++ {
+				h.ProbeAll(context.Background())
+			}
+			So(clientOffer(flakey), ShouldEqual, `{"error":"`+ErrBridgeDown.Error()+`"}`)
+			So(clientOffer(second), ShouldEqual, `{"error":"no snowflake proxies currently available"}`)
+
+			Convey("unless there is a fallback bridge", func() {
+				ctx.bridgeFallback = second
+				snowflake := ctx.AddSnowflake("test", "", NATUnrestricted, 0)
+				done := make(chan string)
+				r := clientRequest(flakey)
+				go func() {
+					done <- serve(r)
+				}()
+				offer := <-snowflake.offerChannel
+				fallback, err := bridgefingerprint.FingerprintFromHexString(second)
+				So(err, ShouldBeNil)
+				So(offer.fingerprint, ShouldResemble, fallback.ToBytes())
+				snowflake.answerChannel <- "test answer"
+				So(<-done, ShouldEqual, `{"answer":"test answer"}`)
+			})
+
+			Convey("or the fallback bridge is down too", func() {
+				ctx.bridgeFallback = flakey
+				So(clientOffer(flakey), ShouldEqual, `{"error":"`+ErrBridgeDown.Error()+`"}`)
+			})
+		})
+	})
+}
+
+func TestMultiRelayBridges(t *testing.T) {
+	Convey("Sends proxies to the relays of their region", t, func() {
+		ctx := NewBrokerContext(NullLogger(), "")
+		i := &IPC{ctx}
+		So(ctx.metrics.LoadGeoipDatabases("test_geoip", "test_geoip6"), ShouldBeNil)
+		So(ctx.bridgeList.LoadBridgeInfo(strings.NewReader(`{"displayName":"multi", "relays":[{"url":"wss://01.snowflake.example/", "weight":5}, {"url":"wss://ca.snowflake.example/", "regions":["CA"]}], "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80A72"}
+`)), ShouldBeNil)
+		fingerprint, err := hex.DecodeString("2B280B23E1107BB62ABFC40DDCC8824814F80A72")
+		So(err, ShouldBeNil)
+
+		for n := 0; n < 10; n++ {
+			done := make(chan bool)
+			w := httptest.NewRecorder()
+			data := bytes.NewReader([]byte(`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.0"}`))
+			r, err := http.NewRequest("POST", "snowflake.broker/proxy", data)
+			So(err, ShouldBeNil)
+			r.RemoteAddr = "129.97.208.23:8888" //CA geoip
+			go func() {
+				proxyPolls(i, w, r)
+				done <- true
+			}()
+			p := <-ctx.proxyPolls
+			p.offerChannel <- &ClientOffer{sdp: []byte("fake offer"), fingerprint: fingerprint}
+			<-done
+			So(w.Body.String(), ShouldEqual, `{"Status":"client match","Offer":"fake offer","NAT":"","RelayURL":"wss://ca.snowflake.example/"}`)
+		}
+	})
+}
+
+func TestRelayPatterns(t *testing.T) {
+	Convey("Context", t, func() {
+		ctx := NewBrokerContext(NullLogger(), "snowflake.torproject.net$")
+		i := &IPC{ctx}
+		So(ctx.bridgeList.LoadBridgeInfo(strings.NewReader(`{"displayName":"default", "webSocketAddress":"wss://snowflake.torproject.net/", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80A72"}
+{"displayName":"multi", "relays":[{"url":"wss://01.snowflake.example/"}, {"url":"wss://02.other.example/"}], "fingerprint":"8838024498816A039FCBBAB14E6F40A0843051FA"}
+`)), ShouldBeNil)
+		defaultHosts := []string{"snowflake.torproject.net"}
+		multiHosts := []string{"01.snowflake.example", "02.other.example"}
+
+		Convey("only rejects proxies accepting no relay at all", func() {
+			So(ctx.CheckProxyRelayPattern(""), ShouldBeTrue)
+			So(ctx.CheckProxyRelayPattern("snowflake.torproject.net$"), ShouldBeTrue)
+			So(ctx.CheckProxyRelayPattern("^01.snowflake.example$"), ShouldBeTrue)
+			So(ctx.CheckProxyRelayPattern("^snowflake.example$"), ShouldBeFalse)
+			So(ctx.CheckProxyRelayPattern("nowhere.example$"), ShouldBeFalse)
+
+			So(ctx.ProxyRelayPattern("snowflake.example$", false), ShouldEqual, "snowflake.example$")
+			So(ctx.ProxyRelayPattern("", true), ShouldEqual, "snowflake.torproject.net$")
+
+			var response []byte
+			body, err := messages.EncodeProxyPollRequestWithRelayPrefix("ymbcCMto7KHNGYlp", "standalone", NATUnrestricted, 0, "nowhere.example$")
+			So(err, ShouldBeNil)
+			So(i.ProxyPolls(messages.Arg{Body: body, RemoteAddr: "192.0.2.1"}, &response), ShouldBeNil)
+			So(string(response), ShouldEqual, `{"Status":"incorrect relay pattern","Offer":"","NAT":"","RelayURL":""}`)
+		})
+
+		Convey("matches proxies with clients of bridges they accept", func() {
+			torproject := ctx.addSnowflake(&ProxyPoll{id: "torproject", natType: NATUnrestricted, relayPattern: "torproject.net$"})
+			example := ctx.addSnowflake(&ProxyPoll{id: "example", natType: NATUnrestricted, clients: 5, relayPattern: "snowflake.example$"})
+			So(ctx.matchSnowflake(&clientInfo{natType: NATRestricted, relayHosts: multiHosts}), ShouldEqual, example)
+			So(ctx.matchSnowflake(&clientInfo{natType: NATRestricted, relayHosts: multiHosts}), ShouldBeNil)
+			So(ctx.matchSnowflake(&clientInfo{natType: NATRestricted, relayHosts: defaultHosts}), ShouldEqual, torproject)
+		})
+
+		Convey("sends proxies to a relay they accept", func() {
+			fingerprint, err := hex.DecodeString("8838024498816A039FCBBAB14E6F40A0843051FA")
+			So(err, ShouldBeNil)
+			body, err := messages.EncodeProxyPollRequestWithRelayPrefix("ymbcCMto7KHNGYlp", "standalone", NATUnrestricted, 0, "other.example$")
+			So(err, ShouldBeNil)
+			for n := 0; n < 10; n++ {
+				done := make(chan error)
+				var response []byte
+				go func() {
+					done <- i.ProxyPolls(messages.Arg{Body: body, RemoteAddr: "192.0.2.1"}, &response)
+				}()
+				p := <-ctx.proxyPolls
+				So(p.relayPattern, ShouldEqual, "other.example$")
+				p.offerChannel <- &ClientOffer{sdp: []byte("fake offer"), fingerprint: fingerprint}
+				So(<-done, ShouldBeNil)
+				So(string(response), ShouldEqual, `{"Status":"client match","Offer":"fake offer","NAT":"","RelayURL":"wss://02.other.example/"}`)
+			}
+		})
+	})
+}
+
+func TestAdminAPI(t *testing.T) {
+	Convey("Context", t, func() {
+		ctx := NewBrokerContext(NullLogger(), "")
+		i := &IPC{ctx}
+		auth := adminAuth{token: "secret"}
+		request := func(handle func(*IPC, http.ResponseWriter, *http.Request), method, body string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(method, "/admin/", strings.NewReader(body))
+			r.Header.Set("Authorization", "Bearer secret")
+			AdminHandler{i, auth, handle}.ServeHTTP(w, r)
+			return w
+		}
+
+		Convey("authorizes client certificates if enabled", func() {
+			r := httptest.NewRequest("GET", "/admin/matching", nil)
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+			So(adminAuth{}.authorized(r), ShouldBeFalse)
+			So(adminAuth{clientCerts: true}.authorized(r), ShouldBeTrue)
+			r.TLS = &tls.ConnectionState{}
+			So(adminAuth{clientCerts: true}.authorized(r), ShouldBeFalse)
+			So(adminAuth{}.enabled(), ShouldBeFalse)
+		})
+
+		Convey("lists the waiting proxies", func() {
+			ctx.addSnowflake(&ProxyPoll{id: "first", proxyType: "standalone", natType: NATUnrestricted, clients: 2, addr: "192.0.2.1", relayPattern: "snowflake.torproject.net$"})
+			ctx.addSnowflake(&ProxyPoll{id: "second", proxyType: "webext", natType: NATRestricted, addr: "192.0.2.2"})
+			ctx.addSnowflake(&ProxyPoll{id: "matched", natType: NATRestricted})
+			heap.Remove(ctx.restrictedSnowflakes, ctx.idToSnowflake["matched"].index)
+
+			var proxies []adminProxy
+			w := request(proxiesHandler, "GET", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(json.Unmarshal(w.Body.Bytes(), &proxies), ShouldBeNil)
+			So(len(proxies), ShouldEqual, 2)
+			So(proxies[0].ID, ShouldEqual, "first")
+			So(proxies[0].Type, ShouldEqual, "standalone")
+			So(proxies[0].NAT, ShouldEqual, NATUnrestricted)
+			So(proxies[0].Clients, ShouldEqual, 2)
+			So(proxies[0].RelayPattern, ShouldEqual, "snowflake.torproject.net$")
+			So(proxies[1].ID, ShouldEqual, "second")
+			So(w.Body.String(), ShouldNotContainSubstring, "192.0.2.1")
+
+			ctx.unsafeLogging = true
+			w = request(proxiesHandler, "GET", "")
+			So(json.Unmarshal(w.Body.Bytes(), &proxies), ShouldBeNil)
+			So(proxies[0].Addr, ShouldEqual, "192.0.2.1")
+
+			So(request(proxiesHandler, "POST", "").Code, ShouldEqual, http.StatusMethodNotAllowed)
+		})
+
+		Convey("pauses matching", func() {
+			w := request(matchingHandler, "POST", `{"paused":true}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, `{"paused":true,"draining":false}`+"\n")
+			So(request(matchingHandler, "GET", "").Body.String(), ShouldEqual, `{"paused":true,"draining":false}`+"\n")
+
+			ctx.addSnowflake(&ProxyPoll{id: "waiting", natType: NATUnrestricted})
+			data, err := createClientOffer(sdp, NATUnknown, "")
+			So(err, ShouldBeNil)
+			w = httptest.NewRecorder()
+			r, err := http.NewRequest("POST", "snowflake.broker/client", data)
+			So(err, ShouldBeNil)
+			clientOffers(i, w, r)
+			So(w.Body.String(), ShouldEqual, `{"error":"no snowflake proxies currently available"}`)
+			So(ctx.snowflakes.Len(), ShouldEqual, 1)
+
+			So(request(matchingHandler, "POST", `{"paused":false}`).Body.String(), ShouldEqual, `{"paused":false,"draining":false}`+"\n")
+			So(request(matchingHandler, "POST", `{"stopped":true}`).Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("drains the broker", func() {
+			So(request(matchingHandler, "POST", `{"draining":true}`).Body.String(), ShouldEqual, `{"paused":false,"draining":true}`+"\n")
+			var response []byte
+			body, err := messages.EncodeProxyPollRequest(sid, "standalone", NATUnrestricted, 0)
+			So(err, ShouldBeNil)
+			// The proxy is sent away without waiting on ctx.proxyPolls.
+			So(i.ProxyPolls(messages.Arg{Body: body, RemoteAddr: "192.0.2.1"}, &response), ShouldBeNil)
+			So(string(response), ShouldEqual, `{"Status":"no match","Offer":"","NAT":"","RelayURL":""}`)
+		})
+
+		Convey("reloads the geoip databases", func() {
+			So(request(reloadGeoipHandler, "POST", "").Code, ShouldEqual, http.StatusUnprocessableEntity)
+			ctx.geoipDatabase, ctx.geoip6Database = "test_geoip", "test_geoip6"
+			So(request(reloadGeoipHandler, "POST", "").Code, ShouldEqual, http.StatusOK)
+			So(ctx.metrics.lookupCountry("129.97.208.23"), ShouldEqual, "CA")
+			ctx.geoipDatabase = "invalid_filename"
+			So(request(reloadGeoipHandler, "POST", "").Code, ShouldEqual, http.StatusUnprocessableEntity)
+			So(ctx.metrics.lookupCountry("129.97.208.23"), ShouldEqual, "CA")
+		})
+
+		Convey("adjusts the timeouts", func() {
+			So(request(timeoutsHandler, "GET", "").Body.String(), ShouldEqual, `{"proxy":"10s","client":"10s"}`+"\n")
+			So(request(timeoutsHandler, "POST", `{"proxy":"2s"}`).Body.String(), ShouldEqual, `{"proxy":"2s","client":"10s"}`+"\n")
+			So(request(timeoutsHandler, "POST", `{"client":"-1s"}`).Code, ShouldEqual, http.StatusBadRequest)
+			So(request(timeoutsHandler, "POST", `{"client":"soon"}`).Code, ShouldEqual, http.StatusBadRequest)
+			proxy, client := ctx.Timeouts()
+			So(proxy, ShouldEqual, 2*time.Second)
+			So(client, ShouldEqual, 10*time.Second)
+		})
+
+		Convey("dumps the metrics", func() {
+			ctx.reputation.Record("192.0.2.1", outcomePoll)
+			w := request(metricsSnapshotHandler, "GET", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var snapshot map[string][]adminSample
+			So(json.Unmarshal(w.Body.Bytes(), &snapshot), ShouldBeNil)
+			So(snapshot["snowflake_proxy_outcomes_total"], ShouldResemble, []adminSample{{Labels: map[string]string{"outcome": "poll"}, Value: 1}})
+		})
+	})
+}
+
 func TestSnowflakeHeap(t *testing.T) {
 	Convey("SnowflakeHeap", t, func() {
 		h := new(SnowflakeHeap)
@@ -640,7 +1385,7 @@ func TestSnowflakeHeap(t *testing.T) {
 func TestInvalidGeoipFile(t *testing.T) {
 	Convey("Geoip", t, func() {
 		// Make sure things behave properly if geoip file fails to load
-		ctx := NewBrokerContext(NullLogger(), "", "")
+		ctx := NewBrokerContext(NullLogger(), "")
 		if err := ctx.metrics.LoadGeoipDatabases("invalid_filename", "invalid_filename6"); err != nil {
 			log.Printf("loading geo ip databases returned error: %v", err)
 		}
@@ -654,7 +1399,7 @@ func TestMetrics(t *testing.T) {
 	Convey("Test metrics...", t, func() {
 		done := make(chan bool)
 		buf := new(bytes.Buffer)
-		ctx := NewBrokerContext(log.New(buf, "", 0), "", "")
+		ctx := NewBrokerContext(log.New(buf, "", 0), "")
 		i := &IPC{ctx}
 
 		err := ctx.metrics.LoadGeoipDatabases("test_geoip", "test_geoip6")
@@ -4,6 +4,8 @@ Keeping track of pending available snowflake proxies.
 
 package main
 
+import "time"
+
 /*
 The Snowflake struct contains a single interaction
 over the offer and answer channels.
@@ -16,6 +18,17 @@ type Snowflake struct {
 	answerChannel chan string
 	clients       int
 	index         int
+	// addr is the address the proxy polled from and country its country
+	// code, or "" if unknown.
+	addr    string
+	country string
+	// added is when the snowflake started waiting, and seq orders the
+	// snowflakes by it.
+	added time.Time
+	seq   uint64
+	// relayPattern is the AcceptedRelayPattern of the proxy. It is only
+	// matched with clients of a bridge that has a relay it accepts.
+	relayPattern string
 }
 
 // Implements heap.Interface, and holds Snowflakes.
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/brokerserverless/internal/handler"
+)
+
+var h *handler.Handler
+
+// init initializes the handler and its Redis client.
+func init() {
+	var err error
+	h, err = handler.NewLambdaHandlerFromEnv(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func main() {
+	lambda.Start(h.AmpClient)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPrometheusStart = `# HELP snowflake_rounded_client_poll_total The number of snowflake client polls, rounded up to a multiple of 8
+# TYPE snowflake_rounded_client_poll_total counter
+snowflake_rounded_client_poll_total{cc="??",nat="restricted",rendezvous_method="http",status="denied"} 8
+snowflake_rounded_client_poll_total{cc="??",nat="restricted",rendezvous_method="http",status="matched"} 16
+# HELP snowflake_rounded_proxy_poll_total The number of snowflake proxy polls, rounded up to a multiple of 8
+# TYPE snowflake_rounded_proxy_poll_total counter
+snowflake_rounded_proxy_poll_total{nat="restricted",status="idle"} 80
+snowflake_rounded_proxy_poll_total{nat="unrestricted",status="idle"} 40
+snowflake_rounded_proxy_poll_total{nat="restricted",status="matched"} 16
+`
+
+const testPrometheusEnd = `# HELP snowflake_rounded_client_poll_total The number of snowflake client polls, rounded up to a multiple of 8
+# TYPE snowflake_rounded_client_poll_total counter
+snowflake_rounded_client_poll_total{cc="??",nat="restricted",rendezvous_method="http",status="denied"} 16
+snowflake_rounded_client_poll_total{cc="??",nat="restricted",rendezvous_method="http",status="matched"} 80
+# HELP snowflake_rounded_proxy_poll_total The number of snowflake proxy polls, rounded up to a multiple of 8
+# TYPE snowflake_rounded_proxy_poll_total counter
+snowflake_rounded_proxy_poll_total{nat="restricted",status="idle"} 240
+snowflake_rounded_proxy_poll_total{nat="unrestricted",status="idle"} 120
+snowflake_rounded_proxy_poll_total{nat="restricted",status="matched"} 80
+`
+
+const testMetricsLog = `snowflake-stats-end 2024-12-01 00:00:00 (86400 s)
+snowflake-ips 
+snowflake-ips-total 0
+snowflake-idle-count 864000
+client-denied-count 8640
+client-snowflake-match-count 86400
+client-http-count 95040
+snowflake-stats-end 2024-12-02 00:00:00 (86400 s)
+snowflake-idle-count 1728000
+client-denied-count 8640
+client-snowflake-match-count 86400
+`
+
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) < 0.005
+}
+
+// The model gives the same costs as the original estimates.
+func TestCompare(t *testing.T) {
+	c := Compare(Scenario{Clients: 20000, Proxies: 100000}, DefaultParams())
+	for _, test := range []struct {
+		name     string
+		cost     float64
+		expected float64
+	}{
+		{"lambda", c.LambdaTotal, 551356.189092},
+		{"proxy poll", c.Lambda.ProxyPoll, 30 * 18374.40504},
+		{"redis", c.Redis, 308.465},
+		{"api gateway", c.APIGateway, 52012.8},
+		{"cloudwatch", c.CloudWatch, 0.042},
+		{"serverless", c.ServerlessTotal, 603677.496092},
+		{"server", c.Server, 3664.725},
+	} {
+		if !closeTo(test.cost, test.expected) {
+			t.Errorf("%s cost: expected %f, got %f", test.name, test.expected, test.cost)
+		}
+	}
+}
+
+func TestPrometheusTraffic(t *testing.T) {
+	start, err := parsePrometheus(strings.NewReader(testPrometheusStart))
+	if err != nil {
+		t.Fatal(err)
+	}
+	end, err := parsePrometheus(strings.NewReader(testPrometheusEnd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	traffic, err := newTraffic(end.sub(start), 8*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Traffic{
+		PeriodSeconds:  8,
+		IdlePolls:      30,
+		MatchedPolls:   8,
+		MatchedClients: 8,
+		DeniedClients:  1,
+	}
+	if *traffic != expected {
+		t.Errorf("expected %+v, got %+v", expected, *traffic)
+	}
+
+	if _, err := newTraffic(start.sub(end), 8*time.Second); err == nil {
+		t.Error("expected an error for counters going down")
+	}
+}
+
+func TestMetricsLogTraffic(t *testing.T) {
+	c, period, err := parseMetricsLog(strings.NewReader(testMetricsLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if period != 2*24*time.Hour {
+		t.Errorf("expected two days, got %v", period)
+	}
+	traffic, err := newTraffic(c, period)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Traffic{
+		PeriodSeconds:  2 * 86400,
+		IdlePolls:      15,
+		MatchedPolls:   1,
+		MatchedClients: 1,
+		DeniedClients:  0.1,
+	}
+	if *traffic != expected {
+		t.Errorf("expected %+v, got %+v", expected, *traffic)
+	}
+
+	// A quarter of the polls are idle, so polls last 5/8 of the timeout.
+	params := (&Traffic{IdlePolls: 1, MatchedPolls: 3, MatchedClients: 3, DeniedClients: 1}).Params(DefaultParams(), 8*time.Second)
+	if params.PollDuration != 5*time.Second {
+		t.Errorf("expected polls to last 5s, got %v", params.PollDuration)
+	}
+	if params.ClientMatchRate != 0.75 {
+		t.Errorf("expected a match rate of 0.75, got %f", params.ClientMatchRate)
+	}
+	scenario := traffic.Scenario(traffic.Params(DefaultParams(), 5*time.Second))
+	if scenario.Clients != 660 || scenario.Proxies != 80 {
+		t.Errorf("expected 660 clients and 80 proxies, got %+v", scenario)
+	}
+}
+
+func TestParseMetricsLogErrors(t *testing.T) {
+	for _, log := range []string{
+		"snowflake-stats-end 2024-12-01 00:00:00\n",
+		"snowflake-stats-end 2024-12-01 00:00:00 (a s)\n",
+		"snowflake-idle-count many\n",
+	} {
+		if _, _, err := parseMetricsLog(strings.NewReader(log)); err == nil {
+			t.Errorf("expected an error for %q", log)
+		}
+	}
+}
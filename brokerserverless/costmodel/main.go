@@ -0,0 +1,185 @@
+/*
+Command costmodel compares the monthly cost of the serverless broker (Lambda,
+ElastiCache, API Gateway and CloudWatch) with that of the classic broker on
+EC2, for a range of client and proxy counts.
+
+Without inputs, the model uses durations and request rates measured by hand
+in CloudWatch. Given the classic broker's /prometheus output (-prometheus) or
+metrics log (-metrics-log), it derives the poll and match rates, and from them
+the poll duration, from the observed traffic instead, and adds a row for the
+number of clients and proxies that make that traffic.
+
+The comparison is printed as a table; -json writes it as a JSON report too.
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Report is the JSON report of the comparison.
+type Report struct {
+	Params  ReportParams `json:"params"`
+	Traffic *Traffic     `json:"traffic,omitempty"`
+	Costs   []Cost       `json:"costs"`
+}
+
+// ReportParams are the Params of a report, with durations in seconds.
+type ReportParams struct {
+	PollInterval       float64 `json:"pollIntervalSeconds"`
+	SessionDuration    float64 `json:"sessionDurationSeconds"`
+	RequestsPerSession int     `json:"requestsPerSession"`
+	PollDuration       float64 `json:"pollDurationSeconds"`
+	ClientDuration     float64 `json:"clientDurationSeconds"`
+	AnswerDuration     float64 `json:"answerDurationSeconds"`
+	MemoryMB           int     `json:"memoryMB"`
+	ClientMatchRate    float64 `json:"clientMatchRate"`
+}
+
+func newReportParams(p Params) ReportParams {
+	return ReportParams{
+		PollInterval:       p.PollInterval.Seconds(),
+		SessionDuration:    p.SessionDuration.Seconds(),
+		RequestsPerSession: p.RequestsPerSession,
+		PollDuration:       p.PollDuration.Seconds(),
+		ClientDuration:     p.ClientDuration.Seconds(),
+		AnswerDuration:     p.AnswerDuration.Seconds(),
+		MemoryMB:           p.MemoryMB,
+		ClientMatchRate:    p.ClientMatchRate,
+	}
+}
+
+func parseCounts(s string) ([]int, error) {
+	var counts []int
+	for _, field := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, n)
+	}
+	return counts, nil
+}
+
+func dollars(amount float64) string {
+	if amount < 0 {
+		return fmt.Sprintf("-$%.2f", -amount)
+	}
+	return fmt.Sprintf("$%.2f", amount)
+}
+
+func printTables(w io.Writer, costs []Cost) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Scenario\t# Clients\t# Proxies\tLambda Functions\tRedis DB\tAPI Gateway\tCloudWatch Logs\tServerless Total\tServer Based Cost\tServer - Serverless\t")
+	for _, c := range costs {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+			c.Name, c.Clients, c.Proxies,
+			dollars(c.LambdaTotal), dollars(c.Redis), dollars(c.APIGateway), dollars(c.CloudWatch),
+			dollars(c.ServerlessTotal), dollars(c.Server), dollars(c.ServerDifference))
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "Scenario\t# Clients\t# Proxies\tProxyPoll\tClientOffer\tProxyAnswer\tTotal Cost\t")
+	for _, c := range costs {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t\n",
+			c.Name, c.Clients, c.Proxies,
+			dollars(c.Lambda.ProxyPoll), dollars(c.Lambda.ClientOffer), dollars(c.Lambda.ProxyAnswer),
+			dollars(c.LambdaTotal))
+	}
+	return tw.Flush()
+}
+
+func writeJSON(filename string, report Report) error {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if filename == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(filename, b, 0644)
+}
+
+func main() {
+	var prometheusSources string
+	var sample time.Duration
+	var metricsLog string
+	var proxyTimeout time.Duration
+	var clientCounts, proxyCounts string
+	var jsonFilename string
+
+	params := DefaultParams()
+
+	flag.StringVar(&prometheusSources, "prometheus", "", "`URL` or file of the broker's /prometheus output to measure traffic with. A single URL is scraped twice, -sample apart; two comma-separated sources are taken to be scraped -sample apart")
+	flag.DurationVar(&sample, "sample", time.Minute, "time between the two /prometheus scrapes")
+	flag.StringVar(&metricsLog, "metrics-log", "", "broker metrics log `file` to measure traffic with")
+	flag.DurationVar(&proxyTimeout, "proxy-timeout", 5*time.Second, "how long the proxy function waits for a client before answering an idle poll")
+	flag.DurationVar(&params.PollInterval, "poll-interval", params.PollInterval, "how often proxies poll")
+	flag.DurationVar(&params.ClientDuration, "client-duration", params.ClientDuration, "how long the client function runs per offer")
+	flag.DurationVar(&params.AnswerDuration, "answer-duration", params.AnswerDuration, "how long the answer function runs per answer")
+	flag.IntVar(&params.MemoryMB, "memory", params.MemoryMB, "memory of the Lambda functions, in MB")
+	flag.StringVar(&clientCounts, "clients", "20000,40000,60000,80000,100000", "comma-separated numbers of clients to compare")
+	flag.StringVar(&proxyCounts, "proxies", "10000,50000,100000,150000,200000", "comma-separated numbers of proxies to compare")
+	flag.StringVar(&jsonFilename, "json", "", "write a JSON report to this `file`, or to stdout instead of the tables if \"-\"")
+	flag.Parse()
+
+	clients, err := parseCounts(clientCounts)
+	if err != nil {
+		log.Fatalf("invalid -clients: %v", err)
+	}
+	proxies, err := parseCounts(proxyCounts)
+	if err != nil {
+		log.Fatalf("invalid -proxies: %v", err)
+	}
+
+	var traffic *Traffic
+	switch {
+	case prometheusSources != "" && metricsLog != "":
+		log.Fatal("give only one of -prometheus and -metrics-log")
+	case prometheusSources != "":
+		traffic, err = observePrometheus(strings.Split(prometheusSources, ","), sample)
+	case metricsLog != "":
+		traffic, err = observeMetricsLog(metricsLog)
+	}
+	if err != nil {
+		log.Fatalf("Failed to measure traffic: %v", err)
+	}
+
+	report := Report{}
+	if traffic != nil {
+		params = traffic.Params(params, proxyTimeout)
+		report.Traffic = traffic
+		report.Costs = append(report.Costs, Compare(traffic.Scenario(params), params))
+	}
+	report.Params = newReportParams(params)
+	for _, numClients := range clients {
+		for _, numProxies := range proxies {
+			report.Costs = append(report.Costs, Compare(Scenario{
+				Name:    "model",
+				Clients: numClients,
+				Proxies: numProxies,
+			}, params))
+		}
+	}
+
+	if jsonFilename != "-" {
+		if err := printTables(os.Stdout, report.Costs); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if jsonFilename != "" {
+		if err := writeJSON(jsonFilename, report); err != nil {
+			log.Fatalf("Failed to write JSON report: %v", err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"time"
+)
+
+// AWS prices, as found on the billing console.
+const (
+	lambdaPricePerInvocation = 0.0000002 // $0.20 per 1M requests
+	lambdaPricePerGBSecond   = 0.00001667
+
+	redisPricePerGBHour = 0.125
+	redisPricePerECPU   = 0.0034
+	redisStorageGB      = 0.34
+	// How long Redis spends on each request, on average, in seconds
+	redisSecondsPerRequest = 0.34
+
+	apiGatewayPricePerRequest = 0.000001 // $1.00 per 1M requests
+	cloudWatchPricePerGB      = 0.50
+	cloudWatchGBPerMonth      = 0.084
+)
+
+// Costs of running the classic broker on EC2 behind a load balancer.
+const (
+	ec2PricePerHour          = 0.08 // t3.medium
+	storagePricePerGBMonth   = 0.10 // S3 standard storage
+	networkPricePerGB        = 0.09 // outbound data transfer
+	albPricePerHour          = 0.0225
+	albPricePerGB            = 0.008
+	brokerInstances          = 2
+	brokerBaseStorageGB      = 15
+	brokerStorageGBPerClient = 0.001
+	brokerGBPerClient        = 0.01
+	brokerGBPerProxy         = 0.01
+)
+
+const (
+	hoursPerMonth = 730
+	daysPerMonth  = 30
+	secondsPerDay = 86400
+)
+
+// Params holds what the model assumes about the traffic of one client and one
+// proxy. The defaults were measured by hand in CloudWatch.
+type Params struct {
+	PollInterval       time.Duration
+	SessionDuration    time.Duration
+	RequestsPerSession int
+
+	// How long each function runs per invocation, and with how much memory
+	PollDuration   time.Duration
+	ClientDuration time.Duration
+	AnswerDuration time.Duration
+	MemoryMB       int
+
+	// Share of client offers that are matched with a proxy and answered
+	ClientMatchRate float64
+}
+
+func DefaultParams() Params {
+	return Params{
+		PollInterval:       5 * time.Second,
+		SessionDuration:    10 * time.Minute,
+		RequestsPerSession: 10,
+		PollDuration:       5007 * time.Millisecond,
+		ClientDuration:     490 * time.Millisecond,
+		AnswerDuration:     7 * time.Millisecond,
+		MemoryMB:           128,
+		ClientMatchRate:    1,
+	}
+}
+
+// sessionsPerDay is how many rendezvous a client makes in a day.
+func (p Params) sessionsPerDay() float64 {
+	return float64(secondsPerDay / int(p.SessionDuration.Seconds()))
+}
+
+// Scenario is a number of clients and proxies that are online at once.
+type Scenario struct {
+	Name    string `json:"name"`
+	Clients int    `json:"clients"`
+	Proxies int    `json:"proxies"`
+}
+
+// LambdaCost breaks down the monthly cost of the Lambda functions.
+type LambdaCost struct {
+	ProxyPoll   float64 `json:"proxyPoll"`
+	ClientOffer float64 `json:"clientOffer"`
+	ProxyAnswer float64 `json:"proxyAnswer"`
+}
+
+func (c LambdaCost) Total() float64 {
+	return c.ProxyPoll + c.ClientOffer + c.ProxyAnswer
+}
+
+// Cost is the monthly cost of a scenario, in dollars.
+type Cost struct {
+	Scenario
+	Lambda           LambdaCost `json:"lambda"`
+	LambdaTotal      float64    `json:"lambdaTotal"`
+	Redis            float64    `json:"redis"`
+	APIGateway       float64    `json:"apiGateway"`
+	CloudWatch       float64    `json:"cloudWatch"`
+	ServerlessTotal  float64    `json:"serverlessTotal"`
+	Server           float64    `json:"server"`
+	ServerDifference float64    `json:"serverMinusServerless"`
+}
+
+func lambdaCost(invocations float64, duration time.Duration, memoryMB int) float64 {
+	gbSeconds := duration.Seconds() * float64(memoryMB) / 1024 * invocations
+	return gbSeconds*lambdaPricePerGBSecond + invocations*lambdaPricePerInvocation
+}
+
+// serverlessCost computes the monthly cost of the serverless broker.
+func serverlessCost(s Scenario, p Params) Cost {
+	pollsPerDay := float64(s.Proxies) * secondsPerDay / p.PollInterval.Seconds()
+	offersPerDay := float64(s.Clients) * p.sessionsPerDay()
+	answersPerDay := offersPerDay * p.ClientMatchRate
+
+	c := Cost{Scenario: s}
+	c.Lambda = LambdaCost{
+		ProxyPoll:   daysPerMonth * lambdaCost(pollsPerDay, p.PollDuration, p.MemoryMB),
+		ClientOffer: daysPerMonth * lambdaCost(offersPerDay, p.ClientDuration, p.MemoryMB),
+		ProxyAnswer: daysPerMonth * lambdaCost(answersPerDay, p.AnswerDuration, p.MemoryMB),
+	}
+	c.LambdaTotal = c.Lambda.Total()
+	c.APIGateway = daysPerMonth * apiGatewayPricePerRequest * (pollsPerDay + offersPerDay + answersPerDay)
+	c.CloudWatch = cloudWatchPricePerGB * cloudWatchGBPerMonth
+
+	redisRequests := offersPerDay * float64(p.RequestsPerSession) * daysPerMonth
+	redisECPUHours := redisRequests * redisSecondsPerRequest / 3600
+	c.Redis = redisPricePerGBHour*hoursPerMonth*redisStorageGB + redisPricePerECPU*redisECPUHours
+
+	c.ServerlessTotal = c.LambdaTotal + c.Redis + c.APIGateway + c.CloudWatch
+	return c
+}
+
+// serverCost computes the monthly cost of the classic broker.
+func serverCost(s Scenario) float64 {
+	compute := ec2PricePerHour * hoursPerMonth * brokerInstances
+	storage := (brokerBaseStorageGB + float64(s.Clients)*brokerStorageGBPerClient) * storagePricePerGBMonth
+	networkGB := (float64(s.Clients)*brokerGBPerClient + float64(s.Proxies)*brokerGBPerProxy) * daysPerMonth
+	network := networkGB * networkPricePerGB
+	alb := albPricePerHour*hoursPerMonth + networkGB*albPricePerGB
+	return compute + storage + network + alb
+}
+
+// Compare computes the cost of a scenario with the serverless broker and
+// with the classic broker.
+func Compare(s Scenario, p Params) Cost {
+	c := serverlessCost(s, p)
+	c.Server = serverCost(s)
+	c.ServerDifference = c.Server - c.ServerlessTotal
+	return c
+}
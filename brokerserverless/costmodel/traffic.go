@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// counts are the rendezvous counted by the classic broker.
+type counts struct {
+	idlePolls      float64
+	matchedPolls   float64
+	matchedClients float64
+	deniedClients  float64
+}
+
+func (c counts) sub(o counts) counts {
+	return counts{
+		idlePolls:      c.idlePolls - o.idlePolls,
+		matchedPolls:   c.matchedPolls - o.matchedPolls,
+		matchedClients: c.matchedClients - o.matchedClients,
+		deniedClients:  c.deniedClients - o.deniedClients,
+	}
+}
+
+// Traffic is the traffic observed at the classic broker, in requests per
+// second.
+type Traffic struct {
+	PeriodSeconds  float64 `json:"periodSeconds"`
+	IdlePolls      float64 `json:"idlePollsPerSecond"`
+	MatchedPolls   float64 `json:"matchedPollsPerSecond"`
+	MatchedClients float64 `json:"matchedClientsPerSecond"`
+	DeniedClients  float64 `json:"deniedClientsPerSecond"`
+}
+
+func newTraffic(c counts, period time.Duration) (*Traffic, error) {
+	seconds := period.Seconds()
+	if seconds <= 0 {
+		return nil, fmt.Errorf("no time elapsed between observations")
+	}
+	if c.idlePolls < 0 || c.matchedPolls < 0 || c.matchedClients < 0 || c.deniedClients < 0 {
+		return nil, fmt.Errorf("counters went down; was the broker restarted?")
+	}
+	if c.idlePolls+c.matchedPolls == 0 {
+		return nil, fmt.Errorf("no proxy polls observed")
+	}
+	return &Traffic{
+		PeriodSeconds:  seconds,
+		IdlePolls:      c.idlePolls / seconds,
+		MatchedPolls:   c.matchedPolls / seconds,
+		MatchedClients: c.matchedClients / seconds,
+		DeniedClients:  c.deniedClients / seconds,
+	}, nil
+}
+
+func (t *Traffic) polls() float64 {
+	return t.IdlePolls + t.MatchedPolls
+}
+
+func (t *Traffic) clients() float64 {
+	return t.MatchedClients + t.DeniedClients
+}
+
+// Params adjusts p to the observed traffic. An idle poll holds the proxy
+// function for the whole proxyTimeout, and a matched one for half of it on
+// average.
+func (t *Traffic) Params(p Params, proxyTimeout time.Duration) Params {
+	idleShare := t.IdlePolls / t.polls()
+	p.PollDuration = time.Duration(idleShare*float64(proxyTimeout) + (1-idleShare)*float64(proxyTimeout)/2)
+	if t.clients() > 0 {
+		p.ClientMatchRate = t.MatchedClients / t.clients()
+	}
+	return p
+}
+
+// Scenario estimates how many clients and proxies are online at once to make
+// the observed traffic.
+func (t *Traffic) Scenario(p Params) Scenario {
+	pollInterval := p.PollInterval
+	if p.PollDuration > pollInterval {
+		pollInterval = p.PollDuration
+	}
+	return Scenario{
+		Name:    "observed",
+		Clients: int(math.Round(t.clients() * p.SessionDuration.Seconds())),
+		Proxies: int(math.Round(t.polls() * pollInterval.Seconds())),
+	}
+}
+
+// readSource reads a URL or a file.
+func readSource(source string) (io.ReadCloser, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := http.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s returned %s", source, resp.Status)
+		}
+		return resp.Body, nil
+	}
+	return os.Open(source)
+}
+
+// parsePrometheus reads the counters of the broker's /prometheus output.
+func parsePrometheus(r io.Reader) (counts, error) {
+	var c counts
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		return c, err
+	}
+	for _, m := range families["snowflake_rounded_proxy_poll_total"].GetMetric() {
+		switch label(m.GetLabel(), "status") {
+		case "idle":
+			c.idlePolls += m.GetCounter().GetValue()
+		case "matched":
+			c.matchedPolls += m.GetCounter().GetValue()
+		}
+	}
+	for _, m := range families["snowflake_rounded_client_poll_total"].GetMetric() {
+		switch label(m.GetLabel(), "status") {
+		case "matched":
+			c.matchedClients += m.GetCounter().GetValue()
+		case "denied":
+			c.deniedClients += m.GetCounter().GetValue()
+		}
+	}
+	return c, nil
+}
+
+func label(pairs []*dto.LabelPair, name string) string {
+	for _, pair := range pairs {
+		if pair.GetName() == name {
+			return pair.GetValue()
+		}
+	}
+	return ""
+}
+
+// scrapePrometheus reads the counters from a /prometheus URL or file.
+func scrapePrometheus(source string) (counts, error) {
+	r, err := readSource(source)
+	if err != nil {
+		return counts{}, err
+	}
+	defer r.Close()
+	c, err := parsePrometheus(r)
+	if err != nil {
+		return c, fmt.Errorf("error parsing %s: %v", source, err)
+	}
+	return c, nil
+}
+
+// observePrometheus measures the traffic between two scrapes of /prometheus
+// taken sample apart. Unless two sources are given, the one source is scraped
+// twice.
+func observePrometheus(sources []string, sample time.Duration) (*Traffic, error) {
+	var start, end counts
+	var err error
+	switch len(sources) {
+	case 1:
+		if start, err = scrapePrometheus(sources[0]); err != nil {
+			return nil, err
+		}
+		time.Sleep(sample)
+		if end, err = scrapePrometheus(sources[0]); err != nil {
+			return nil, err
+		}
+	case 2:
+		if start, err = scrapePrometheus(sources[0]); err != nil {
+			return nil, err
+		}
+		if end, err = scrapePrometheus(sources[1]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("expected one or two /prometheus sources, got %d", len(sources))
+	}
+	return newTraffic(end.sub(start), sample)
+}
+
+// parseMetricsLog adds up the counts of all periods of the broker's metrics
+// log, and returns them with the total length of the periods.
+func parseMetricsLog(r io.Reader) (counts, time.Duration, error) {
+	var c counts
+	var period time.Duration
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if fields[0] == "snowflake-stats-end" {
+			// snowflake-stats-end 2006-01-02 15:04:05 (86400 s)
+			if len(fields) < 5 {
+				return c, period, fmt.Errorf("bad line: %s", scanner.Text())
+			}
+			seconds, err := strconv.Atoi(strings.TrimPrefix(fields[3], "("))
+			if err != nil {
+				return c, period, fmt.Errorf("bad line: %s", scanner.Text())
+			}
+			period += time.Duration(seconds) * time.Second
+			continue
+		}
+
+		var counter *float64
+		switch fields[0] {
+		case "snowflake-idle-count":
+			counter = &c.idlePolls
+		case "client-snowflake-match-count":
+			counter = &c.matchedClients
+		case "client-denied-count":
+			counter = &c.deniedClients
+		default:
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return c, period, fmt.Errorf("bad line: %s", scanner.Text())
+		}
+		*counter += float64(n)
+	}
+	// Every matched client took one matched poll.
+	c.matchedPolls = c.matchedClients
+	return c, period, scanner.Err()
+}
+
+// observeMetricsLog measures the traffic over all periods of a metrics log.
+func observeMetricsLog(filename string) (*Traffic, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, period, err := parseMetricsLog(f)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", filename, err)
+	}
+	return newTraffic(c, period)
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/amp"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/ratelimit"
+)
+
+const ampClientPrefix = "/amp/client/"
+
+// AmpClient is the AMP-speaking endpoint for client poll messages, intended
+// for access via an AMP cache, like ampClientOffers in the broker. The
+// client's encoded poll message is in the URL path rather than the request
+// body, and the encoded client poll response is sent back as AMP-armored
+// HTML.
+func (h *Handler) AmpClient(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	log.Print("Received client offer request inside ampClientHandler")
+
+	// The encoded client poll message immediately follows the
+	// /amp/client/ path prefix.
+	path := strings.TrimPrefix(request.Path, ampClientPrefix)
+	if path == request.Path {
+		// The path didn't start with the expected prefix. This probably
+		// indicates a misconfigured route.
+		log.Printf("ampClientHandler: unexpected prefix in path %s", request.Path)
+		return events.APIGatewayProxyResponse{StatusCode: 500}, nil
+	}
+
+	remoteAddr := h.clientIP(request.Headers, request.MultiValueHeaders, request.RequestContext.Identity.SourceIP)
+	if !h.allowRequest(ctx, ratelimit.EndpointAmp, remoteAddr) {
+		return errorResponse(messages.ErrRateLimited), nil
+	}
+
+	var response []byte
+	encPollReq, err := amp.DecodePath(path)
+	if err == nil {
+		arg := messages.Arg{
+			Body:             encPollReq,
+			RemoteAddr:       remoteAddr,
+			RendezvousMethod: messages.RendezvousAmpCache,
+		}
+		err = h.handleClientOffer(ctx, arg, &response)
+	} else {
+		response, err = (&messages.ClientPollResponse{
+			Error: "cannot decode URL path",
+		}).EncodePollResponse()
+	}
+	if err != nil {
+		// We couldn't even construct a JSON object containing an error
+		// message. The AMP cache will translate this 500 status into a 404
+		// status.
+		log.Printf("ampClientHandler: %v", err)
+		return events.APIGatewayProxyResponse{StatusCode: 500}, nil
+	}
+
+	var body strings.Builder
+	enc, err := amp.NewArmorEncoder(&body)
+	if err != nil {
+		log.Printf("amp.NewArmorEncoder: %v", err)
+		return events.APIGatewayProxyResponse{StatusCode: 500}, nil
+	}
+	if _, err := enc.Write(response); err != nil {
+		log.Printf("ampClientHandler: unable to write answer: %v", err)
+		return events.APIGatewayProxyResponse{StatusCode: 500}, nil
+	}
+	if err := enc.Close(); err != nil {
+		log.Printf("ampClientHandler: unable to write answer: %v", err)
+		return events.APIGatewayProxyResponse{StatusCode: 500}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers: map[string]string{
+			"Content-Type": "text/html",
+			// Hint to an AMP cache not to waste resources caching this
+			// document, as the broker does.
+			"Cache-Control": "max-age=15",
+		},
+		Body: body.String(),
+	}, nil
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/matchstore"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/ratelimit"
+)
+
+// Answer decodes the request and returns the APIGateway response.
+func (h *Handler) Answer(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	log.Print("Received proxy answer request inside answer Handler")
+
+	arg, err := h.decodeRequest(request, "")
+	if err != nil {
+		return invalidRequestResponse(err), nil
+	}
+	if !h.allowRequest(ctx, ratelimit.EndpointAnswer, arg.RemoteAddr) {
+		return errorResponse(messages.ErrRateLimited), nil
+	}
+	log.Printf("Body in answer handler: %s", arg.Body)
+
+	if err := validateSDP(arg.Body); err != nil {
+		log.Println("Error proxy SDP: ", err.Error())
+		return errorResponse(messages.ErrBadRequest), nil
+	}
+
+	var response []byte
+	err = h.handleProxyAnswers(ctx, arg, &response)
+	if err != nil {
+		return errorResponse(err), nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       string(response),
+	}, nil
+}
+
+// handleProxyAnswers handles stores the proxy answer request in Redis.
+func (h *Handler) handleProxyAnswers(ctx context.Context, arg messages.Arg, response *[]byte) error {
+	// Decode the SDP and validate it
+	answer, proxyID, err := messages.DecodeAnswerRequest(arg.Body)
+	if err != nil || answer == "" {
+		log.Printf("Invalid SDP or answer: %v", err)
+		return messages.ErrBadRequest
+	}
+
+	// Push the proxy answer to the waiting client
+	success := true
+	err = h.Store.DeliverAnswer(ctx, proxyID, answer)
+	if errors.Is(err, matchstore.ErrClientGone) {
+		log.Printf("Client of proxy %s is gone", proxyID)
+		success = false
+	} else if err != nil {
+		return fmt.Errorf("failed to deliver answer of proxy %s: %v", proxyID, err)
+	}
+
+	b, err := messages.EncodeAnswerResponse(success)
+	if err != nil {
+		log.Printf("Error encoding answer: %s", err)
+		return messages.ErrInternal
+	}
+	*response = b
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgefingerprint"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgelist"
+)
+
+// bridgeListRetries is how many more times a bridge list that could not be
+// read at cold start is tried, and bridgeListBackoff how long the first retry
+// waits. The wait doubles with each retry.
+const (
+	bridgeListRetries = 5
+	bridgeListBackoff = 10 * time.Second
+)
+
+// bridgeListTimeout bounds each attempt to read the bridge list, as retries
+// happen while a request is served.
+const bridgeListTimeout = 5 * time.Second
+
+// LoadBridgeList loads the bridge list of the serverless broker, in the format
+// of the broker's -bridge-list-path file. It is taken from the first of these
+// environment variables that is not empty:
+//
+//	BRIDGE_LIST            the bridge list itself
+//	BRIDGE_LIST_URL        the URL of an object holding the bridge list, such
+//	                       as an S3 object
+//	BRIDGE_LIST_REDIS_KEY  the Redis key holding the bridge list
+//
+// If none is set, the default bridge is the only one known. If the list
+// cannot be read or loaded, as during a Redis outage, the default bridge list
+// is served instead, so that the functions still start, and the list is tried
+// again as it is used, a few times with an exponential backoff.
+func LoadBridgeList(ctx context.Context, redisClient redis.UniversalClient) bridgelist.BridgeListHolderFileBased {
+	l := &retryingBridgeList{
+		BridgeListHolderFileBased: bridgelist.NewBridgeListHolder(),
+		read:                      bridgeListSource(redisClient),
+		backoff:                   bridgeListBackoff,
+		now:                       time.Now,
+	}
+	if err := l.load(ctx); err != nil {
+		log.Printf("Failed to load bridge list, serving the default one until it loads: %v", err)
+		if err := l.BridgeListHolderFileBased.LoadBridgeInfo(bytes.NewReader([]byte(bridgelist.DefaultBridgeList))); err != nil {
+			panic(err)
+		}
+		l.retries = bridgeListRetries
+		l.next = l.now().Add(l.backoff)
+	}
+	return l
+}
+
+// bridgeListSource returns the function reading the bridge list from where
+// the environment says it is.
+func bridgeListSource(redisClient redis.UniversalClient) func(context.Context) ([]byte, error) {
+	if s := os.Getenv("BRIDGE_LIST"); s != "" {
+		return func(context.Context) ([]byte, error) { return []byte(s), nil }
+	} else if url := os.Getenv("BRIDGE_LIST_URL"); url != "" {
+		return func(ctx context.Context) ([]byte, error) { return fetchBridgeList(ctx, url) }
+	} else if key := os.Getenv("BRIDGE_LIST_REDIS_KEY"); key != "" {
+		return func(ctx context.Context) ([]byte, error) {
+			list, err := redisClient.Get(ctx, key).Bytes()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read bridge list from Redis key %s: %v", key, err)
+			}
+			return list, nil
+		}
+	}
+	return func(context.Context) ([]byte, error) { return []byte(bridgelist.DefaultBridgeList), nil }
+}
+
+// retryingBridgeList is a bridge list that tries to read its list again, when
+// it is used, while it serves a fallback one.
+type retryingBridgeList struct {
+	bridgelist.BridgeListHolderFileBased
+	read func(context.Context) ([]byte, error)
+	now  func() time.Time
+
+	lock sync.Mutex
+	// retries is how many attempts are left, zero once the list is loaded.
+	retries int
+	next    time.Time
+	backoff time.Duration
+}
+
+func (l *retryingBridgeList) load(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, bridgeListTimeout)
+	defer cancel()
+	list, err := l.read(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := l.BridgeListHolderFileBased.ReloadBridgeInfo(bytes.NewReader(list)); err != nil {
+		return fmt.Errorf("failed to load bridge list: %v", err)
+	}
+	return nil
+}
+
+// retry tries to load the list again if an attempt is left and due.
+func (l *retryingBridgeList) retry() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.retries == 0 || l.now().Before(l.next) {
+		return
+	}
+	l.retries--
+	if err := l.load(context.Background()); err != nil {
+		if l.retries == 0 {
+			log.Printf("Failed to load bridge list, giving up and keeping the default one: %v", err)
+			return
+		}
+		l.backoff *= 2
+		l.next = l.now().Add(l.backoff)
+		log.Printf("Failed to load bridge list, retrying in %v: %v", l.backoff, err)
+		return
+	}
+	l.retries = 0
+	log.Print("Loaded bridge list")
+}
+
+func (l *retryingBridgeList) GetBridgeInfo(fingerprint bridgefingerprint.Fingerprint) (bridgelist.BridgeInfo, error) {
+	l.retry()
+	return l.BridgeListHolderFileBased.GetBridgeInfo(fingerprint)
+}
+
+func (l *retryingBridgeList) AllBridgeInfo() []bridgelist.BridgeInfo {
+	l.retry()
+	return l.BridgeListHolderFileBased.AllBridgeInfo()
+}
+
+func fetchBridgeList(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch bridge list: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch bridge list: %s", resp.Status)
+	}
+	log.Printf("Fetched bridge list from %s", url)
+	return io.ReadAll(resp.Body)
+}
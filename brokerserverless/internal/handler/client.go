@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgefingerprint"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/matchstore"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/ratelimit"
+)
+
+// Client decodes the request and returns the APIGateway response.
+func (h *Handler) Client(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	log.Print("Received client offer request inside clientHandler")
+
+	arg, err := h.decodeRequest(request, messages.RendezvousHttp)
+	if err != nil {
+		return invalidRequestResponse(err), nil
+	}
+	if !h.allowRequest(ctx, ratelimit.EndpointClient, arg.RemoteAddr) {
+		return errorResponse(messages.ErrRateLimited), nil
+	}
+	log.Printf("Body in client handler: %s", arg.Body)
+
+	// Handle the legacy version
+	//
+	// Like the broker, we support the legacy client format, which relies on
+	// HTTP headers and status codes to convey information.
+	isLegacy := false
+	if len(arg.Body) > 0 && arg.Body[0] == '{' {
+		isLegacy = true
+		req := messages.ClientPollRequest{
+			Offer: string(arg.Body),
+			NAT:   header(request, "Snowflake-NAT-Type"),
+		}
+		encoded, err := req.EncodeClientPollRequest()
+		if err != nil {
+			log.Printf("Error shimming the legacy request: %s", err.Error())
+			return errorResponse(messages.ErrInternal), nil
+		}
+		arg.Body = encoded
+	}
+
+	var response []byte
+	err = h.handleClientOffer(ctx, arg, &response)
+	if err != nil {
+		return errorResponse(err), nil
+	}
+
+	if isLegacy {
+		resp, err := messages.DecodeClientPollResponse(response)
+		if err != nil {
+			return errorResponse(err), nil
+		}
+		switch resp.Error {
+		case "":
+			response = []byte(resp.Answer)
+		case messages.StrNoProxies:
+			return events.APIGatewayProxyResponse{StatusCode: 503}, nil
+		case messages.StrTimedOut:
+			return events.APIGatewayProxyResponse{StatusCode: 504}, nil
+		default:
+			// The offer was rejected.
+			return errorResponse(messages.ErrBadRequest), nil
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       string(response),
+	}, nil
+}
+
+// ClientOffers handles a client offer that did not come through API Gateway,
+// such as one received over SQS, like IPC.ClientOffers in the broker.
+func (h *Handler) ClientOffers(ctx context.Context, arg messages.Arg, response *[]byte) error {
+	return h.handleClientOffer(ctx, arg, response)
+}
+
+// handleClientOffer checks for an available proxy and waits for the proxy answer returning the answer as a response.
+func (h *Handler) handleClientOffer(ctx context.Context, arg messages.Arg, response *[]byte) error {
+	req, err := messages.DecodeClientPollRequest(arg.Body)
+	if err != nil {
+		return sendClientResponse(&messages.ClientPollResponse{Error: err.Error()}, response)
+	}
+
+	offer := &matchstore.Offer{
+		NATType: req.NAT,
+		SDP:     []byte(req.Offer),
+	}
+
+	fingerprint, err := hex.DecodeString(req.Fingerprint)
+	if err != nil {
+		return sendClientResponse(&messages.ClientPollResponse{Error: err.Error()}, response)
+	}
+
+	bridgeFingerprint, err := bridgefingerprint.FingerprintFromBytes(fingerprint)
+	if err != nil {
+		return sendClientResponse(&messages.ClientPollResponse{Error: err.Error()}, response)
+	}
+
+	// Reject clients asking for a bridge we cannot send proxies to
+	info, err := h.BridgeList.GetBridgeInfo(bridgeFingerprint)
+	if err != nil {
+		return sendClientResponse(&messages.ClientPollResponse{Error: err.Error()}, response)
+	}
+
+	offer.Fingerprint = bridgeFingerprint.ToBytes()
+
+	// Immediately check for an available proxy compatible with the client
+	// NAT type and willing to connect to a relay of the bridge
+	proxy, err := h.Store.ClaimProxy(matchstore.WithRelayHosts(ctx, info.RelayHosts()), offer.NATType)
+	if err != nil {
+		return fmt.Errorf("error claiming proxy: %v", err)
+	}
+	if proxy == nil {
+		// No proxy available
+		h.Metrics.UpdateRendezvousStats(ctx, arg.RemoteAddr, arg.RendezvousMethod, offer.NATType, false)
+		return sendClientResponse(&messages.ClientPollResponse{Error: messages.StrNoProxies}, response)
+	}
+	log.Printf("Assigned proxy ID: %s", proxy.ID)
+	defer h.Store.Expire(ctx, proxy)
+
+	err = h.Store.DeliverOffer(ctx, proxy, offer)
+	if errors.Is(err, matchstore.ErrProxyGone) {
+		// The proxy timed out before the offer could be handed to it
+		log.Printf("Proxy %s is gone", proxy.ID)
+		h.Metrics.UpdateRendezvousStats(ctx, arg.RemoteAddr, arg.RendezvousMethod, offer.NATType, false)
+		return sendClientResponse(&messages.ClientPollResponse{Error: messages.StrNoProxies}, response)
+	} else if err != nil {
+		return fmt.Errorf("error delivering offer to proxy %s: %v", proxy.ID, err)
+	}
+	log.Printf("Matched proxy %s", proxy.ID)
+
+	// Wait for proxy answer with a blocking call
+	answer, err := h.Store.WaitForAnswer(ctx, proxy)
+	if errors.Is(err, matchstore.ErrTimeout) {
+		// Handle timeout case: no proxy answer received within the timeout
+		log.Printf("Timeout: No proxy answer received from proxy %s", proxy.ID)
+		return sendClientResponse(&messages.ClientPollResponse{Error: messages.StrTimedOut}, response)
+	} else if err != nil {
+		return fmt.Errorf("error waiting for proxy answer: %v", err)
+	}
+
+	h.Metrics.UpdateRendezvousStats(ctx, arg.RemoteAddr, arg.RendezvousMethod, offer.NATType, true)
+	return sendClientResponse(&messages.ClientPollResponse{Answer: answer}, response)
+}
+
+// sendClientResponse is a helper function to send the error response.
+func sendClientResponse(resp *messages.ClientPollResponse, response *[]byte) error {
+	respBytes, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal error response: %v", err)
+	}
+	*response = respBytes
+	return nil
+}
@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/realclientip/realclientip-go"
+)
+
+// clientIP returns the address of the client of a request, like
+// util.GetClientIp in the broker. API Gateway only gives the address the
+// request came from, which is that of the CDN when the broker is reached
+// through domain fronting, so the client address is taken from the
+// X-Forwarded-For header when TrustedProxyCount is set. Entries of the
+// header added before the trusted proxies are ignored, since clients can
+// write anything there.
+func (h *Handler) clientIP(headers map[string]string, multiValueHeaders map[string][]string, sourceIP string) string {
+	if h.TrustedProxyCount <= 0 {
+		return sourceIP
+	}
+	strat, err := realclientip.NewRightmostTrustedCountStrategy("X-Forwarded-For", h.TrustedProxyCount)
+	if err != nil {
+		log.Printf("Invalid trusted proxy count %d: %v", h.TrustedProxyCount, err)
+		return sourceIP
+	}
+
+	header := make(http.Header)
+	if len(multiValueHeaders) > 0 {
+		for name, values := range multiValueHeaders {
+			for _, value := range values {
+				header.Add(name, value)
+			}
+		}
+	} else {
+		for name, value := range headers {
+			header.Add(name, value)
+		}
+	}
+	if ip := strat.ClientIP(header, ""); ip != "" {
+		return ip
+	}
+	// There are fewer addresses in the header than trusted proxies, so
+	// the request did not come through them.
+	return sourceIP
+}
@@ -0,0 +1,212 @@
+/*
+Package handler implements the endpoints of the serverless broker as API
+Gateway Lambda handlers. The client, proxy and answer functions each serve one
+of them, and brokerserverless/local serves all three from a single process.
+*/
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/go-redis/redis/v8"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/brokerserverless/internal/metrics"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/brokerserverless/internal/redisconfig"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgelist"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/matchstore"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/ratelimit"
+)
+
+const DATABASE_EXPIRATION = 5 * time.Minute
+const CLIENT_OFFER_TIMEOUT = 5 * time.Second
+const PROXY_ANSWER_TIMEOUT = time.Second * 5
+
+// Handler serves the serverless broker endpoints, keeping the matching state
+// in Store.
+type Handler struct {
+	Store matchstore.MatchStore
+	// BridgeList holds the bridges clients may ask for, and the relay URL
+	// proxies are given for each of them. Proxies are only matched with
+	// clients of the bridges whose relays their relay pattern accepts.
+	BridgeList bridgelist.BridgeListHolderFileBased
+
+	// PresumedPatternForLegacyClient is the pattern assumed for proxies too
+	// old to send an AcceptedRelayPattern.
+	PresumedPatternForLegacyClient string
+
+	// Metrics records the broker's metrics, if not nil.
+	Metrics *metrics.Metrics
+
+	// TrustedProxyCount is the number of reverse proxies, API Gateway
+	// included, that add the address they are reached from to the
+	// X-Forwarded-For header of requests. If zero, the header is ignored
+	// and clients are known by the address API Gateway is reached from.
+	TrustedProxyCount int
+
+	// RateLimiter limits how often a host may use each endpoint. Requests
+	// are not limited if it is nil.
+	RateLimiter *ratelimit.Limiter
+}
+
+// NewHandlerFromEnv returns a Handler for store, with the relay pattern of
+// legacy proxies given by the DEFAULT_RELAY_PATTERN environment variable, like
+// the broker's -default-relay-pattern flag. ALLOWED_RELAY_PATTERN, like the
+// broker's -allowed-relay-pattern flag, is ignored.
+func NewHandlerFromEnv(store matchstore.MatchStore) *Handler {
+	if os.Getenv("ALLOWED_RELAY_PATTERN") != "" {
+		log.Println("Warning: ALLOWED_RELAY_PATTERN is deprecated and ignored")
+	}
+	return &Handler{
+		Store:                          store,
+		PresumedPatternForLegacyClient: os.Getenv("DEFAULT_RELAY_PATTERN"),
+	}
+}
+
+// NewLambdaHandlerFromEnv returns the Handler of a Lambda function: its store
+// is in the Redis server configured as by redisconfig.NewClientFromEnv, and
+// it is given the bridge list of LoadBridgeList and the metrics of
+// metrics.NewMetricsFromEnv. The TRUSTED_PROXY_COUNT environment variable
+// sets its TrustedProxyCount, and RATE_LIMIT the budgets of its RateLimiter,
+// in the format of ratelimit.ParseBudgets. The token buckets are kept in
+// Redis, so that they are shared by all the functions.
+func NewLambdaHandlerFromEnv(ctx context.Context) (*Handler, error) {
+	redisClient, err := redisconfig.NewClientFromEnv(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis configuration: %v", err)
+	}
+
+	h := NewHandlerFromEnv(NewRedisStore(redisClient))
+
+	if s := os.Getenv("TRUSTED_PROXY_COUNT"); s != "" {
+		h.TrustedProxyCount, err = strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXY_COUNT: %v", err)
+		}
+	}
+
+	h.BridgeList = LoadBridgeList(ctx, redisClient)
+
+	h.Metrics, err = metrics.NewMetricsFromEnv(redisClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load geoip databases: %v", err)
+	}
+
+	budgets, err := ratelimit.ParseBudgets(os.Getenv("RATE_LIMIT"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RATE_LIMIT: %v", err)
+	}
+	if len(budgets) > 0 {
+		h.RateLimiter = ratelimit.NewLimiter(ratelimit.NewRedisStore(redisClient), budgets)
+	}
+	return h, nil
+}
+
+// allowRequest reports whether a request of the host at addr to endpoint is
+// within the rate limit of the endpoint, and counts the requests that are not.
+func (h *Handler) allowRequest(ctx context.Context, endpoint, addr string) bool {
+	if h.RateLimiter.Allow(ctx, endpoint, addr) {
+		return true
+	}
+	h.Metrics.RateLimited(ctx, endpoint)
+	return false
+}
+
+// ProxyRelayPattern returns the relay pattern of a proxy: the one it sent, or
+// the presumed one if it is too old to send one.
+func (h *Handler) ProxyRelayPattern(pattern string, nonSupported bool) string {
+	if nonSupported {
+		return h.PresumedPatternForLegacyClient
+	}
+	return pattern
+}
+
+// CheckProxyRelayPattern reports whether a proxy with the given relay pattern
+// accepts a relay of at least one bridge of the list, and so can ever be
+// matched with a client, like the broker's CheckProxyRelayPattern.
+func (h *Handler) CheckProxyRelayPattern(pattern string) bool {
+	for _, info := range h.BridgeList.AllBridgeInfo() {
+		if matchstore.AcceptsRelay(pattern, info.RelayHosts()) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorResponse maps the error of a request to the status of the response,
+// like broker/http.go does, without passing on the details.
+func errorResponse(err error) events.APIGatewayProxyResponse {
+	if errors.Is(err, messages.ErrBadRequest) {
+		return events.APIGatewayProxyResponse{StatusCode: 400}
+	}
+	if errors.Is(err, messages.ErrRateLimited) {
+		return events.APIGatewayProxyResponse{StatusCode: 429}
+	}
+	log.Println(err)
+	return events.APIGatewayProxyResponse{StatusCode: 500}
+}
+
+// header returns the value of a request header. HTTP APIs pass header names
+// in lower case.
+func header(request events.APIGatewayProxyRequest, name string) string {
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// decodeRequest returns the message of an API Gateway request, received by
+// rendezvous method. API Gateway base64-encodes bodies that are not valid
+// text.
+func (h *Handler) decodeRequest(request events.APIGatewayProxyRequest, method messages.RendezvousMethod) (messages.Arg, error) {
+	body := []byte(request.Body)
+	if request.IsBase64Encoded {
+		var err error
+		body, err = base64.StdEncoding.DecodeString(request.Body)
+		if err != nil {
+			return messages.Arg{}, fmt.Errorf("error decoding base64 body: %v", err)
+		}
+	}
+	return messages.Arg{
+		Body:             body,
+		RemoteAddr:       h.clientIP(request.Headers, request.MultiValueHeaders, request.RequestContext.Identity.SourceIP),
+		RendezvousMethod: method,
+	}, nil
+}
+
+// invalidRequestResponse answers a request decodeRequest failed on.
+func invalidRequestResponse(err error) events.APIGatewayProxyResponse {
+	log.Println(err)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 400,
+		Body:       "Invalid base64 encoding",
+	}
+}
+
+func validateSDP(SDP []byte) error {
+	if !bytes.Contains(SDP, []byte("a=candidate")) {
+		return fmt.Errorf("SDP contains no candidate")
+	}
+	return nil
+}
+
+// NewRedisStore returns a RedisStore with the timeouts used by the Lambdas.
+func NewRedisStore(client redis.UniversalClient) *matchstore.RedisStore {
+	store := matchstore.NewRedisStore(client)
+	store.ProxyTimeout = CLIENT_OFFER_TIMEOUT
+	store.AnswerTimeout = PROXY_ANSWER_TIMEOUT
+	store.Expiration = DATABASE_EXPIRATION
+	return store
+}
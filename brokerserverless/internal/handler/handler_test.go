@@ -0,0 +1,359 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/go-redis/redis/v8"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgefingerprint"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgelist"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/matchstore"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/ratelimit"
+)
+
+const (
+	testRelayPattern = "^snowflake.torproject.net$"
+	testFingerprint  = "2B280B23E1107BB62ABFC40DDCC8824814F80A72"
+	testOffer        = "v=0\r\na=candidate:offer"
+	testAnswer       = "v=0\r\na=candidate:answer"
+)
+
+func newTestHandler(t *testing.T) *Handler {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	bridgeList := bridgelist.NewBridgeListHolder()
+	if err := bridgeList.LoadBridgeInfo(bytes.NewReader([]byte(bridgelist.DefaultBridgeList))); err != nil {
+		t.Fatal(err)
+	}
+	return &Handler{
+		Store:                          NewRedisStore(client),
+		BridgeList:                     bridgeList,
+		PresumedPatternForLegacyClient: testRelayPattern,
+	}
+}
+
+// request returns an API Gateway request carrying body, base64-encoded as
+// API Gateway does for binary bodies if encode is set.
+func request(body []byte, encode bool) events.APIGatewayProxyRequest {
+	r := events.APIGatewayProxyRequest{Body: string(body)}
+	if encode {
+		r.Body = base64.StdEncoding.EncodeToString(body)
+		r.IsBase64Encoded = true
+	}
+	r.RequestContext.Identity.SourceIP = "192.0.2.1"
+	return r
+}
+
+func proxyPoll(t *testing.T, h *Handler, token string) (offer string, newToken string) {
+	offer, _, newToken, err := relayProxyPoll(t, h, testRelayPattern, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return offer, newToken
+}
+
+// relayProxyPoll polls as a proxy accepting the relays matched by pattern,
+// and returns the error of the poll response, if any.
+func relayProxyPoll(t *testing.T, h *Handler, pattern, token string) (offer, relayURL, newToken string, err error) {
+	body, err := messages.EncodeProxyPollRequestWithToken("sid", "standalone", "unrestricted", 0, pattern, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := h.Proxy(context.Background(), request(body, false))
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("proxy poll: status %d, error %v", resp.StatusCode, err)
+	}
+	offer, _, relayURL, newToken, err = messages.DecodePollResponseWithToken([]byte(resp.Body))
+	return offer, relayURL, newToken, err
+}
+
+func TestRendezvous(t *testing.T) {
+	h := newTestHandler(t)
+
+	_, token := proxyPoll(t, h, "")
+	if token == "" {
+		t.Fatal("proxy was not registered")
+	}
+
+	clientBody, err := (&messages.ClientPollRequest{
+		Offer:       testOffer,
+		NAT:         "unrestricted",
+		Fingerprint: testFingerprint,
+	}).EncodeClientPollRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDone := make(chan events.APIGatewayProxyResponse)
+	go func() {
+		resp, err := h.Client(context.Background(), request(clientBody, true))
+		if err != nil {
+			t.Error(err)
+		}
+		clientDone <- resp
+	}()
+
+	var offer string
+	for deadline := time.Now().Add(time.Second); offer == "" && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		offer, _ = proxyPoll(t, h, token)
+	}
+	if offer != testOffer {
+		t.Fatalf("expected offer %q, got %q", testOffer, offer)
+	}
+
+	answerBody, err := messages.EncodeAnswerRequest(testAnswer, "sid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := h.Answer(context.Background(), request(answerBody, true))
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("answer: status %d, error %v", resp.StatusCode, err)
+	}
+	if success, err := messages.DecodeAnswerResponse([]byte(resp.Body)); err != nil || !success {
+		t.Fatalf("answer was not delivered: %v", err)
+	}
+
+	resp = <-clientDone
+	if resp.StatusCode != 200 {
+		t.Fatalf("client: status %d", resp.StatusCode)
+	}
+	clientResp, err := messages.DecodeClientPollResponse([]byte(resp.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientResp.Answer != testAnswer || clientResp.Error != "" {
+		t.Errorf("unexpected client response %+v", clientResp)
+	}
+}
+
+func TestRelayPattern(t *testing.T) {
+	h := newTestHandler(t)
+	const multiFingerprint = "8838024498816A039FCBBAB14E6F40A0843051FA"
+	bridges := bridgelist.DefaultBridgeList +
+		`{"displayName":"multi", "relays":[{"url":"wss://01.snowflake.example/"}, {"url":"wss://snowflake.example.org/"}], "fingerprint":"` + multiFingerprint + `"}` + "\n"
+	if err := h.BridgeList.LoadBridgeInfo(bytes.NewReader([]byte(bridges))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Proxies accepting no relay of any bridge are rejected.
+	if _, _, _, err := relayProxyPoll(t, h, "^other.example$", ""); err == nil || err.Error() != "incorrect relay pattern" {
+		t.Fatalf("expected the relay pattern to be rejected, got %v", err)
+	}
+
+	_, _, token, err := relayProxyPoll(t, h, "snowflake.example$", "")
+	if err != nil || token == "" {
+		t.Fatalf("proxy was not registered: %v", err)
+	}
+	clientPoll := func(fingerprint string) *messages.ClientPollResponse {
+		body, err := (&messages.ClientPollRequest{
+			Offer:       testOffer,
+			NAT:         "unrestricted",
+			Fingerprint: fingerprint,
+		}).EncodeClientPollRequest()
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		resp, err := h.Client(context.Background(), request(body, false))
+		if err != nil || resp.StatusCode != 200 {
+			t.Errorf("client: status %d, error %v", resp.StatusCode, err)
+			return nil
+		}
+		clientResp, err := messages.DecodeClientPollResponse([]byte(resp.Body))
+		if err != nil {
+			t.Error(err)
+		}
+		return clientResp
+	}
+
+	// The proxy is not matched with clients of a bridge it has no relay for.
+	if resp := clientPoll(testFingerprint); resp == nil || resp.Error != messages.StrNoProxies {
+		t.Fatalf("expected %q, got %+v", messages.StrNoProxies, resp)
+	}
+
+	clientDone := make(chan *messages.ClientPollResponse)
+	go func() { clientDone <- clientPoll(multiFingerprint) }()
+	var offer, relayURL string
+	for deadline := time.Now().Add(time.Second); offer == "" && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		offer, relayURL, _, err = relayProxyPoll(t, h, "snowflake.example$", token)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if offer != testOffer {
+		t.Fatalf("expected offer %q, got %q", testOffer, offer)
+	}
+	// The proxy is given the relay of the bridge its pattern accepts.
+	if relayURL != "wss://01.snowflake.example/" {
+		t.Errorf("expected the relay the proxy accepts, got %q", relayURL)
+	}
+
+	answerBody, err := messages.EncodeAnswerRequest(testAnswer, "sid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Answer(context.Background(), request(answerBody, false)); err != nil {
+		t.Fatal(err)
+	}
+	if resp := <-clientDone; resp == nil || resp.Answer != testAnswer {
+		t.Errorf("unexpected client response %+v", resp)
+	}
+}
+
+func TestNoProxies(t *testing.T) {
+	h := newTestHandler(t)
+
+	clientBody, err := (&messages.ClientPollRequest{
+		Offer:       testOffer,
+		NAT:         "unrestricted",
+		Fingerprint: testFingerprint,
+	}).EncodeClientPollRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := h.Client(context.Background(), request(clientBody, false))
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("status %d, error %v", resp.StatusCode, err)
+	}
+	clientResp, err := messages.DecodeClientPollResponse([]byte(resp.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientResp.Error != messages.StrNoProxies {
+		t.Errorf("expected %q, got %+v", messages.StrNoProxies, clientResp)
+	}
+}
+
+func TestDecodeRequest(t *testing.T) {
+	arg, err := newTestHandler(t).decodeRequest(request([]byte("body"), true), messages.RendezvousHttp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(arg.Body) != "body" || arg.RemoteAddr != "192.0.2.1" || arg.RendezvousMethod != messages.RendezvousHttp {
+		t.Errorf("unexpected decoded request %+v", arg)
+	}
+
+	invalid := events.APIGatewayProxyRequest{Body: "not base64!", IsBase64Encoded: true}
+	for name, handle := range map[string]func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error){
+		"client": newTestHandler(t).Client,
+		"proxy":  newTestHandler(t).Proxy,
+		"answer": newTestHandler(t).Answer,
+	} {
+		resp, err := handle(context.Background(), invalid)
+		if err != nil || resp.StatusCode != 400 {
+			t.Errorf("%s: expected status 400, got %d, error %v", name, resp.StatusCode, err)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	h := newTestHandler(t)
+	for _, test := range []struct {
+		trustedProxyCount int
+		forwardedFor      string
+		expected          string
+	}{
+		// Without trusted proxies, the header is ignored.
+		{0, "198.51.100.1", "192.0.2.1"},
+		// API Gateway alone added the address it was reached from.
+		{1, "198.51.100.1, 192.0.2.1", "192.0.2.1"},
+		// A CDN added the client address, then API Gateway added the
+		// CDN's; the first entry was written by the client.
+		{2, "203.0.113.1, 198.51.100.1, 192.0.2.1", "198.51.100.1"},
+		// The request did not come through the CDN.
+		{2, "192.0.2.1", "192.0.2.1"},
+	} {
+		h.TrustedProxyCount = test.trustedProxyCount
+		r := request([]byte("body"), false)
+		r.Headers = map[string]string{"x-forwarded-for": test.forwardedFor}
+		arg, err := h.decodeRequest(r, messages.RendezvousHttp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if arg.RemoteAddr != test.expected {
+			t.Errorf("%d trusted proxies, X-Forwarded-For %q: expected %s, got %s",
+				test.trustedProxyCount, test.forwardedFor, test.expected, arg.RemoteAddr)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h := newTestHandler(t)
+	h.RateLimiter = ratelimit.NewLimiter(ratelimit.NewMemoryStore(), ratelimit.Budgets{
+		ratelimit.EndpointClient: {Rate: 0.001, Burst: 1},
+	})
+
+	clientBody, err := (&messages.ClientPollRequest{
+		Offer:       testOffer,
+		NAT:         "unrestricted",
+		Fingerprint: testFingerprint,
+	}).EncodeClientPollRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []int{200, 429} {
+		resp, err := h.Client(context.Background(), request(clientBody, false))
+		if err != nil || resp.StatusCode != expected {
+			t.Errorf("client poll %d: expected status %d, got %d, error %v", i, expected, resp.StatusCode, err)
+		}
+	}
+
+	// Proxies have no budget.
+	for i := 0; i < 3; i++ {
+		proxyPoll(t, h, "")
+		h.Store.Expire(context.Background(), &matchstore.Proxy{ID: "sid", NATType: "unrestricted"})
+	}
+}
+
+func TestLoadBridgeListRetry(t *testing.T) {
+	const multiFingerprint = "8838024498816A039FCBBAB14E6F40A0843051FA"
+	multiList := `{"displayName":"multi", "webSocketAddress":"wss://01.snowflake.example/", "fingerprint":"` + multiFingerprint + `"}` + "\n"
+	fingerprint, err := bridgefingerprint.FingerprintFromHexString(multiFingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	t.Setenv("BRIDGE_LIST_REDIS_KEY", "bridges")
+
+	// The default bridge list is served until the list can be read.
+	l := LoadBridgeList(context.Background(), client).(*retryingBridgeList)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	if _, err := l.GetBridgeInfo(fingerprint); err == nil {
+		t.Fatal("expected the default bridge list")
+	}
+	server.Set("bridges", multiList)
+	if _, err := l.GetBridgeInfo(fingerprint); err == nil {
+		t.Fatal("expected the list not to be read again before the backoff")
+	}
+	now = now.Add(bridgeListBackoff)
+	if _, err := l.GetBridgeInfo(fingerprint); err != nil {
+		t.Fatalf("expected the list to be read again: %v", err)
+	}
+
+	// It is tried a bounded number of times.
+	server.Del("bridges")
+	l = LoadBridgeList(context.Background(), client).(*retryingBridgeList)
+	l.now = func() time.Time { return now }
+	for i := 0; i < bridgeListRetries; i++ {
+		now = now.Add(time.Hour)
+		l.AllBridgeInfo()
+	}
+	server.Set("bridges", multiList)
+	now = now.Add(time.Hour)
+	if _, err := l.GetBridgeInfo(fingerprint); err == nil {
+		t.Error("expected the list to be given up on")
+	}
+}
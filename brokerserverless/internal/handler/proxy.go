@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgefingerprint"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgelist"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/matchstore"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/ratelimit"
+)
+
+// Proxy decodes the request and returns the APIGateway response.
+func (h *Handler) Proxy(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	log.Print("Received proxy poll request inside proxyHandler")
+
+	arg, err := h.decodeRequest(request, "")
+	if err != nil {
+		return invalidRequestResponse(err), nil
+	}
+	if !h.allowRequest(ctx, ratelimit.EndpointProxy, arg.RemoteAddr) {
+		return errorResponse(messages.ErrRateLimited), nil
+	}
+	log.Printf("Body in proxy handler: %s", arg.Body)
+
+	var response []byte
+	err = h.handleProxyPolls(ctx, arg, false, &response)
+	if err != nil {
+		return errorResponse(err), nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       string(response),
+	}, nil
+}
+
+// handleProxyPolls handles the proxy poll request and returns the response.
+// Unless keepWaiting is set, proxies that can fetch their offer later are
+// registered and answered right away.
+func (h *Handler) handleProxyPolls(ctx context.Context, arg messages.Arg, keepWaiting bool, response *[]byte) error {
+	sid, proxyType, natType, clients, relayPattern, relayPatternSupported, err := messages.DecodeProxyPollRequestWithRelayPrefix(arg.Body)
+	if err != nil {
+		return messages.ErrBadRequest
+	}
+	log.Printf("Received proxy poll request: sid=%s, proxyType=%s, natType=%s, clients=%d, relayPattern=%s, relayPatternSupported=%t", sid, proxyType, natType, clients, relayPattern, relayPatternSupported)
+
+	registration, token, err := messages.DecodeProxyPollToken(arg.Body)
+	if err != nil {
+		return messages.ErrBadRequest
+	}
+	// A proxy fetching the offer it registered for is still on the same
+	// poll, which was counted when it registered.
+	newPoll := token == ""
+	if newPoll {
+		h.Metrics.ProxyPolled(ctx, natType, proxyType, relayPatternSupported)
+	}
+
+	relayPattern = h.ProxyRelayPattern(relayPattern, !relayPatternSupported)
+	if !h.CheckProxyRelayPattern(relayPattern) {
+		if newPoll {
+			h.Metrics.ProxyRejected(ctx, natType, proxyType)
+		}
+		log.Printf("bad request: rejected relay pattern from proxy = %v", messages.ErrBadRequest)
+		b, err := messages.EncodePollResponseWithRelayURL("", false, "", "", "incorrect relay pattern")
+		*response = b
+		if err != nil {
+			return messages.ErrInternal
+		}
+		return nil
+	}
+
+	if newPoll {
+		h.Metrics.UpdateCountryStats(ctx, arg.RemoteAddr, proxyType, natType)
+	}
+
+	proxy := &matchstore.Proxy{
+		ID:           sid,
+		ProxyType:    proxyType,
+		NATType:      natType,
+		Clients:      clients,
+		RelayPattern: relayPattern,
+	}
+
+	// Proxies that can fetch their offer later are not kept waiting, so
+	// that the function is not billed for the time it waits for a client.
+	var offer *matchstore.Offer
+	store, nonBlocking := h.Store.(matchstore.NonBlockingStore)
+	nonBlocking = nonBlocking && !keepWaiting
+	switch {
+	case nonBlocking && token != "":
+		offer, err = store.FetchOffer(ctx, sid, token)
+		if errors.Is(err, matchstore.ErrProxyGone) {
+			log.Printf("Registration of proxy %s expired.", sid)
+			offer, err = nil, nil
+		} else if err != nil {
+			return fmt.Errorf("error fetching client offer: %v", err)
+		} else if offer == nil {
+			return sendRegisteredResponse(token, response)
+		}
+	case nonBlocking && registration:
+		token, err := store.AddProxy(ctx, proxy)
+		if errors.Is(err, matchstore.ErrProxyBusy) {
+			log.Printf("Proxy %s polled again while registered", sid)
+			return messages.ErrBadRequest
+		} else if err != nil {
+			return fmt.Errorf("error registering proxy: %v", err)
+		}
+		log.Printf("Registered proxy %s", sid)
+		return sendRegisteredResponse(token, response)
+	default:
+		offer, err = h.Store.RegisterProxy(ctx, proxy)
+		if errors.Is(err, matchstore.ErrProxyBusy) {
+			log.Printf("Proxy %s polled again while registered", sid)
+			return messages.ErrBadRequest
+		} else if err != nil {
+			return fmt.Errorf("error waiting for client match: %v", err)
+		}
+	}
+
+	var b []byte
+
+	if offer == nil {
+		log.Printf("No client offer found for proxy %s.", sid)
+		h.Metrics.ProxyMatched(ctx, natType, false)
+
+		b, err := messages.EncodePollResponse("", false, "")
+		if err != nil {
+			return fmt.Errorf("failed to encode poll response: %v", err)
+		}
+		*response = b
+		return nil
+	}
+
+	log.Printf("Matched a client with proxy %s", sid)
+	h.Metrics.ProxyMatched(ctx, natType, true)
+
+	bridgeFingerprint, err := bridgefingerprint.FingerprintFromBytes(offer.Fingerprint)
+	if err != nil {
+		return messages.ErrBadRequest
+	}
+	info, err := h.BridgeList.GetBridgeInfo(bridgeFingerprint)
+	if err != nil {
+		return fmt.Errorf("error looking up bridge of client offer: %v", err)
+	}
+	relayURL := info.PickAcceptedRelay("", func(relayURL string) bool {
+		return matchstore.AcceptsRelay(relayPattern, []string{bridgelist.RelayHost(relayURL)})
+	})
+
+	b, err = messages.EncodePollResponseWithRelayURL(string(offer.SDP), true, offer.NATType, relayURL, "")
+	if err != nil {
+		return messages.ErrInternal
+	}
+	*response = b
+	return nil
+}
+
+// sendRegisteredResponse tells the proxy to fetch its offer later with token.
+func sendRegisteredResponse(token string, response *[]byte) error {
+	b, err := messages.EncodePollResponseWithToken(token)
+	if err != nil {
+		return fmt.Errorf("failed to encode poll response: %v", err)
+	}
+	*response = b
+	return nil
+}
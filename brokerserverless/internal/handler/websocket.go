@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/ratelimit"
+)
+
+// WebSocket handles the messages of proxies connected to the API Gateway
+// WebSocket API. Proxies send their polls and answers as signaling messages,
+// and the response to each is sent back over the same connection. Polls are
+// held until a client is matched, so the offer reaches the proxy right away.
+func (h *Handler) WebSocket(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	switch request.RequestContext.RouteKey {
+	case "$connect", "$disconnect":
+		log.Printf("Proxy WebSocket %s: %s", request.RequestContext.RouteKey, request.RequestContext.ConnectionID)
+		return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+	}
+
+	var response []byte
+	kind, body, err := messages.DecodeProxySignalingMessage([]byte(request.Body))
+	if err != nil {
+		log.Printf("Invalid signaling message: %v", err)
+		err = messages.ErrBadRequest
+	} else {
+		arg := messages.Arg{
+			Body:       body,
+			RemoteAddr: h.clientIP(request.Headers, request.MultiValueHeaders, request.RequestContext.Identity.SourceIP),
+		}
+		switch kind {
+		case messages.ProxySignalingPoll:
+			if !h.allowRequest(ctx, ratelimit.EndpointProxy, arg.RemoteAddr) {
+				err = messages.ErrRateLimited
+			} else {
+				err = h.handleProxyPolls(ctx, arg, true, &response)
+			}
+		case messages.ProxySignalingAnswer:
+			if !h.allowRequest(ctx, ratelimit.EndpointAnswer, arg.RemoteAddr) {
+				err = messages.ErrRateLimited
+			} else if err = validateSDP(body); err != nil {
+				log.Println("Error proxy SDP: ", err.Error())
+				err = messages.ErrBadRequest
+			} else {
+				err = h.handleProxyAnswers(ctx, arg, &response)
+			}
+		}
+	}
+	if err != nil && !errors.Is(err, messages.ErrBadRequest) && !errors.Is(err, messages.ErrRateLimited) {
+		log.Printf("Error processing proxy %s: %v", kind, err)
+		err = messages.ErrInternal
+	}
+
+	reply, err := messages.EncodeProxySignalingMessage(kind, response, err)
+	if err != nil {
+		log.Printf("Error encoding signaling message: %v", err)
+		return events.APIGatewayProxyResponse{StatusCode: 500}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       string(reply),
+	}, nil
+}
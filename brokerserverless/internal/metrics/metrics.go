@@ -0,0 +1,295 @@
+/*
+Package metrics records the broker's metrics for the serverless broker.
+
+The Lambdas keep the counters of broker/metrics.go in Redis, so that they add
+up across invocations: unique proxy IPs in HyperLogLogs, and per-country and
+per-rendezvous-method counts in hashes. The counts of the current period are
+rendered in the broker-spec format by WriteSpec and reset by Rotate, as the
+broker does once a day; the Prometheus counters are never reset, and are
+rendered by WritePrometheus with the names and labels of the broker's
+/prometheus endpoint.
+
+All keys share the {metrics} hash tag, so that the commands touching several of
+them also work when the functions use a Redis cluster (REDIS_CLUSTER).
+*/
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gitlab.torproject.org/tpo/anti-censorship/geoip"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
+)
+
+const (
+	NATUnknown      = "unknown"
+	NATRestricted   = "restricted"
+	NATUnrestricted = "unrestricted"
+)
+
+// Resolution is how often the counts of a period are logged and reset.
+const Resolution = 24 * time.Hour
+
+var rendezvousMethodList = [...]messages.RendezvousMethod{
+	messages.RendezvousHttp,
+	messages.RendezvousAmpCache,
+	messages.RendezvousSqs,
+}
+
+// Keys of the counts of the current period
+const (
+	periodStartKey = "{metrics}:period-start"
+	countriesKey   = "{metrics}:countries"
+	countsKey      = "{metrics}:counts"
+)
+
+func proxyIPsKey(proxyType string) string {
+	return "{metrics}:proxy-ips:" + proxyType
+}
+
+func natIPsKey(natType string) string {
+	return "{metrics}:proxy-ips-nat:" + natType
+}
+
+func clientCountriesKey(method messages.RendezvousMethod) string {
+	return "{metrics}:client-countries:" + string(method)
+}
+
+// Fields of countsKey
+const (
+	idleCountField                = "idle"
+	pollWithRelayURLField         = "poll-with-relay-url"
+	pollWithoutRelayURLField      = "poll-without-relay-url"
+	pollRejectedForRelayURLField  = "poll-rejected-for-relay-url"
+	clientDeniedField             = "client-denied:"
+	clientRestrictedDeniedField   = "client-restricted-denied:"
+	clientUnrestrictedDeniedField = "client-unrestricted-denied:"
+	clientMatchField              = "client-match:"
+)
+
+// prometheusKey is the hash of a Prometheus counter, with a field for each
+// combination of label values.
+func prometheusKey(name string) string {
+	return "{metrics}:prometheus:" + name
+}
+
+// Metrics records the broker's metrics in Redis. Errors are logged rather
+// than returned, so that a request never fails because of its metrics, and a
+// nil *Metrics records nothing.
+type Metrics struct {
+	client  redis.UniversalClient
+	geoipdb *geoip.Geoip
+}
+
+func NewMetrics(client redis.UniversalClient) *Metrics {
+	return &Metrics{client: client}
+}
+
+// NewMetricsFromEnv returns Metrics for client, with the geoip databases
+// given by the GEOIP_PATH and GEOIP6_PATH environment variables, like the
+// broker's -geoipdb and -geoip6db flags. Without them, proxy countries are not
+// counted and all clients are from "??".
+func NewMetricsFromEnv(client redis.UniversalClient) (*Metrics, error) {
+	m := NewMetrics(client)
+	geoipDB, geoip6DB := os.Getenv("GEOIP_PATH"), os.Getenv("GEOIP6_PATH")
+	if geoipDB == "" && geoip6DB == "" {
+		return m, nil
+	}
+	if err := m.LoadGeoipDatabases(geoipDB, geoip6DB); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Metrics) LoadGeoipDatabases(geoipDB string, geoip6DB string) error {
+	var err error
+	log.Println("Loading geoip databases")
+	m.geoipdb, err = geoip.New(geoipDB, geoip6DB)
+	return err
+}
+
+func (m *Metrics) country(addr string) string {
+	if m.geoipdb != nil {
+		if country, ok := m.geoipdb.GetCountryByAddr(net.ParseIP(addr)); ok {
+			return country
+		}
+	}
+	return "??"
+}
+
+// labels encodes the values of the labels of a Prometheus counter as a field
+// of its hash.
+func labels(values ...string) string {
+	b, _ := json.Marshal(values)
+	return string(b)
+}
+
+// ProxyPolled counts a poll of a proxy, before its relay pattern is checked.
+func (m *Metrics) ProxyPolled(ctx context.Context, natType, proxyType string, relayPatternSupported bool) {
+	if m == nil {
+		return
+	}
+	field, name := pollWithoutRelayURLField, "rounded_proxy_poll_without_relay_url_extension_total"
+	if relayPatternSupported {
+		field, name = pollWithRelayURLField, "rounded_proxy_poll_with_relay_url_extension_total"
+	}
+	_, err := m.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, countsKey, field, 1)
+		pipe.HIncrBy(ctx, prometheusKey(name), labels(natType, proxyType), 1)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error counting proxy poll: %v", err)
+	}
+}
+
+// ProxyRejected counts a poll rejected for its relay pattern.
+func (m *Metrics) ProxyRejected(ctx context.Context, natType, proxyType string) {
+	if m == nil {
+		return
+	}
+	_, err := m.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, countsKey, pollRejectedForRelayURLField, 1)
+		pipe.HIncrBy(ctx, prometheusKey("rounded_proxy_poll_rejected_relay_url_extension_total"), labels(natType, proxyType), 1)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error counting rejected proxy poll: %v", err)
+	}
+}
+
+// ProxyMatched counts a poll that ended, with or without a client.
+func (m *Metrics) ProxyMatched(ctx context.Context, natType string, matched bool) {
+	if m == nil {
+		return
+	}
+	status := "idle"
+	if matched {
+		status = "matched"
+	}
+	_, err := m.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if !matched {
+			pipe.HIncrBy(ctx, countsKey, idleCountField, 1)
+		}
+		pipe.HIncrBy(ctx, prometheusKey("rounded_proxy_poll_total"), labels(natType, status), 1)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error counting proxy poll: %v", err)
+	}
+}
+
+// UpdateCountryStats counts the address of a proxy, once per period. Like
+// the broker, it only counts countries and NAT types with a geoip database.
+func (m *Metrics) UpdateCountryStats(ctx context.Context, addr string, proxyType string, natType string) {
+	if m == nil {
+		return
+	}
+	if !messages.KnownProxyTypes[proxyType] {
+		proxyType = messages.ProxyUnknown
+	}
+	added, err := m.client.PFAdd(ctx, proxyIPsKey(proxyType), addr).Result()
+	if err != nil {
+		log.Printf("Error counting proxy address: %v", err)
+		return
+	}
+	if added == 0 || m.geoipdb == nil {
+		return
+	}
+	country := m.country(addr)
+
+	switch natType {
+	case NATRestricted, NATUnrestricted:
+	default:
+		natType = NATUnknown
+	}
+	_, err = m.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, countriesKey, country, 1)
+		pipe.PFAdd(ctx, natIPsKey(natType), addr)
+		pipe.HIncrBy(ctx, prometheusKey("proxy_total"), labels(proxyType, natType, country), 1)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error counting proxy country: %v", err)
+	}
+}
+
+// UpdateRendezvousStats counts a client offer that was answered, or denied
+// for lack of proxies.
+func (m *Metrics) UpdateRendezvousStats(ctx context.Context, addr string, rendezvousMethod messages.RendezvousMethod, natType string, matched bool) {
+	if m == nil {
+		return
+	}
+	country := m.country(addr)
+	method := string(rendezvousMethod)
+	_, err := m.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		status := "matched"
+		if !matched {
+			status = "denied"
+			pipe.HIncrBy(ctx, countsKey, clientDeniedField+method, 1)
+			if natType == NATUnrestricted {
+				pipe.HIncrBy(ctx, countsKey, clientUnrestrictedDeniedField+method, 1)
+			} else {
+				pipe.HIncrBy(ctx, countsKey, clientRestrictedDeniedField+method, 1)
+			}
+		} else {
+			pipe.HIncrBy(ctx, countsKey, clientMatchField+method, 1)
+		}
+		pipe.HIncrBy(ctx, clientCountriesKey(rendezvousMethod), country, 1)
+		pipe.HIncrBy(ctx, prometheusKey("rounded_client_poll_total"), labels(natType, status, country, method), 1)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error counting client poll: %v", err)
+	}
+}
+
+// RateLimited counts a request refused for exceeding the rate limit of its
+// endpoint.
+func (m *Metrics) RateLimited(ctx context.Context, endpoint string) {
+	if m == nil {
+		return
+	}
+	err := m.client.HIncrBy(ctx, prometheusKey("rate_limited_total"), labels(endpoint), 1).Err()
+	if err != nil {
+		log.Printf("Error counting rate-limited request: %v", err)
+	}
+}
+
+// periodKeys are the keys of the counts of the current period.
+func periodKeys() []string {
+	keys := []string{countriesKey, countsKey, proxyIPsKey(messages.ProxyUnknown)}
+	for proxyType := range messages.KnownProxyTypes {
+		keys = append(keys, proxyIPsKey(proxyType))
+	}
+	for _, natType := range []string{NATRestricted, NATUnrestricted, NATUnknown} {
+		keys = append(keys, natIPsKey(natType))
+	}
+	for _, method := range rendezvousMethodList {
+		keys = append(keys, clientCountriesKey(method))
+	}
+	return keys
+}
+
+// Rotate resets the counts of the period, and starts the next one at now.
+// The Prometheus counters are kept.
+func (m *Metrics) Rotate(ctx context.Context, now time.Time) error {
+	_, err := m.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		rotate(ctx, pipe, now)
+		return nil
+	})
+	return err
+}
+
+func rotate(ctx context.Context, pipe redis.Pipeliner, now time.Time) {
+	pipe.Del(ctx, periodKeys()...)
+	pipe.Set(ctx, periodStartKey, strconv.FormatInt(now.Unix(), 10), 0)
+}
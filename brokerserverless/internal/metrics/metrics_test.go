@@ -0,0 +1,189 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
+)
+
+func newTestMetrics(t *testing.T) *Metrics {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	m := NewMetrics(client)
+	if err := m.LoadGeoipDatabases("../../../broker/test_geoip", "../../../broker/test_geoip6"); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func specLines(t *testing.T, s *Snapshot, end time.Time) map[string]string {
+	var buf bytes.Buffer
+	if err := s.WriteSpec(&buf, end); err != nil {
+		t.Fatal(err)
+	}
+	lines := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		lines[key] = value
+	}
+	return lines
+}
+
+func TestMetricsSpec(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMetrics(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := m.Rotate(ctx, start); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each address is counted once, however often it polls.
+	for i := 0; i < 3; i++ {
+		m.ProxyPolled(ctx, NATRestricted, "standalone", true)
+		m.UpdateCountryStats(ctx, "129.97.208.23", "standalone", NATRestricted)
+	}
+	m.ProxyPolled(ctx, NATUnrestricted, "webext", false)
+	m.UpdateCountryStats(ctx, "2001:200::1", "webext", NATUnrestricted)
+	m.ProxyPolled(ctx, NATUnknown, "something-else", false)
+	m.ProxyRejected(ctx, NATUnknown, "something-else")
+	m.UpdateCountryStats(ctx, "192.0.2.1", "something-else", NATUnknown)
+	m.ProxyMatched(ctx, NATRestricted, false)
+	m.ProxyMatched(ctx, NATRestricted, true)
+
+	m.UpdateRendezvousStats(ctx, "129.97.208.23", messages.RendezvousHttp, NATUnrestricted, true)
+	m.UpdateRendezvousStats(ctx, "129.97.208.23", messages.RendezvousHttp, NATRestricted, false)
+	m.UpdateRendezvousStats(ctx, "192.0.2.1", messages.RendezvousAmpCache, NATUnrestricted, false)
+
+	s, err := m.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := specLines(t, s, start.Add(Resolution))
+	for key, expected := range map[string]string{
+		"snowflake-stats-end":                          "2024-01-02 00:00:00 (86400 s)",
+		"snowflake-ips":                                "??=1,CA=1,JP=1",
+		"snowflake-ips-standalone":                     "1",
+		"snowflake-ips-webext":                         "1",
+		"snowflake-ips-badge":                          "0",
+		"snowflake-ips-total":                          "3",
+		"snowflake-idle-count":                         "8",
+		"snowflake-proxy-poll-with-relay-url-count":    "8",
+		"snowflake-proxy-poll-without-relay-url-count": "8",
+		"snowflake-proxy-rejected-for-relay-url-count": "8",
+		"client-denied-count":                          "8",
+		"client-restricted-denied-count":               "8",
+		"client-unrestricted-denied-count":             "8",
+		"client-snowflake-match-count":                 "8",
+		"client-http-count":                            "8",
+		"client-http-ips":                              "CA=8",
+		"client-ampcache-count":                        "8",
+		"client-ampcache-ips":                          "??=8",
+		"client-sqs-count":                             "0",
+		"client-sqs-ips":                               "",
+		"snowflake-ips-nat-restricted":                 "1",
+		"snowflake-ips-nat-unrestricted":               "1",
+		"snowflake-ips-nat-unknown":                    "1",
+	} {
+		if lines[key] != expected {
+			t.Errorf("%s: expected %q, got %q", key, expected, lines[key])
+		}
+	}
+
+	// Rotating resets the counts of the period, but not the Prometheus
+	// counters.
+	if err := m.Rotate(ctx, start.Add(Resolution)); err != nil {
+		t.Fatal(err)
+	}
+	s, err = m.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines = specLines(t, s, start.Add(Resolution+time.Hour))
+	for key, expected := range map[string]string{
+		"snowflake-stats-end":  "2024-01-02 01:00:00 (3600 s)",
+		"snowflake-ips":        "",
+		"snowflake-ips-total":  "0",
+		"snowflake-idle-count": "0",
+		"client-denied-count":  "0",
+	} {
+		if lines[key] != expected {
+			t.Errorf("after rotation, %s: expected %q, got %q", key, expected, lines[key])
+		}
+	}
+	if len(s.prometheus["rounded_client_poll_total"]) == 0 {
+		t.Error("Prometheus counters were reset by rotation")
+	}
+}
+
+func TestMetricsPrometheus(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMetrics(t)
+
+	m.UpdateCountryStats(ctx, "129.97.208.23", "standalone", NATRestricted)
+	for i := 0; i < 9; i++ {
+		m.ProxyMatched(ctx, NATRestricted, false)
+	}
+	m.UpdateRendezvousStats(ctx, "129.97.208.23", messages.RendezvousSqs, NATUnrestricted, true)
+	m.RateLimited(ctx, "client")
+
+	s, err := m.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := s.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	output := buf.String()
+	for _, expected := range []string{
+		`snowflake_proxy_total{cc="CA",nat="restricted",type="standalone"} 1`,
+		`snowflake_rounded_proxy_poll_total{nat="restricted",status="idle"} 16`,
+		`snowflake_rounded_client_poll_total{cc="CA",nat="unrestricted",rendezvous_method="sqs",status="matched"} 8`,
+		`snowflake_rate_limited_total{endpoint="client"} 1`,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("expected %q in:\n%s", expected, output)
+		}
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	m.ProxyPolled(context.Background(), NATRestricted, "standalone", true)
+	m.UpdateRendezvousStats(context.Background(), "192.0.2.1", messages.RendezvousHttp, NATRestricted, true)
+}
+
+func TestSnapshotAndRotate(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMetrics(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := m.Rotate(ctx, start); err != nil {
+		t.Fatal(err)
+	}
+	m.UpdateCountryStats(ctx, "129.97.208.23", "standalone", NATRestricted)
+
+	// The counts are read and reset together.
+	s, err := m.SnapshotAndRotate(ctx, start.Add(Resolution))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := specLines(t, s, start.Add(Resolution)); lines["snowflake-ips"] != "CA=1" {
+		t.Errorf("expected the counts of the period, got %q", lines["snowflake-ips"])
+	}
+	s, err = m.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Start.Equal(start.Add(Resolution)) || s.Countries["CA"] != 0 {
+		t.Errorf("expected a new period, got %v, %v", s.Start, s.Countries)
+	}
+}
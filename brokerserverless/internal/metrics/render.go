@@ -0,0 +1,302 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
+)
+
+const prometheusNamespace = "snowflake"
+
+// counter is a Prometheus counter of the broker's /prometheus endpoint.
+type counter struct {
+	name    string
+	help    string
+	labels  []string
+	rounded bool
+}
+
+var counters = []counter{
+	{"proxy_total", "The number of unique snowflake IPs",
+		[]string{"type", "nat", "cc"}, false},
+	{"rounded_proxy_poll_total", "The number of snowflake proxy polls, rounded up to a multiple of 8",
+		[]string{"nat", "status"}, true},
+	{"rounded_proxy_poll_with_relay_url_extension_total", "The number of snowflake proxy polls with Relay URL Extension, rounded up to a multiple of 8",
+		[]string{"nat", "type"}, true},
+	{"rounded_proxy_poll_without_relay_url_extension_total", "The number of snowflake proxy polls without Relay URL Extension, rounded up to a multiple of 8",
+		[]string{"nat", "type"}, true},
+	{"rounded_proxy_poll_rejected_relay_url_extension_total", "The number of snowflake proxy polls rejected by Relay URL Extension, rounded up to a multiple of 8",
+		[]string{"nat", "type"}, true},
+	{"rounded_client_poll_total", "The number of snowflake client polls, rounded up to a multiple of 8",
+		[]string{"nat", "status", "cc", "rendezvous_method"}, true},
+	{"rate_limited_total", "The number of requests refused for exceeding the rate limit of their endpoint",
+		[]string{"endpoint"}, false},
+}
+
+// Snapshot holds the metrics read from Redis at one time.
+type Snapshot struct {
+	// Start is when the current period started, or zero if it is not known.
+	Start time.Time
+	// ProxyIPs is the number of unique proxy IPs of each proxy type,
+	// including unknown.
+	ProxyIPs map[string]uint64
+	// NATIPs is the number of unique proxy IPs of each NAT type.
+	NATIPs map[string]uint64
+	// Countries is the number of unique proxy IPs in each country.
+	Countries map[string]uint64
+	// ClientCountries is the number of client polls from each country, for
+	// each rendezvous method.
+	ClientCountries map[messages.RendezvousMethod]map[string]uint64
+
+	counts map[string]uint64
+	// prometheus maps the encoded label values of each counter to its value.
+	prometheus map[string]map[string]uint64
+}
+
+func parseCounts(hash map[string]string) map[string]uint64 {
+	counts := make(map[string]uint64, len(hash))
+	for field, value := range hash {
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		counts[field] = n
+	}
+	return counts
+}
+
+// Snapshot reads the metrics from Redis.
+func (m *Metrics) Snapshot(ctx context.Context) (*Snapshot, error) {
+	return m.snapshot(ctx, m.client.Pipelined, nil)
+}
+
+// SnapshotAndRotate reads the metrics from Redis and starts the next period
+// at now, as Rotate does, in a single transaction, so that the counts
+// recorded in the meantime are not lost.
+func (m *Metrics) SnapshotAndRotate(ctx context.Context, now time.Time) (*Snapshot, error) {
+	return m.snapshot(ctx, m.client.TxPipelined, func(pipe redis.Pipeliner) {
+		rotate(ctx, pipe, now)
+	})
+}
+
+// snapshot reads the metrics through the pipeline run by pipelined, followed
+// by the commands queued by then, if not nil.
+func (m *Metrics) snapshot(ctx context.Context, pipelined func(context.Context, func(redis.Pipeliner) error) ([]redis.Cmder, error), then func(redis.Pipeliner)) (*Snapshot, error) {
+	proxyTypes := []string{messages.ProxyUnknown}
+	for proxyType := range messages.KnownProxyTypes {
+		proxyTypes = append(proxyTypes, proxyType)
+	}
+	natTypes := []string{NATRestricted, NATUnrestricted, NATUnknown}
+
+	var start *redis.StringCmd
+	var countries, counts *redis.StringStringMapCmd
+	proxyIPs := make(map[string]*redis.IntCmd)
+	natIPs := make(map[string]*redis.IntCmd)
+	clientCountries := make(map[messages.RendezvousMethod]*redis.StringStringMapCmd)
+	prom := make(map[string]*redis.StringStringMapCmd)
+	_, err := pipelined(ctx, func(pipe redis.Pipeliner) error {
+		start = pipe.Get(ctx, periodStartKey)
+		countries = pipe.HGetAll(ctx, countriesKey)
+		counts = pipe.HGetAll(ctx, countsKey)
+		for _, proxyType := range proxyTypes {
+			proxyIPs[proxyType] = pipe.PFCount(ctx, proxyIPsKey(proxyType))
+		}
+		for _, natType := range natTypes {
+			natIPs[natType] = pipe.PFCount(ctx, natIPsKey(natType))
+		}
+		for _, method := range rendezvousMethodList {
+			clientCountries[method] = pipe.HGetAll(ctx, clientCountriesKey(method))
+		}
+		for _, c := range counters {
+			prom[c.name] = pipe.HGetAll(ctx, prometheusKey(c.name))
+		}
+		if then != nil {
+			then(pipe)
+		}
+		return nil
+	})
+	// A period that was never started is not an error.
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	s := &Snapshot{
+		ProxyIPs:        make(map[string]uint64),
+		NATIPs:          make(map[string]uint64),
+		Countries:       parseCounts(countries.Val()),
+		ClientCountries: make(map[messages.RendezvousMethod]map[string]uint64),
+		counts:          parseCounts(counts.Val()),
+		prometheus:      make(map[string]map[string]uint64),
+	}
+	if seconds, err := strconv.ParseInt(start.Val(), 10, 64); err == nil {
+		s.Start = time.Unix(seconds, 0)
+	}
+	for proxyType, cmd := range proxyIPs {
+		s.ProxyIPs[proxyType] = uint64(cmd.Val())
+	}
+	for natType, cmd := range natIPs {
+		s.NATIPs[natType] = uint64(cmd.Val())
+	}
+	for method, cmd := range clientCountries {
+		s.ClientCountries[method] = parseCounts(cmd.Val())
+	}
+	for name, cmd := range prom {
+		s.prometheus[name] = parseCounts(cmd.Val())
+	}
+	return s, nil
+}
+
+// Rounds up a count to the nearest multiple of 8.
+func binCount(count uint64) uint64 {
+	return uint64((math.Ceil(float64(count) / 8)) * 8)
+}
+
+// displayCountries formats counts by country, largest first, like
+// CountryStats.Display in the broker.
+func displayCountries(counts map[string]uint64, binned bool) string {
+	ccs := make([]string, 0, len(counts))
+	for cc := range counts {
+		ccs = append(ccs, cc)
+	}
+	sort.Slice(ccs, func(i, j int) bool {
+		if counts[ccs[i]] == counts[ccs[j]] {
+			return ccs[i] < ccs[j]
+		}
+		return counts[ccs[i]] > counts[ccs[j]]
+	})
+	output := ""
+	for _, cc := range ccs {
+		count := counts[cc]
+		if binned {
+			count = binCount(count)
+		}
+		if output != "" {
+			output += ","
+		}
+		output += fmt.Sprintf("%s=%d", cc, count)
+	}
+	return output
+}
+
+func (s *Snapshot) sumCounts(prefix string) uint64 {
+	var sum uint64
+	for _, method := range rendezvousMethodList {
+		sum += s.counts[prefix+string(method)]
+	}
+	return sum
+}
+
+// WriteSpec writes the counts of the period ending at end in the format of
+// the broker's metrics log, as specified in the broker spec.
+func (s *Snapshot) WriteSpec(w io.Writer, end time.Time) error {
+	period := Resolution
+	if !s.Start.IsZero() {
+		period = end.Sub(s.Start).Round(time.Second)
+	}
+
+	proxyTypes := make([]string, 0, len(messages.KnownProxyTypes))
+	for proxyType := range messages.KnownProxyTypes {
+		proxyTypes = append(proxyTypes, proxyType)
+	}
+	sort.Strings(proxyTypes)
+
+	lines := []string{
+		fmt.Sprintf("snowflake-stats-end %s (%d s)", end.UTC().Format("2006-01-02 15:04:05"), int(period.Seconds())),
+		fmt.Sprintf("snowflake-ips %s", displayCountries(s.Countries, false)),
+	}
+	total := s.ProxyIPs[messages.ProxyUnknown]
+	for _, proxyType := range proxyTypes {
+		lines = append(lines, fmt.Sprintf("snowflake-ips-%s %d", proxyType, s.ProxyIPs[proxyType]))
+		total += s.ProxyIPs[proxyType]
+	}
+	lines = append(lines,
+		fmt.Sprintf("snowflake-ips-total %d", total),
+		fmt.Sprintf("snowflake-idle-count %d", binCount(s.counts[idleCountField])),
+		fmt.Sprintf("snowflake-proxy-poll-with-relay-url-count %d", binCount(s.counts[pollWithRelayURLField])),
+		fmt.Sprintf("snowflake-proxy-poll-without-relay-url-count %d", binCount(s.counts[pollWithoutRelayURLField])),
+		fmt.Sprintf("snowflake-proxy-rejected-for-relay-url-count %d", binCount(s.counts[pollRejectedForRelayURLField])),
+		fmt.Sprintf("client-denied-count %d", binCount(s.sumCounts(clientDeniedField))),
+		fmt.Sprintf("client-restricted-denied-count %d", binCount(s.sumCounts(clientRestrictedDeniedField))),
+		fmt.Sprintf("client-unrestricted-denied-count %d", binCount(s.sumCounts(clientUnrestrictedDeniedField))),
+		fmt.Sprintf("client-snowflake-match-count %d", binCount(s.sumCounts(clientMatchField))),
+	)
+	for _, method := range rendezvousMethodList {
+		count := s.counts[clientDeniedField+string(method)] + s.counts[clientMatchField+string(method)]
+		lines = append(lines,
+			fmt.Sprintf("client-%s-count %d", method, binCount(count)),
+			fmt.Sprintf("client-%s-ips %s", method, displayCountries(s.ClientCountries[method], true)),
+		)
+	}
+	lines = append(lines,
+		fmt.Sprintf("snowflake-ips-nat-restricted %d", s.NATIPs[NATRestricted]),
+		fmt.Sprintf("snowflake-ips-nat-unrestricted %d", s.NATIPs[NATUnrestricted]),
+		fmt.Sprintf("snowflake-ips-nat-unknown %d", s.NATIPs[NATUnknown]),
+	)
+
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c counter) desc() *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", c.name), c.help, c.labels, nil)
+}
+
+// Describe and Collect make a Snapshot a prometheus.Collector of its
+// counters.
+func (s *Snapshot) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range counters {
+		ch <- c.desc()
+	}
+}
+
+func (s *Snapshot) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range counters {
+		desc := c.desc()
+		for field, value := range s.prometheus[c.name] {
+			var labelValues []string
+			if err := json.Unmarshal([]byte(field), &labelValues); err != nil || len(labelValues) != len(c.labels) {
+				continue
+			}
+			if c.rounded {
+				value = binCount(value)
+			}
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), labelValues...)
+		}
+	}
+}
+
+// WritePrometheus writes the counters in the Prometheus text format, as the
+// broker's /prometheus endpoint does.
+func (s *Snapshot) WritePrometheus(w io.Writer) error {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(s); err != nil {
+		return err
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	encoder := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
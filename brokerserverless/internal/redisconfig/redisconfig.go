@@ -0,0 +1,240 @@
+/*
+Package redisconfig configures the Redis client of the serverless broker from
+the environment of the Lambda functions.
+
+The client can talk to a single server, a cluster or the master of a set of
+sentinels, with an auth token and over TLS, as with an encrypted ElastiCache.
+Connections are made lazily and remade as commands need them, so a function
+started during a Redis outage does not crash but serves requests again once
+Redis is back.
+
+The environment variables are:
+
+	REDIS_ADDRESS          comma-separated host:port addresses of the server,
+	                       of cluster nodes or of sentinels
+	REDIS_CLUSTER          "true" to use cluster mode, even with a single
+	                       (configuration endpoint) address
+	REDIS_SENTINEL_MASTER  name of the master, to go through sentinels
+	REDIS_USERNAME         ACL user name
+	REDIS_AUTH_TOKEN       password or ElastiCache auth token
+	REDIS_DB               database number, for a single server or sentinels
+	REDIS_TLS              "true" to connect over TLS
+	REDIS_TLS_CA_FILE      PEM bundle of the CAs to trust, instead of the
+	                       system's; implies REDIS_TLS
+	REDIS_TLS_SERVER_NAME  name to verify the server certificate against
+	REDIS_POOL_SIZE        maximum number of connections per node
+	REDIS_MIN_IDLE_CONNS   connections per node to keep open between requests
+	REDIS_MAX_RETRIES      retries of a failed command, -1 for none
+	REDIS_DIAL_TIMEOUT     timeout of a connection attempt, such as "2s"
+	REDIS_CONNECT_RETRIES  retries of the connection check at cold start
+*/
+package redisconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// DefaultConnectRetries is how many times Connect retries by default.
+const DefaultConnectRetries = 3
+
+// connectBackoff is how long Connect waits before its first retry. The wait
+// doubles with each retry.
+const connectBackoff = 100 * time.Millisecond
+
+// Config is the configuration of a Redis client.
+type Config struct {
+	Addrs      []string
+	Cluster    bool
+	MasterName string
+
+	Username string
+	Password string
+	DB       int
+
+	TLS           bool
+	TLSCAFile     string
+	TLSServerName string
+
+	// Zero values leave the go-redis defaults.
+	PoolSize     int
+	MinIdleConns int
+	MaxRetries   int
+	DialTimeout  time.Duration
+
+	ConnectRetries int
+}
+
+func envInt(name string, value *int) error {
+	s := os.Getenv(name)
+	if s == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", name, err)
+	}
+	*value = n
+	return nil
+}
+
+func envBool(name string, value *bool) error {
+	s := os.Getenv(name)
+	if s == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", name, err)
+	}
+	*value = b
+	return nil
+}
+
+// FromEnv reads a Config from the environment variables.
+func FromEnv() (*Config, error) {
+	c := &Config{
+		MasterName:     os.Getenv("REDIS_SENTINEL_MASTER"),
+		Username:       os.Getenv("REDIS_USERNAME"),
+		Password:       os.Getenv("REDIS_AUTH_TOKEN"),
+		TLSCAFile:      os.Getenv("REDIS_TLS_CA_FILE"),
+		TLSServerName:  os.Getenv("REDIS_TLS_SERVER_NAME"),
+		ConnectRetries: DefaultConnectRetries,
+	}
+	for _, addr := range strings.Split(os.Getenv("REDIS_ADDRESS"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			c.Addrs = append(c.Addrs, addr)
+		}
+	}
+
+	for _, err := range []error{
+		envBool("REDIS_CLUSTER", &c.Cluster),
+		envBool("REDIS_TLS", &c.TLS),
+		envInt("REDIS_DB", &c.DB),
+		envInt("REDIS_POOL_SIZE", &c.PoolSize),
+		envInt("REDIS_MIN_IDLE_CONNS", &c.MinIdleConns),
+		envInt("REDIS_MAX_RETRIES", &c.MaxRetries),
+		envInt("REDIS_CONNECT_RETRIES", &c.ConnectRetries),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s := os.Getenv("REDIS_DIAL_TIMEOUT"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_DIAL_TIMEOUT: %v", err)
+		}
+		c.DialTimeout = d
+	}
+	return c, nil
+}
+
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	if !c.TLS && c.TLSCAFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.TLSServerName,
+	}
+	if c.TLSCAFile != "" {
+		pem, err := os.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA bundle %s", c.TLSCAFile)
+		}
+	}
+	return config, nil
+}
+
+// NewClient returns a client for the configured server, cluster or
+// sentinels. It does not connect yet.
+func (c *Config) NewClient() (redis.UniversalClient, error) {
+	if len(c.Addrs) == 0 {
+		return nil, fmt.Errorf("no Redis address given")
+	}
+	if c.Cluster && c.MasterName != "" {
+		return nil, fmt.Errorf("cluster mode and sentinels are exclusive")
+	}
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &redis.UniversalOptions{
+		Addrs:        c.Addrs,
+		MasterName:   c.MasterName,
+		DB:           c.DB,
+		Username:     c.Username,
+		Password:     c.Password,
+		TLSConfig:    tlsConfig,
+		PoolSize:     c.PoolSize,
+		MinIdleConns: c.MinIdleConns,
+		MaxRetries:   c.MaxRetries,
+		DialTimeout:  c.DialTimeout,
+	}
+	switch {
+	case c.Cluster:
+		return redis.NewClusterClient(opts.Cluster()), nil
+	case c.MasterName != "":
+		return redis.NewFailoverClient(opts.Failover()), nil
+	default:
+		return redis.NewClient(opts.Simple()), nil
+	}
+}
+
+// Connect checks that Redis answers, retrying up to retries times with an
+// exponential backoff. Failing that, it returns the last error; the client
+// stays usable and reconnects when a command needs it.
+func Connect(ctx context.Context, client redis.UniversalClient, retries int) error {
+	backoff := connectBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = client.Ping(ctx).Err(); err == nil {
+			return nil
+		}
+		if attempt >= retries {
+			return err
+		}
+		log.Printf("Redis is not reachable, retrying in %v: %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// NewClientFromEnv returns a client configured by the environment variables,
+// once Redis answers or the connection retries are used up, so that the
+// functions do not fail at cold start during an outage.
+func NewClientFromEnv(ctx context.Context) (redis.UniversalClient, error) {
+	c, err := FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	client, err := c.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	if err := Connect(ctx, client, c.ConnectRetries); err != nil {
+		log.Printf("Failed to connect to Redis, will retry on demand: %v", err)
+	} else {
+		log.Print("Connected to Redis successfully.")
+	}
+	return client, nil
+}
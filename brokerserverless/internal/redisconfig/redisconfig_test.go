@@ -0,0 +1,128 @@
+package redisconfig
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("REDIS_ADDRESS", "a:6379, b:6379,")
+	t.Setenv("REDIS_CLUSTER", "true")
+	t.Setenv("REDIS_AUTH_TOKEN", "secret")
+	t.Setenv("REDIS_TLS", "1")
+	t.Setenv("REDIS_POOL_SIZE", "4")
+	t.Setenv("REDIS_DIAL_TIMEOUT", "2s")
+
+	c, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Addrs) != 2 || c.Addrs[0] != "a:6379" || c.Addrs[1] != "b:6379" {
+		t.Errorf("unexpected addresses %q", c.Addrs)
+	}
+	if !c.Cluster || !c.TLS || c.Password != "secret" || c.PoolSize != 4 || c.DialTimeout != 2*time.Second {
+		t.Errorf("unexpected configuration %+v", c)
+	}
+	if c.ConnectRetries != DefaultConnectRetries {
+		t.Errorf("expected %d connection retries, got %d", DefaultConnectRetries, c.ConnectRetries)
+	}
+
+	for name, value := range map[string]string{
+		"REDIS_CLUSTER":      "maybe",
+		"REDIS_POOL_SIZE":    "many",
+		"REDIS_DIAL_TIMEOUT": "2",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := FromEnv(); err == nil {
+				t.Errorf("expected an error for %s=%q", name, value)
+			}
+		})
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	for _, test := range []struct {
+		config Config
+		check  func(redis.UniversalClient) bool
+	}{
+		{Config{Addrs: []string{"a:6379"}}, func(c redis.UniversalClient) bool {
+			_, ok := c.(*redis.Client)
+			return ok
+		}},
+		{Config{Addrs: []string{"a:6379"}, Cluster: true}, func(c redis.UniversalClient) bool {
+			_, ok := c.(*redis.ClusterClient)
+			return ok
+		}},
+		{Config{Addrs: []string{"a:26379"}, MasterName: "master"}, func(c redis.UniversalClient) bool {
+			// Failover clients are plain clients dialing through
+			// the sentinels.
+			_, ok := c.(*redis.Client)
+			return ok
+		}},
+	} {
+		client, err := test.config.NewClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !test.check(client) {
+			t.Errorf("unexpected client %T for %+v", client, test.config)
+		}
+		client.Close()
+	}
+
+	for _, config := range []Config{
+		{},
+		{Addrs: []string{"a:6379"}, Cluster: true, MasterName: "master"},
+		{Addrs: []string{"a:6379"}, TLSCAFile: "does-not-exist.pem"},
+	} {
+		if _, err := config.NewClient(); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
+
+func TestTLSCAFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Addrs: []string{"a:6379"}, TLSCAFile: path}
+	if _, err := c.NewClient(); err == nil {
+		t.Error("expected an error for a CA bundle without certificates")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	client, err := (&Config{Addrs: []string{server.Addr()}}).NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := Connect(context.Background(), client, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// An unreachable server is given up on after the retries, and the
+	// client is still returned by NewClientFromEnv.
+	addr := server.Addr()
+	server.Close()
+	t.Setenv("REDIS_ADDRESS", addr)
+	t.Setenv("REDIS_CONNECT_RETRIES", "1")
+	client, err = NewClientFromEnv(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Ping(context.Background()).Err(); err == nil {
+		t.Error("expected a closed server to be unreachable")
+	}
+}
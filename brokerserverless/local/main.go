@@ -0,0 +1,322 @@
+/*
+Command local runs the serverless broker on a single machine.
+
+The client, AMP client, proxy and answer Lambda handlers are served behind a
+plain HTTP server that translates each request into the API Gateway event the
+Lambda would receive. Unless -redis-address is given, the matching state is kept in
+an embedded miniredis server, so no network access or AWS resources are
+needed. Point proxies at it with -broker http://localhost:8080/ (and
+optionally -broker-websocket ws://localhost:8080/proxy-ws) and clients with
+-url http://localhost:8080/. The metrics the Lambdas record are served on
+/metrics, in the broker-spec format, and on /prometheus.
+*/
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+	"unicode/utf8"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/brokerserverless/internal/handler"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/brokerserverless/internal/metrics"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgelist"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/ratelimit"
+)
+
+const (
+	readLimit = 100000 // Maximum number of bytes to be read from an HTTP request
+)
+
+type lambdaFunc func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+
+// LambdaHandler implements the http.Handler interface by invoking a Lambda
+// handler the way API Gateway does.
+type LambdaHandler struct {
+	route  string
+	handle lambdaFunc
+}
+
+func (lh LambdaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, readLimit))
+	if err != nil {
+		log.Printf("Error reading %s request: %v", lh.route, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	resp, err := lh.handle(r.Context(), newProxyRequest(r, lh.route, body))
+	if err != nil {
+		// API Gateway answers with a generic error when the function fails.
+		log.Printf("Error invoking %s handler: %v", lh.route, err)
+		http.Error(w, `{"message":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	writeProxyResponse(w, resp)
+}
+
+type websocketLambdaFunc func(context.Context, events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// WebSocketHandler implements the http.Handler interface by invoking a Lambda
+// handler for the connection, disconnection and each message of a WebSocket
+// connection, the way an API Gateway WebSocket API does.
+type WebSocketHandler struct {
+	handle websocketLambdaFunc
+}
+
+func (wh WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Error upgrading WebSocket connection: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(readLimit)
+
+	sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		sourceIP = r.RemoteAddr
+	}
+	invoke := func(routeKey string, body string) (events.APIGatewayProxyResponse, error) {
+		return wh.handle(r.Context(), events.APIGatewayWebsocketProxyRequest{
+			RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+				ConnectionID: r.RemoteAddr,
+				RouteKey:     routeKey,
+				Identity: events.APIGatewayRequestIdentity{
+					SourceIP:  sourceIP,
+					UserAgent: r.UserAgent(),
+				},
+			},
+			Body: body,
+		})
+	}
+
+	if resp, err := invoke("$connect", ""); err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("WebSocket connection refused: %d %v", resp.StatusCode, err)
+		return
+	}
+	defer invoke("$disconnect", "")
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		resp, err := invoke("$default", string(message))
+		if err != nil {
+			// API Gateway answers with a generic error when the function fails.
+			log.Printf("Error invoking WebSocket handler: %v", err)
+			resp.Body = `{"message": "Internal server error"}`
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(resp.Body)); err != nil {
+			log.Printf("Error writing WebSocket message: %v", err)
+			return
+		}
+	}
+}
+
+// newProxyRequest builds the API Gateway event for an HTTP request.
+func newProxyRequest(r *http.Request, route string, body []byte) events.APIGatewayProxyRequest {
+	sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		sourceIP = r.RemoteAddr
+	}
+
+	request := events.APIGatewayProxyRequest{
+		Resource:                        route,
+		Path:                            r.URL.Path,
+		HTTPMethod:                      r.Method,
+		Headers:                         make(map[string]string),
+		MultiValueHeaders:               r.Header,
+		QueryStringParameters:           make(map[string]string),
+		MultiValueQueryStringParameters: r.URL.Query(),
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: route,
+			Path:         r.URL.Path,
+			HTTPMethod:   r.Method,
+			Identity: events.APIGatewayRequestIdentity{
+				SourceIP:  sourceIP,
+				UserAgent: r.UserAgent(),
+			},
+		},
+	}
+	for name := range r.Header {
+		request.Headers[name] = r.Header.Get(name)
+	}
+	for name := range r.URL.Query() {
+		request.QueryStringParameters[name] = r.URL.Query().Get(name)
+	}
+
+	// API Gateway base64-encodes bodies that are not valid text.
+	if utf8.Valid(body) {
+		request.Body = string(body)
+	} else {
+		request.Body = base64.StdEncoding.EncodeToString(body)
+		request.IsBase64Encoded = true
+	}
+	return request
+}
+
+// writeProxyResponse writes the API Gateway response of a handler to w.
+func writeProxyResponse(w http.ResponseWriter, resp events.APIGatewayProxyResponse) {
+	for name, value := range resp.Headers {
+		w.Header().Set(name, value)
+	}
+	for name, values := range resp.MultiValueHeaders {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+
+	body := []byte(resp.Body)
+	if resp.IsBase64Encoded {
+		var err error
+		body, err = base64.StdEncoding.DecodeString(resp.Body)
+		if err != nil {
+			log.Printf("Error decoding base64 response: %v", err)
+			http.Error(w, `{"message":"Internal Server Error"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	status := resp.StatusCode
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// metricsHandler serves the metrics recorded so far, in the broker-spec
+// format or as Prometheus text.
+func metricsHandler(m *metrics.Metrics, prometheus bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snapshot, err := m.Snapshot(r.Context())
+		if err != nil {
+			log.Printf("Error reading metrics: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if prometheus {
+			err = snapshot.WritePrometheus(w)
+		} else {
+			err = snapshot.WriteSpec(w, time.Now())
+		}
+		if err != nil {
+			log.Printf("Error writing metrics: %v", err)
+		}
+	}
+}
+
+func main() {
+	var addr string
+	var redisAddress string
+	var bridgeListFilePath string
+	var allowedRelayPattern, presumedPatternForLegacyClient string
+	var geoipDatabase, geoip6Database string
+	var trustedProxyCount int
+	var rateLimit string
+
+	flag.StringVar(&addr, "addr", "localhost:8080", "address to listen on")
+	flag.StringVar(&redisAddress, "redis-address", "", "address of a Redis server to use instead of the embedded one")
+	flag.StringVar(&bridgeListFilePath, "bridge-list-path", "", "file path for bridgeListFile, instead of the bridge list given in the environment")
+	flag.StringVar(&allowedRelayPattern, "allowed-relay-pattern", os.Getenv("ALLOWED_RELAY_PATTERN"), "deprecated and ignored: proxies are only matched with clients of the bridges whose relays their AcceptedRelayPattern accepts, and rejected if it accepts none")
+	flag.StringVar(&presumedPatternForLegacyClient, "default-relay-pattern", os.Getenv("DEFAULT_RELAY_PATTERN"), "presumed pattern for legacy client")
+	flag.StringVar(&geoipDatabase, "geoipdb", os.Getenv("GEOIP_PATH"), "path to correctly formatted geoip database mapping IPv4 address ranges to country codes")
+	flag.StringVar(&geoip6Database, "geoip6db", os.Getenv("GEOIP6_PATH"), "path to correctly formatted geoip database mapping IPv6 address ranges to country codes")
+	flag.IntVar(&trustedProxyCount, "trusted-proxy-count", 0, "number of reverse proxies in front of the emulator that add to X-Forwarded-For; if zero, the header is ignored")
+	flag.StringVar(&rateLimit, "rate-limit", os.Getenv("RATE_LIMIT"), "comma-separated endpoint=rate:burst budgets of the requests a host may make, as in the RATE_LIMIT environment variable of the functions")
+	flag.Parse()
+
+	if redisAddress == "" {
+		server, err := miniredis.Run()
+		if err != nil {
+			log.Fatalf("Failed to start embedded Redis: %v", err)
+		}
+		// miniredis only expires keys when its clock is moved.
+		go func() {
+			for range time.Tick(time.Second) {
+				server.FastForward(time.Second)
+			}
+		}()
+		redisAddress = server.Addr()
+		log.Printf("Started embedded Redis on %s", redisAddress)
+	}
+
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: redisAddress,
+	})
+	if err := redisClient.Ping(context.Background()).Err(); err != nil {
+		log.Fatalf("Failed to connect to Redis: %v", err)
+	}
+
+	if allowedRelayPattern != "" {
+		log.Println("Warning: -allowed-relay-pattern is deprecated and ignored")
+	}
+
+	h := &handler.Handler{
+		Store:                          handler.NewRedisStore(redisClient),
+		PresumedPatternForLegacyClient: presumedPatternForLegacyClient,
+		Metrics:                        metrics.NewMetrics(redisClient),
+		TrustedProxyCount:              trustedProxyCount,
+	}
+	budgets, err := ratelimit.ParseBudgets(rateLimit)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if len(budgets) > 0 {
+		h.RateLimiter = ratelimit.NewLimiter(ratelimit.NewRedisStore(redisClient), budgets)
+	}
+	if geoipDatabase != "" || geoip6Database != "" {
+		if err := h.Metrics.LoadGeoipDatabases(geoipDatabase, geoip6Database); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	if bridgeListFilePath != "" {
+		bridgeListFile, err := os.Open(bridgeListFilePath)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		bridgeList := bridgelist.NewBridgeListHolder()
+		err = bridgeList.LoadBridgeInfo(bridgeListFile)
+		bridgeListFile.Close()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		h.BridgeList = bridgeList
+	} else {
+		h.BridgeList = handler.LoadBridgeList(context.Background(), redisClient)
+	}
+
+	mux := http.NewServeMux()
+	// The same routes as in template.yaml, with the WebSocket API mounted
+	// on /proxy-ws.
+	mux.Handle("POST /client", LambdaHandler{"/client", h.Client})
+	mux.Handle("POST /proxy", LambdaHandler{"/proxy", h.Proxy})
+	mux.Handle("POST /answer", LambdaHandler{"/answer", h.Answer})
+	mux.Handle("GET /amp/client/", LambdaHandler{"/amp/client/{proxy+}", h.AmpClient})
+	mux.Handle("/proxy-ws", WebSocketHandler{h.WebSocket})
+	mux.Handle("GET /metrics", metricsHandler(h.Metrics, false))
+	mux.Handle("GET /prometheus", metricsHandler(h.Metrics, true))
+
+	log.Printf("Serving the serverless broker on http://%s/", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
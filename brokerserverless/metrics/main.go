@@ -0,0 +1,89 @@
+/*
+Command metrics renders the metrics the serverless broker records in Redis.
+
+Run as a Lambda function, on a daily schedule, it logs the counts of the
+period in the broker-spec format, like the broker's metrics log, and starts
+the next period. Run as a command, it prints the metrics in the broker-spec
+format or as Prometheus text, so that serverless and classic deployments can
+be compared directly.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/brokerserverless/internal/metrics"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/brokerserverless/internal/redisconfig"
+)
+
+// logMetrics writes the counts of the period ending now to the function's
+// log, and starts the next period.
+func logMetrics(ctx context.Context, m *metrics.Metrics) error {
+	now := time.Now()
+	snapshot, err := m.SnapshotAndRotate(ctx, now)
+	if err != nil {
+		return err
+	}
+	return snapshot.WriteSpec(os.Stdout, now)
+}
+
+func main() {
+	var redisAddress string
+	var format string
+	var rotate bool
+
+	flag.StringVar(&redisAddress, "redis-address", "", "address of the Redis server of the serverless broker, instead of REDIS_ADDRESS")
+	flag.StringVar(&format, "format", "spec", "format to print the metrics in: \"spec\" for the broker-spec metrics log, or \"prometheus\"")
+	flag.BoolVar(&rotate, "rotate", false, "start a new period after printing the metrics")
+	flag.Parse()
+
+	config, err := redisconfig.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid Redis configuration: %v", err)
+	}
+	if redisAddress != "" {
+		config.Addrs = []string{redisAddress}
+	}
+	redisClient, err := config.NewClient()
+	if err != nil {
+		log.Fatalf("Invalid Redis configuration: %v", err)
+	}
+	m := metrics.NewMetrics(redisClient)
+
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "" {
+		lambda.Start(func(ctx context.Context, event events.CloudWatchEvent) error {
+			return logMetrics(ctx, m)
+		})
+		return
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+	var snapshot *metrics.Snapshot
+	if rotate {
+		snapshot, err = m.SnapshotAndRotate(ctx, now)
+	} else {
+		snapshot, err = m.Snapshot(ctx)
+	}
+	if err != nil {
+		log.Fatalf("Failed to read metrics: %v", err)
+	}
+	switch format {
+	case "spec":
+		err = snapshot.WriteSpec(os.Stdout, now)
+	case "prometheus":
+		err = snapshot.WritePrometheus(os.Stdout)
+	default:
+		log.Fatalf("Unknown format %q", format)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Command sqs is the Lambda function that serves clients rendezvousing over SQS.
+
+It is triggered by the broker's SQS queue, and handles each client offer like
+the broker's sqsHandler: the response is sent to the per-client queue named
+after the ClientID message attribute. An invocation without messages, as by
+the schedule in template.yaml, deletes the client queues that have not been
+used for a while.
+*/
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/brokerserverless/internal/handler"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/sqsclient"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/util"
+)
+
+const (
+	clientQueuePrefix = "snowflake-client-"
+	cleanupThreshold  = -2 * time.Minute
+)
+
+var h *handler.Handler
+var sqsClient sqsclient.SQSClient
+
+// init initializes the handler and the SQS client.
+func init() {
+	var err error
+	h, err = handler.NewLambdaHandlerFromEnv(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	sqsClient = sqs.NewFromConfig(cfg)
+}
+
+// remoteAddr is the best guess of the client's IP, for geolocation: the
+// address of the first candidate of its offer.
+func remoteAddr(encPollReq []byte) string {
+	req, err := messages.DecodeClientPollRequest(encPollReq)
+	if err != nil {
+		log.Printf("SQSHandler: error encountered when decoding client poll request: %v", err)
+		return ""
+	}
+	sdp, err := util.DeserializeSessionDescription(req.Offer)
+	if err != nil {
+		log.Printf("SQSHandler: error encountered when deserializing session desc: %v", err)
+		return ""
+	}
+	candidateAddrs := util.GetCandidateAddrs(sdp.SDP)
+	if len(candidateAddrs) == 0 {
+		return ""
+	}
+	return candidateAddrs[0].String()
+}
+
+// handleMessage handles the client offer of one message, and sends the
+// response to the client's queue.
+func handleMessage(ctx context.Context, message events.SQSMessage) {
+	clientID := message.MessageAttributes["ClientID"].StringValue
+	if clientID == nil {
+		log.Println("SQSHandler: got SDP offer in SQS message with no client ID. ignoring this message.")
+		return
+	}
+
+	res, err := sqsClient.CreateQueue(ctx, &sqs.CreateQueueInput{
+		QueueName: aws.String(clientQueuePrefix + *clientID),
+	})
+	if err != nil {
+		log.Printf("SQSHandler: error encountered when creating answer queue for client %s: %v", *clientID, err)
+		return
+	}
+
+	encPollReq := []byte(message.Body)
+	arg := messages.Arg{
+		Body:             encPollReq,
+		RemoteAddr:       remoteAddr(encPollReq),
+		RendezvousMethod: messages.RendezvousSqs,
+	}
+	var response []byte
+	if err := h.ClientOffers(ctx, arg, &response); err != nil {
+		log.Printf("SQSHandler: error encountered when handling message: %v", err)
+		return
+	}
+
+	_, err = sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    res.QueueUrl,
+		MessageBody: aws.String(string(response)),
+	})
+	if err != nil {
+		log.Printf("SQSHandler: error encountered when answering client %s: %v", *clientID, err)
+	}
+}
+
+// cleanupClientQueues deletes the client queues that were last changed more
+// than 2 minutes ago.
+func cleanupClientQueues(ctx context.Context) {
+	queueURLsList := []string{}
+	var nextToken *string
+	for {
+		res, err := sqsClient.ListQueues(ctx, &sqs.ListQueuesInput{
+			QueueNamePrefix: aws.String(clientQueuePrefix),
+			MaxResults:      aws.Int32(1000),
+			NextToken:       nextToken,
+		})
+		if err != nil {
+			// Client queues will be cleaned up the next time the
+			// function is scheduled.
+			log.Printf("SQSHandler: encountered error while retrieving client queues to clean up: %v", err)
+			break
+		}
+		queueURLsList = append(queueURLsList, res.QueueUrls...)
+		if res.NextToken == nil {
+			break
+		}
+		nextToken = res.NextToken
+	}
+
+	numDeleted := 0
+	cleanupCutoff := time.Now().Add(cleanupThreshold)
+	for _, queueURL := range queueURLsList {
+		if !strings.Contains(queueURL, clientQueuePrefix) {
+			continue
+		}
+		res, err := sqsClient.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(queueURL),
+			AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameLastModifiedTimestamp},
+		})
+		if err != nil {
+			// The queue may be in the process of being deleted.
+			log.Printf("SQSHandler: encountered error while getting attribute of client queue %s. queue may already be deleted.", queueURL)
+			continue
+		}
+		lastModifiedInt64, err := strconv.ParseInt(res.Attributes[string(types.QueueAttributeNameLastModifiedTimestamp)], 10, 64)
+		if err != nil {
+			log.Printf("SQSHandler: encountered invalid lastModifiedTimetamp value from client queue %s: %v", queueURL, err)
+			continue
+		}
+		if time.Unix(lastModifiedInt64, 0).Before(cleanupCutoff) {
+			_, err := sqsClient.DeleteQueue(ctx, &sqs.DeleteQueueInput{
+				QueueUrl: aws.String(queueURL),
+			})
+			if err != nil {
+				log.Printf("SQSHandler: encountered error when deleting client queue %s: %v", queueURL, err)
+				continue
+			}
+			numDeleted += 1
+		}
+	}
+	log.Printf("SQSHandler: finished running iteration of client queue cleanup. found and deleted %d client queues.", numDeleted)
+}
+
+// handleSQS handles a batch of messages of the broker's queue. The messages
+// are handled at once, since each waits for a proxy answer. Messages are never
+// reported as failed: by the time they could be retried, the client is gone.
+func handleSQS(ctx context.Context, event events.SQSEvent) error {
+	if len(event.Records) == 0 {
+		cleanupClientQueues(ctx)
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for _, message := range event.Records {
+		wg.Add(1)
+		go func(message events.SQSMessage) {
+			defer wg.Done()
+			handleMessage(ctx, message)
+		}(message)
+	}
+	wg.Wait()
+	return nil
+}
+
+func main() {
+	lambda.Start(handleSQS)
+}
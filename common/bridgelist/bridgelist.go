@@ -0,0 +1,334 @@
+/* (*BridgeListHolderFileBased).LoadBridgeInfo loads a Snowflake Server bridge info description file,
+   its format is as follows:
+
+   This file should be in newline-delimited JSON format(https://jsonlines.org/).
+   For each line, the format of json data should be in the format of:
+   {"displayName":"default", "webSocketAddress":"wss://snowflake.torproject.net/", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80A72"}
+
+   displayName:string is the name of this bridge. This value is not currently used programmatically.
+
+   webSocketAddress:string is the WebSocket URL of this bridge.
+   This will be the address proxy used to connect to this snowflake server.
+
+   fingerprint:string is the identifier of the bridge.
+   This will be used by a client to identify the bridge it wishes to connect to.
+
+   A bridge served by several snowflake servers may list them in relays instead
+   of giving a webSocketAddress:
+   {"displayName":"multi", "relays":[{"url":"wss://01.snowflake.example/", "weight":2, "regions":["DE","FR"]}, {"url":"wss://02.snowflake.example/"}], "fingerprint":"8838024498816A039FCBBAB14E6F40A0843051FA"}
+
+   relays[].url:string is the WebSocket URL of a server of the bridge.
+
+   relays[].weight:int is how much traffic the server gets relative to the
+   other servers of the bridge. It defaults to 1.
+
+   relays[].regions:[]string optionally lists the country codes of the proxies
+   the server is meant for. Proxies in these countries are sent to one of the
+   servers meant for them, if there is any.
+
+   The webSocketAddress of such a bridge is the URL of its first relay.
+
+   The existence of ANY other fields is NOT permitted.
+
+   The file will be considered invalid if there is at least one invalid json record.
+   In this case, an error will be returned, and none of the records will be loaded.
+
+   (*BridgeListHolderFileBased).ReloadBridgeInfo does the same, and also reports
+   which bridges were added, removed or changed by the new file.
+*/
+
+// Package bridgelist keeps track of the Snowflake bridges a broker can hand out
+// to proxies. It is shared by the broker and the serverless broker, so that
+// both read bridge lists the same way.
+package bridgelist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgefingerprint"
+)
+
+// DefaultBridgeList is the bridge list used when none is configured.
+const DefaultBridgeList = `{"displayName":"default", "webSocketAddress":"wss://snowflake.torproject.net/", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80A72"}
+`
+
+var ErrBridgeNotFound = errors.New("bridge with requested fingerprint is unknown to the broker")
+
+func NewBridgeListHolder() BridgeListHolderFileBased {
+	return &bridgeListHolder{}
+}
+
+type bridgeListHolder struct {
+	bridgeInfo       map[bridgefingerprint.Fingerprint]BridgeInfo
+	accessBridgeInfo sync.RWMutex
+}
+
+type BridgeListHolder interface {
+	GetBridgeInfo(bridgefingerprint.Fingerprint) (BridgeInfo, error)
+}
+
+type BridgeListHolderFileBased interface {
+	BridgeListHolder
+	LoadBridgeInfo(reader io.Reader) error
+	// ReloadBridgeInfo replaces the bridge list like LoadBridgeInfo, and
+	// returns how the new list differs from the old one.
+	ReloadBridgeInfo(reader io.Reader) (Diff, error)
+	// AllBridgeInfo returns every bridge of the list, ordered by
+	// fingerprint.
+	AllBridgeInfo() []BridgeInfo
+}
+
+// Diff lists the hex fingerprints of the bridges added, removed and changed
+// by a reload of the bridge list, in order.
+type Diff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+// Empty reports whether the reload changed nothing.
+func (d Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func (d Diff) String() string {
+	if d.Empty() {
+		return "no changes"
+	}
+	var parts []string
+	for _, change := range []struct {
+		name         string
+		fingerprints []string
+	}{{"added", d.Added}, {"removed", d.Removed}, {"changed", d.Changed}} {
+		if len(change.fingerprints) > 0 {
+			parts = append(parts, fmt.Sprintf("%s %s", change.name, strings.Join(change.fingerprints, " ")))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+func diff(old, new map[bridgefingerprint.Fingerprint]BridgeInfo) Diff {
+	var d Diff
+	for fingerprint, info := range new {
+		name := strings.ToUpper(hex.EncodeToString(fingerprint.ToBytes()))
+		if oldInfo, ok := old[fingerprint]; !ok {
+			d.Added = append(d.Added, name)
+		} else if !reflect.DeepEqual(oldInfo, info) {
+			d.Changed = append(d.Changed, name)
+		}
+	}
+	for fingerprint := range old {
+		if _, ok := new[fingerprint]; !ok {
+			d.Removed = append(d.Removed, strings.ToUpper(hex.EncodeToString(fingerprint.ToBytes())))
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Changed)
+	return d
+}
+
+type BridgeInfo struct {
+	DisplayName      string  `json:"displayName"`
+	WebSocketAddress string  `json:"webSocketAddress"`
+	Fingerprint      string  `json:"fingerprint"`
+	Relays           []Relay `json:"relays,omitempty"`
+}
+
+// Relay is one of the servers of a bridge with several.
+type Relay struct {
+	URL     string   `json:"url"`
+	Weight  int      `json:"weight,omitempty"`
+	Regions []string `json:"regions,omitempty"`
+}
+
+func (r Relay) weight() int {
+	if r.Weight == 0 {
+		return 1
+	}
+	return r.Weight
+}
+
+// validate checks the relays of a bridge just loaded, and sets its
+// webSocketAddress to the first one. A bridge without either is still
+// accepted, as it always was, but no proxy can be sent to it.
+func (b *BridgeInfo) validate() error {
+	if len(b.Relays) == 0 {
+		if b.WebSocketAddress == "" {
+			log.Printf("Warning: bridge %s has no webSocketAddress or relays", b.Fingerprint)
+		}
+		return nil
+	}
+	if b.WebSocketAddress != "" {
+		return fmt.Errorf("bridge %s has both a webSocketAddress and relays", b.Fingerprint)
+	}
+	for _, relay := range b.Relays {
+		if relay.URL == "" {
+			return fmt.Errorf("bridge %s has a relay without url", b.Fingerprint)
+		}
+		if relay.Weight < 0 {
+			return fmt.Errorf("bridge %s has a relay with negative weight", b.Fingerprint)
+		}
+	}
+	b.WebSocketAddress = b.Relays[0].URL
+	return nil
+}
+
+// RelayURLs returns the WebSocket URLs of all the servers of the bridge.
+func (b BridgeInfo) RelayURLs() []string {
+	if len(b.Relays) == 0 {
+		return []string{b.WebSocketAddress}
+	}
+	urls := make([]string, len(b.Relays))
+	for i, relay := range b.Relays {
+		urls[i] = relay.URL
+	}
+	return urls
+}
+
+// RelayHosts returns the host names of the servers of the bridge, which the
+// relay patterns of proxies are matched against.
+func (b BridgeInfo) RelayHosts() []string {
+	var hosts []string
+	for _, relayURL := range b.RelayURLs() {
+		if host := RelayHost(relayURL); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// RelayHost returns the host name of a relay URL, or "" if it cannot be
+// parsed.
+func RelayHost(relayURL string) string {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// PickRelay returns the WebSocket URL a proxy in the given country should
+// connect to, chosen at random in proportion to the weights of the relays. If
+// some relays are meant for the country, only those are considered. The
+// country may be empty if it is unknown.
+func (b BridgeInfo) PickRelay(country string) string {
+	return b.PickAcceptedRelay(country, nil)
+}
+
+// PickAcceptedRelay is PickRelay among the relays whose URL is accepted by
+// accepts, or among all relays if accepts is nil. It returns "" if none is.
+func (b BridgeInfo) PickAcceptedRelay(country string, accepts func(url string) bool) string {
+	candidates := b.Relays
+	if len(candidates) == 0 {
+		candidates = []Relay{{URL: b.WebSocketAddress}}
+	}
+	if accepts != nil {
+		var accepted []Relay
+		for _, relay := range candidates {
+			if accepts(relay.URL) {
+				accepted = append(accepted, relay)
+			}
+		}
+		if len(accepted) == 0 {
+			return ""
+		}
+		candidates = accepted
+	}
+	if country != "" {
+		var regional []Relay
+		for _, relay := range candidates {
+			for _, region := range relay.Regions {
+				if strings.EqualFold(region, country) {
+					regional = append(regional, relay)
+					break
+				}
+			}
+		}
+		if len(regional) > 0 {
+			candidates = regional
+		}
+	}
+	total := 0
+	for _, relay := range candidates {
+		total += relay.weight()
+	}
+	n := rand.Intn(total)
+	for _, relay := range candidates {
+		if n < relay.weight() {
+			return relay.URL
+		}
+		n -= relay.weight()
+	}
+	return candidates[len(candidates)-1].URL
+}
+
+func (h *bridgeListHolder) GetBridgeInfo(fingerprint bridgefingerprint.Fingerprint) (BridgeInfo, error) {
+	h.accessBridgeInfo.RLock()
+	defer h.accessBridgeInfo.RUnlock()
+	if bridgeInfo, ok := h.bridgeInfo[fingerprint]; ok {
+		return bridgeInfo, nil
+	}
+	return BridgeInfo{}, ErrBridgeNotFound
+}
+
+func (h *bridgeListHolder) AllBridgeInfo() []BridgeInfo {
+	h.accessBridgeInfo.RLock()
+	defer h.accessBridgeInfo.RUnlock()
+	bridges := make([]BridgeInfo, 0, len(h.bridgeInfo))
+	for _, bridgeInfo := range h.bridgeInfo {
+		bridges = append(bridges, bridgeInfo)
+	}
+	sort.Slice(bridges, func(i, j int) bool {
+		return strings.ToUpper(bridges[i].Fingerprint) < strings.ToUpper(bridges[j].Fingerprint)
+	})
+	return bridges
+}
+
+func (h *bridgeListHolder) LoadBridgeInfo(reader io.Reader) error {
+	_, err := h.ReloadBridgeInfo(reader)
+	return err
+}
+
+func (h *bridgeListHolder) ReloadBridgeInfo(reader io.Reader) (Diff, error) {
+	bridgeInfoMap := map[bridgefingerprint.Fingerprint]BridgeInfo{}
+	inputScanner := bufio.NewScanner(reader)
+	for inputScanner.Scan() {
+		inputLine := inputScanner.Bytes()
+		bridgeInfo := BridgeInfo{}
+		decoder := json.NewDecoder(bytes.NewReader(inputLine))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&bridgeInfo); err != nil {
+			return Diff{}, err
+		}
+		if err := bridgeInfo.validate(); err != nil {
+			return Diff{}, err
+		}
+
+		var bridgeFingerprint bridgefingerprint.Fingerprint
+		var err error
+		if bridgeFingerprint, err = bridgefingerprint.FingerprintFromHexString(bridgeInfo.Fingerprint); err != nil {
+			return Diff{}, err
+		}
+
+		bridgeInfoMap[bridgeFingerprint] = bridgeInfo
+	}
+	h.accessBridgeInfo.Lock()
+	defer h.accessBridgeInfo.Unlock()
+	d := diff(h.bridgeInfo, bridgeInfoMap)
+	h.bridgeInfo = bridgeInfoMap
+	return d, nil
+}
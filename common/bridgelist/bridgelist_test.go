@@ -0,0 +1,183 @@
+package bridgelist
+
+import (
+	"bytes"
+	"encoding/hex"
+	. "github.com/smartystreets/goconvey/convey"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/bridgefingerprint"
+	"testing"
+)
+
+const DefaultBridges = `{"displayName":"default", "webSocketAddress":"wss://snowflake.torproject.org", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80A72"}
+`
+
+const ImaginaryBridges = `{"displayName":"default", "webSocketAddress":"wss://snowflake.torproject.org", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80A72"}
+{"displayName":"imaginary-1", "webSocketAddress":"wss://imaginary-1-snowflake.torproject.org", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80B00"}
+{"displayName":"imaginary-2", "webSocketAddress":"wss://imaginary-2-snowflake.torproject.org", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80B01"}
+{"displayName":"imaginary-3", "webSocketAddress":"wss://imaginary-3-snowflake.torproject.org", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80B02"}
+{"displayName":"imaginary-4", "webSocketAddress":"wss://imaginary-4-snowflake.torproject.org", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80B03"}
+{"displayName":"imaginary-5", "webSocketAddress":"wss://imaginary-5-snowflake.torproject.org", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80B04"}
+{"displayName":"imaginary-6", "webSocketAddress":"wss://imaginary-6-snowflake.torproject.org", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80B05"}
+{"displayName":"imaginary-7", "webSocketAddress":"wss://imaginary-7-snowflake.torproject.org", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80B06"}
+{"displayName":"imaginary-8", "webSocketAddress":"wss://imaginary-8-snowflake.torproject.org", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80B07"}
+{"displayName":"imaginary-9", "webSocketAddress":"wss://imaginary-9-snowflake.torproject.org", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80B08"}
+{"displayName":"imaginary-10", "webSocketAddress":"wss://imaginary-10-snowflake.torproject.org", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80B09"}
+`
+
+func TestBridgeLoad(t *testing.T) {
+	Convey("load default list", t, func() {
+		bridgeList := NewBridgeListHolder()
+		So(bridgeList.LoadBridgeInfo(bytes.NewReader([]byte(DefaultBridges))), ShouldBeNil)
+		{
+			bridgeFingerprint := [20]byte{}
+			{
+				n, err := hex.Decode(bridgeFingerprint[:], []byte("2B280B23E1107BB62ABFC40DDCC8824814F80A72"))
+				So(n, ShouldEqual, 20)
+				So(err, ShouldBeNil)
+			}
+			Fingerprint, err := bridgefingerprint.FingerprintFromBytes(bridgeFingerprint[:])
+			So(err, ShouldBeNil)
+			bridgeInfo, err := bridgeList.GetBridgeInfo(Fingerprint)
+			So(err, ShouldBeNil)
+			So(bridgeInfo.DisplayName, ShouldEqual, "default")
+			So(bridgeInfo.WebSocketAddress, ShouldEqual, "wss://snowflake.torproject.org")
+		}
+	})
+	Convey("load imaginary list", t, func() {
+		bridgeList := NewBridgeListHolder()
+		So(bridgeList.LoadBridgeInfo(bytes.NewReader([]byte(ImaginaryBridges))), ShouldBeNil)
+		{
+			bridgeFingerprint := [20]byte{}
+			{
+				n, err := hex.Decode(bridgeFingerprint[:], []byte("2B280B23E1107BB62ABFC40DDCC8824814F80B07"))
+				So(n, ShouldEqual, 20)
+				So(err, ShouldBeNil)
+			}
+			Fingerprint, err := bridgefingerprint.FingerprintFromBytes(bridgeFingerprint[:])
+			So(err, ShouldBeNil)
+			bridgeInfo, err := bridgeList.GetBridgeInfo(Fingerprint)
+			So(err, ShouldBeNil)
+			So(bridgeInfo.DisplayName, ShouldEqual, "imaginary-8")
+			So(bridgeInfo.WebSocketAddress, ShouldEqual, "wss://imaginary-8-snowflake.torproject.org")
+		}
+	})
+}
+
+func TestBridgeReload(t *testing.T) {
+	Convey("reload reports the changes to the list", t, func() {
+		bridgeList := NewBridgeListHolder()
+		diff, err := bridgeList.ReloadBridgeInfo(bytes.NewReader([]byte(DefaultBridges)))
+		So(err, ShouldBeNil)
+		So(diff.Added, ShouldResemble, []string{"2B280B23E1107BB62ABFC40DDCC8824814F80A72"})
+
+		changed := `{"displayName":"default", "webSocketAddress":"wss://snowflake.torproject.net", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80A72"}
+{"displayName":"imaginary-1", "webSocketAddress":"wss://imaginary-1-snowflake.torproject.org", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80B00"}
+`
+		diff, err = bridgeList.ReloadBridgeInfo(bytes.NewReader([]byte(changed)))
+		So(err, ShouldBeNil)
+		So(diff.Added, ShouldResemble, []string{"2B280B23E1107BB62ABFC40DDCC8824814F80B00"})
+		So(diff.Removed, ShouldBeEmpty)
+		So(diff.Changed, ShouldResemble, []string{"2B280B23E1107BB62ABFC40DDCC8824814F80A72"})
+
+		diff, err = bridgeList.ReloadBridgeInfo(bytes.NewReader([]byte(ImaginaryBridges)))
+		So(err, ShouldBeNil)
+		So(diff.Added, ShouldHaveLength, 9)
+		bridges := bridgeList.AllBridgeInfo()
+		So(bridges, ShouldHaveLength, 11)
+		So(bridges[0].DisplayName, ShouldEqual, "default")
+		So(bridges[10].DisplayName, ShouldEqual, "imaginary-10")
+		So(diff.Changed, ShouldResemble, []string{"2B280B23E1107BB62ABFC40DDCC8824814F80A72"})
+		So(diff.String(), ShouldStartWith, "added 2B280B23E1107BB62ABFC40DDCC8824814F80B01 ")
+
+		diff, err = bridgeList.ReloadBridgeInfo(bytes.NewReader([]byte(DefaultBridges)))
+		So(err, ShouldBeNil)
+		So(diff.Removed, ShouldHaveLength, 10)
+		So(diff.String(), ShouldStartWith, "removed ")
+
+		diff, err = bridgeList.ReloadBridgeInfo(bytes.NewReader([]byte(DefaultBridges)))
+		So(err, ShouldBeNil)
+		So(diff.Empty(), ShouldBeTrue)
+		So(diff.String(), ShouldEqual, "no changes")
+	})
+
+	Convey("an invalid list leaves the old one in place", t, func() {
+		bridgeList := NewBridgeListHolder()
+		So(bridgeList.LoadBridgeInfo(bytes.NewReader([]byte(DefaultBridges))), ShouldBeNil)
+		_, err := bridgeList.ReloadBridgeInfo(bytes.NewReader([]byte(ImaginaryBridges + `{"fingerprint":"nope"}`)))
+		So(err, ShouldNotBeNil)
+		fingerprint, err := bridgefingerprint.FingerprintFromHexString("2B280B23E1107BB62ABFC40DDCC8824814F80B00")
+		So(err, ShouldBeNil)
+		_, err = bridgeList.GetBridgeInfo(fingerprint)
+		So(err, ShouldEqual, ErrBridgeNotFound)
+	})
+}
+
+const MultiRelayBridges = `{"displayName":"default", "webSocketAddress":"wss://snowflake.torproject.org", "fingerprint":"2B280B23E1107BB62ABFC40DDCC8824814F80A72"}
+{"displayName":"multi", "relays":[{"url":"wss://01.snowflake.example/", "weight":3}, {"url":"wss://02.snowflake.example/"}, {"url":"wss://de.snowflake.example/", "regions":["DE", "AT"]}], "fingerprint":"8838024498816A039FCBBAB14E6F40A0843051FA"}
+`
+
+func TestMultiRelayBridges(t *testing.T) {
+	Convey("load bridges with several relays", t, func() {
+		bridgeList := NewBridgeListHolder()
+		So(bridgeList.LoadBridgeInfo(bytes.NewReader([]byte(MultiRelayBridges))), ShouldBeNil)
+
+		fingerprint, err := bridgefingerprint.FingerprintFromHexString("8838024498816A039FCBBAB14E6F40A0843051FA")
+		So(err, ShouldBeNil)
+		multi, err := bridgeList.GetBridgeInfo(fingerprint)
+		So(err, ShouldBeNil)
+		So(multi.WebSocketAddress, ShouldEqual, "wss://01.snowflake.example/")
+		So(multi.RelayURLs(), ShouldResemble, []string{"wss://01.snowflake.example/", "wss://02.snowflake.example/", "wss://de.snowflake.example/"})
+
+		counts := make(map[string]int)
+		for i := 0; i < 5000; i++ {
+			counts[multi.PickRelay("")]++
+		}
+		// Weights of 3, 1 and 1.
+		So(counts["wss://01.snowflake.example/"], ShouldBeBetween, 2700, 3300)
+		So(counts["wss://02.snowflake.example/"], ShouldBeBetween, 800, 1200)
+		So(counts["wss://de.snowflake.example/"], ShouldBeBetween, 800, 1200)
+
+		for i := 0; i < 100; i++ {
+			So(multi.PickRelay("at"), ShouldEqual, "wss://de.snowflake.example/")
+			So(multi.PickRelay("FR"), ShouldNotBeEmpty)
+		}
+
+		notFirst := func(url string) bool { return url != "wss://01.snowflake.example/" }
+		for i := 0; i < 100; i++ {
+			So(multi.PickAcceptedRelay("", notFirst), ShouldNotEqual, "wss://01.snowflake.example/")
+			So(multi.PickAcceptedRelay("DE", notFirst), ShouldEqual, "wss://de.snowflake.example/")
+		}
+		So(multi.PickAcceptedRelay("", func(string) bool { return false }), ShouldBeEmpty)
+		So(multi.RelayHosts(), ShouldResemble, []string{"01.snowflake.example", "02.snowflake.example", "de.snowflake.example"})
+		So(RelayHost("wss://01.snowflake.example:8443/path"), ShouldEqual, "01.snowflake.example")
+
+		fingerprint, err = bridgefingerprint.FingerprintFromHexString("2B280B23E1107BB62ABFC40DDCC8824814F80A72")
+		So(err, ShouldBeNil)
+		single, err := bridgeList.GetBridgeInfo(fingerprint)
+		So(err, ShouldBeNil)
+		So(single.PickRelay("DE"), ShouldEqual, "wss://snowflake.torproject.org")
+		So(single.RelayURLs(), ShouldResemble, []string{"wss://snowflake.torproject.org"})
+	})
+
+	Convey("accept a bridge without webSocketAddress or relays", t, func() {
+		bridgeList := NewBridgeListHolder()
+		So(bridgeList.LoadBridgeInfo(bytes.NewReader([]byte(`{"displayName":"none", "fingerprint":"8838024498816A039FCBBAB14E6F40A0843051FA"}`+"\n"))), ShouldBeNil)
+		fingerprint, err := bridgefingerprint.FingerprintFromHexString("8838024498816A039FCBBAB14E6F40A0843051FA")
+		So(err, ShouldBeNil)
+		bridgeInfo, err := bridgeList.GetBridgeInfo(fingerprint)
+		So(err, ShouldBeNil)
+		So(bridgeInfo.RelayHosts(), ShouldBeEmpty)
+	})
+
+	Convey("reject invalid relays", t, func() {
+		for _, line := range []string{
+			`{"displayName":"both", "webSocketAddress":"wss://snowflake.torproject.org", "relays":[{"url":"wss://01.snowflake.example/"}], "fingerprint":"8838024498816A039FCBBAB14E6F40A0843051FA"}`,
+			`{"displayName":"no url", "relays":[{"weight":1}], "fingerprint":"8838024498816A039FCBBAB14E6F40A0843051FA"}`,
+			`{"displayName":"negative", "relays":[{"url":"wss://01.snowflake.example/", "weight":-1}], "fingerprint":"8838024498816A039FCBBAB14E6F40A0843051FA"}`,
+			`{"displayName":"unknown", "relays":[{"url":"wss://01.snowflake.example/", "region":"DE"}], "fingerprint":"8838024498816A039FCBBAB14E6F40A0843051FA"}`,
+		} {
+			bridgeList := NewBridgeListHolder()
+			So(bridgeList.LoadBridgeInfo(bytes.NewReader([]byte(line+"\n"))), ShouldNotBeNil)
+		}
+	})
+}
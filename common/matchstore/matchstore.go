@@ -0,0 +1,142 @@
+/*
+Package matchstore keeps track of snowflake proxies waiting for clients and
+passes SDP offers and answers between matched pairs.
+
+The broker and the serverless broker both rendezvous through a MatchStore, so
+the same steps happen in the same order no matter where the matching state is
+kept:
+
+ 1. A proxy polls and is registered with RegisterProxy, which blocks until a
+    client offer is delivered to it.
+ 2. A client claims a compatible proxy with ClaimProxy and hands it its offer
+    with DeliverOffer.
+ 3. The client waits for the proxy's answer with WaitForAnswer while the proxy
+    sends it back through DeliverAnswer.
+ 4. The client forgets the proxy with Expire once the rendezvous is over.
+*/
+package matchstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/namematcher"
+)
+
+const (
+	// DefaultProxyTimeout is how long a registered proxy waits for a client.
+	DefaultProxyTimeout = 10 * time.Second
+	// DefaultAnswerTimeout is how long a client waits for the proxy's answer.
+	DefaultAnswerTimeout = 10 * time.Second
+	// DefaultExpiration bounds how long the state of an abandoned rendezvous
+	// is kept by stores that cannot clean up after themselves.
+	DefaultExpiration = 5 * time.Minute
+)
+
+const (
+	NATUnknown      = "unknown"
+	NATRestricted   = "restricted"
+	NATUnrestricted = "unrestricted"
+)
+
+var (
+	// ErrTimeout is returned by WaitForAnswer when the proxy did not answer in time.
+	ErrTimeout = errors.New("timed out waiting for answer")
+	// ErrProxyGone is returned by DeliverOffer when the claimed proxy is no
+	// longer waiting for a client.
+	ErrProxyGone = errors.New("proxy gone")
+	// ErrClientGone is returned by DeliverAnswer when no client is waiting
+	// for the proxy's answer anymore.
+	ErrClientGone = errors.New("client gone")
+	// ErrProxyBusy is returned by RegisterProxy and AddProxy when a proxy
+	// with the same id is already waiting for or matched with a client.
+	ErrProxyBusy = errors.New("proxy already registered")
+)
+
+// Proxy describes a snowflake proxy that is waiting for a client.
+type Proxy struct {
+	ID        string
+	ProxyType string
+	NATType   string
+	Clients   int
+	// Addr is the address the proxy polled from, if known.
+	Addr string
+	// RelayPattern is the AcceptedRelayPattern of the proxy: the host names
+	// of the relays it is willing to connect to. An empty pattern accepts
+	// every relay.
+	RelayPattern string
+}
+
+// AcceptsRelay reports whether a proxy with the given relay pattern is willing
+// to connect to a relay with one of the given host names.
+func AcceptsRelay(pattern string, hosts []string) bool {
+	matcher := namematcher.NewNameMatcher(pattern)
+	for _, host := range hosts {
+		if matcher.IsMember(host) {
+			return true
+		}
+	}
+	return false
+}
+
+type relayHostsKey struct{}
+
+// WithRelayHosts returns a context restricting ClaimProxy to the proxies
+// whose RelayPattern accepts one of the host names of the relays of the
+// bridge the client asked for.
+func WithRelayHosts(ctx context.Context, hosts []string) context.Context {
+	return context.WithValue(ctx, relayHostsKey{}, hosts)
+}
+
+// RelayHosts returns the relay host names set by WithRelayHosts, or nil if
+// any proxy may be claimed.
+func RelayHosts(ctx context.Context) []string {
+	hosts, _ := ctx.Value(relayHostsKey{}).([]string)
+	return hosts
+}
+
+// Offer contains an SDP, bridge fingerprint and the NAT type of the client.
+type Offer struct {
+	NATType     string `json:"natType"`
+	SDP         []byte `json:"sdp"`
+	Fingerprint []byte `json:"fingerprint"`
+}
+
+// MatchStore holds the matching state shared between proxy polls, client
+// offers and proxy answers.
+type MatchStore interface {
+	// RegisterProxy makes the proxy available to clients and blocks until a
+	// client offer is delivered to it. If no client claims the proxy in
+	// time, the proxy is expired and a nil offer is returned.
+	RegisterProxy(ctx context.Context, proxy *Proxy) (*Offer, error)
+	// ClaimProxy removes a proxy compatible with a client of the given NAT
+	// type from the pool of waiting proxies, preferring the proxies serving
+	// the fewest clients. If the context carries relay host names (see
+	// WithRelayHosts), only a proxy accepting one of them is claimed. It
+	// returns a nil proxy if none is available.
+	ClaimProxy(ctx context.Context, natType string) (*Proxy, error)
+	// DeliverOffer hands a client offer to a proxy returned by ClaimProxy.
+	DeliverOffer(ctx context.Context, proxy *Proxy, offer *Offer) error
+	// WaitForAnswer blocks until the proxy answers the offer it was given,
+	// or returns ErrTimeout.
+	WaitForAnswer(ctx context.Context, proxy *Proxy) (string, error)
+	// DeliverAnswer passes the answer of the proxy with the given id to the
+	// client waiting for it, or returns ErrClientGone.
+	DeliverAnswer(ctx context.Context, id string, answer string) error
+	// Expire forgets the proxy along with any pending offer or answer.
+	Expire(ctx context.Context, proxy *Proxy) error
+}
+
+// A NonBlockingStore can also register proxies without keeping them waiting,
+// for proxies that come back later to fetch their offer.
+type NonBlockingStore interface {
+	MatchStore
+	// AddProxy makes the proxy available to clients for as long as
+	// RegisterProxy would wait, and returns a token to fetch its offer with.
+	AddProxy(ctx context.Context, proxy *Proxy) (token string, err error)
+	// FetchOffer returns the client offer delivered to the proxy with the
+	// given id and token, or a nil offer if there is none yet. Once the
+	// registration has expired, it returns ErrProxyGone.
+	FetchOffer(ctx context.Context, id string, token string) (*Offer, error)
+}
@@ -0,0 +1,93 @@
+package matchstore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MatchPolicy decides which proxies a client may be matched with. For each
+// client NAT type, it lists the NAT pools proxies are taken from, in order of
+// preference. Clients of unknown NAT type are treated as restricted ones, as
+// are proxies of unknown NAT type, which wait in the restricted pool.
+//
+// Two restricted peers usually cannot connect to each other, so only the
+// experimental policies pair restricted clients with restricted proxies.
+type MatchPolicy struct {
+	Name         string
+	unrestricted []string
+	restricted   []string
+}
+
+var (
+	// PolicyPreferRestricted gives restricted clients unrestricted proxies,
+	// and unrestricted clients restricted proxies first, to keep the
+	// scarcer unrestricted proxies for the clients that need them. It is
+	// the default.
+	PolicyPreferRestricted = &MatchPolicy{
+		Name:         "prefer-restricted",
+		unrestricted: []string{NATRestricted, NATUnrestricted},
+		restricted:   []string{NATUnrestricted},
+	}
+	// PolicyStrict only makes pairs whose NATs are known to be compatible,
+	// and gives every client an unrestricted proxy if there is one.
+	PolicyStrict = &MatchPolicy{
+		Name:         "strict",
+		unrestricted: []string{NATUnrestricted, NATRestricted},
+		restricted:   []string{NATUnrestricted},
+	}
+	// PolicyFallback is PolicyPreferRestricted, except that restricted
+	// clients fall back to a restricted proxy rather than getting none when
+	// no unrestricted proxy is left.
+	PolicyFallback = &MatchPolicy{
+		Name:         "fallback",
+		unrestricted: []string{NATRestricted, NATUnrestricted},
+		restricted:   []string{NATUnrestricted, NATRestricted},
+	}
+	// PolicyBarebones ignores NAT types altogether and gives every client
+	// any proxy, restricted ones first. It is only meant for experiments.
+	PolicyBarebones = &MatchPolicy{
+		Name:         "barebones",
+		unrestricted: []string{NATRestricted, NATUnrestricted},
+		restricted:   []string{NATRestricted, NATUnrestricted},
+	}
+)
+
+// DefaultMatchPolicy is the policy used unless another is chosen.
+var DefaultMatchPolicy = PolicyPreferRestricted
+
+var matchPolicies = map[string]*MatchPolicy{
+	PolicyPreferRestricted.Name: PolicyPreferRestricted,
+	PolicyStrict.Name:           PolicyStrict,
+	PolicyFallback.Name:         PolicyFallback,
+	PolicyBarebones.Name:        PolicyBarebones,
+}
+
+// ParseMatchPolicy returns the policy with the given name, or the default
+// policy if name is empty.
+func ParseMatchPolicy(name string) (*MatchPolicy, error) {
+	if name == "" {
+		return DefaultMatchPolicy, nil
+	}
+	if policy, ok := matchPolicies[name]; ok {
+		return policy, nil
+	}
+	var names []string
+	for name := range matchPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown matching policy %q: expected one of %s", name, strings.Join(names, ", "))
+}
+
+// Pools returns the NAT pools a client of the given NAT type takes its proxy
+// from, in order of preference. A nil policy is the default one.
+func (p *MatchPolicy) Pools(natType string) []string {
+	if p == nil {
+		p = DefaultMatchPolicy
+	}
+	if natType == NATUnrestricted {
+		return p.unrestricted
+	}
+	return p.restricted
+}
@@ -0,0 +1,92 @@
+package matchstore
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseMatchPolicy(t *testing.T) {
+	for name, expected := range map[string]*MatchPolicy{
+		"":                  PolicyPreferRestricted,
+		"prefer-restricted": PolicyPreferRestricted,
+		"strict":            PolicyStrict,
+		"fallback":          PolicyFallback,
+		"barebones":         PolicyBarebones,
+	} {
+		if policy, err := ParseMatchPolicy(name); err != nil || policy != expected {
+			t.Errorf("ParseMatchPolicy(%q): expected %s, got %v, %v", name, expected.Name, policy, err)
+		}
+	}
+	if _, err := ParseMatchPolicy("random"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+// TestRedisStoreMatchPolicies matches clients of every NAT type with every
+// combination of waiting proxies under each policy.
+func TestRedisStoreMatchPolicies(t *testing.T) {
+	r, u := NATRestricted, NATUnrestricted
+	for _, test := range []struct {
+		policy *MatchPolicy
+		client string
+		// pools the client may be matched from, in order of preference.
+		pools []string
+	}{
+		{PolicyPreferRestricted, NATUnrestricted, []string{r, u}},
+		{PolicyPreferRestricted, NATRestricted, []string{u}},
+		{PolicyPreferRestricted, NATUnknown, []string{u}},
+		{PolicyStrict, NATUnrestricted, []string{u, r}},
+		{PolicyStrict, NATRestricted, []string{u}},
+		{PolicyStrict, NATUnknown, []string{u}},
+		{PolicyFallback, NATUnrestricted, []string{r, u}},
+		{PolicyFallback, NATRestricted, []string{u, r}},
+		{PolicyFallback, NATUnknown, []string{u, r}},
+		{PolicyBarebones, NATUnrestricted, []string{r, u}},
+		{PolicyBarebones, NATRestricted, []string{r, u}},
+		{PolicyBarebones, NATUnknown, []string{r, u}},
+	} {
+		for _, proxies := range [][]string{
+			nil,
+			{NATRestricted},
+			{NATUnknown},
+			{NATUnrestricted},
+			{NATRestricted, NATUnrestricted},
+			{NATUnknown, NATUnrestricted},
+		} {
+			store, server := newTestStore(t)
+			store.Policy = test.policy
+			waiting := make(map[string]string)
+			for _, natType := range proxies {
+				id := "proxy-" + natType
+				server.HSet(proxyKey(id), "natType", natType)
+				server.ZAdd(waitingProxiesKey(natType), 0, id)
+				pool := NATRestricted
+				if natType == NATUnrestricted {
+					pool = NATUnrestricted
+				}
+				waiting[pool] = natType
+			}
+			var expected string
+			for _, pool := range test.pools {
+				if natType, ok := waiting[pool]; ok {
+					expected = natType
+					break
+				}
+			}
+
+			proxy, err := store.ClaimProxy(context.Background(), test.client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected == "" {
+				if proxy != nil {
+					t.Errorf("%s: %s client with %v proxies: expected no proxy, got %s",
+						test.policy.Name, test.client, proxies, proxy.NATType)
+				}
+			} else if proxy == nil || proxy.NATType != expected {
+				t.Errorf("%s: %s client with %v proxies: expected a %s proxy, got %+v",
+					test.policy.Name, test.client, proxies, expected, proxy)
+			}
+		}
+	}
+}
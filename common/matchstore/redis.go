@@ -0,0 +1,316 @@
+package matchstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// keyPrefix starts the names of all the keys of the store. Its hash tag puts
+// them in a single slot of a Redis cluster, since the scripts of a rendezvous
+// touch the pools along with the keys of a proxy.
+const keyPrefix = "{matchstore}:"
+
+// waitingProxiesKey is the sorted set of ids of proxies of a NAT pool waiting
+// for a client, scored by the number of clients each proxy already serves, so
+// that the least loaded proxies are claimed first, as with SnowflakeHeap.Less
+// in the broker. As in the broker's heaps, proxies whose NAT type is not known
+// to be unrestricted are kept in the restricted pool.
+func waitingProxiesKey(natType string) string {
+	if natType == NATUnrestricted {
+		return keyPrefix + "proxy_pool:" + NATUnrestricted
+	}
+	return keyPrefix + "proxy_pool:" + NATRestricted
+}
+
+// claimOrder lists the sorted sets a client of the given NAT type can be
+// matched from under policy, in order of preference.
+func claimOrder(policy *MatchPolicy, natType string) []string {
+	var keys []string
+	for _, pool := range policy.Pools(natType) {
+		keys = append(keys, waitingProxiesKey(pool))
+	}
+	return keys
+}
+
+// claimBatch is how many proxies of a pool ClaimProxy hands the claim script
+// at a time.
+const claimBatch = 16
+
+// abandonTimeout bounds the removal of a proxy that stopped waiting for its
+// offer because of an error.
+const abandonTimeout = time.Second
+
+// claimGracePeriod is how long a proxy that was claimed as it timed out keeps
+// waiting for the client offer.
+const claimGracePeriod = time.Second
+
+// proxyKey is the hash holding the poll information of a proxy.
+func proxyKey(id string) string {
+	return keyPrefix + "proxy:" + id
+}
+
+// offerQueueKey is the list on which a client offer is delivered to a proxy.
+func offerQueueKey(id string) string {
+	return keyPrefix + "client_offer_queue:" + id
+}
+
+// answerQueueKey is the list on which a proxy answer is returned to the client.
+func answerQueueKey(id string) string {
+	return keyPrefix + "answer_queue:" + id
+}
+
+// RedisStore is a MatchStore keeping its state in Redis, so that several
+// broker instances (or Lambda invocations) can match proxies and clients
+// with each other.
+type RedisStore struct {
+	client redis.UniversalClient
+
+	// ProxyTimeout is how long RegisterProxy waits for a client offer.
+	ProxyTimeout time.Duration
+	// AnswerTimeout is how long WaitForAnswer waits for the proxy's answer.
+	AnswerTimeout time.Duration
+	// Expiration is the lifetime of the keys of a single rendezvous.
+	Expiration time.Duration
+	// Policy decides which proxies clients are matched with.
+	Policy *MatchPolicy
+}
+
+func NewRedisStore(client redis.UniversalClient) *RedisStore {
+	return &RedisStore{
+		client:        client,
+		ProxyTimeout:  DefaultProxyTimeout,
+		AnswerTimeout: DefaultAnswerTimeout,
+		Expiration:    DefaultExpiration,
+		Policy:        DefaultMatchPolicy,
+	}
+}
+
+// add registers a proxy in its pool for lifetime, with a token to fetch its
+// offer with if not empty. A session id is only ever registered once at a
+// time, so that a poll cannot take over the offer or answer of a session that
+// is already waiting or matched.
+func (s *RedisStore) add(ctx context.Context, proxy *Proxy, token string, lifetime time.Duration) error {
+	added, err := register.Run(ctx, s.client,
+		[]string{proxyKey(proxy.ID), waitingProxiesKey(proxy.NATType)},
+		proxy.ID, proxy.ProxyType, proxy.NATType, proxy.Clients, token,
+		int64(lifetime/time.Second), proxy.Addr, proxy.RelayPattern).Int()
+	if err != nil {
+		return fmt.Errorf("failed to register proxy: %v", err)
+	}
+	if added == 0 {
+		return ErrProxyBusy
+	}
+	return nil
+}
+
+func (s *RedisStore) RegisterProxy(ctx context.Context, proxy *Proxy) (*Offer, error) {
+	// The registration lapses on its own soon after the proxy stops
+	// waiting, should it fail to unregister. Claiming it extends its
+	// lifetime.
+	if err := s.add(ctx, proxy, "", s.ProxyTimeout+claimGracePeriod); err != nil {
+		return nil, err
+	}
+
+	queue := offerQueueKey(proxy.ID)
+	result, err := s.client.BLPop(ctx, s.ProxyTimeout, queue).Result()
+	if errors.Is(err, redis.Nil) {
+		var removed int
+		removed, err = unregister.Run(ctx, s.client,
+			[]string{proxyKey(proxy.ID), waitingProxiesKey(proxy.NATType)}, proxy.ID).Int()
+		if err == nil && removed == 1 {
+			return nil, nil
+		}
+		if err == nil {
+			// A client claimed the proxy just as it timed out, and is
+			// about to deliver its offer.
+			result, err = s.client.BLPop(ctx, claimGracePeriod, queue).Result()
+			if errors.Is(err, redis.Nil) {
+				return nil, s.Expire(ctx, proxy)
+			}
+		}
+	}
+	if err != nil {
+		s.abandon(ctx, proxy)
+		return nil, fmt.Errorf("failed to retrieve client offer: %v", err)
+	}
+
+	// BLPOP returns the key followed by the popped value.
+	var offer Offer
+	if err := json.Unmarshal([]byte(result[1]), &offer); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal client offer: %v", err)
+	}
+	return &offer, nil
+}
+
+// abandon removes a proxy that stopped waiting for its offer because of an
+// error, so that no client is matched with it. It does so even if ctx was
+// cancelled, which is often why the proxy stopped waiting.
+func (s *RedisStore) abandon(ctx context.Context, proxy *Proxy) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abandonTimeout)
+	defer cancel()
+	if err := s.Expire(ctx, proxy); err != nil {
+		log.Printf("Failed to remove proxy %s that stopped waiting: %v", proxy.ID, err)
+	}
+}
+
+func (s *RedisStore) AddProxy(ctx context.Context, proxy *Proxy) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b[:])
+
+	// Nobody waits to unregister the proxy, so it lapses on its own.
+	// Claiming it extends its lifetime.
+	if err := s.add(ctx, proxy, token, s.ProxyTimeout); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *RedisStore) FetchOffer(ctx context.Context, id string, token string) (*Offer, error) {
+	result, err := fetchOffer.Run(ctx, s.client,
+		[]string{proxyKey(id), offerQueueKey(id)}, token).Text()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrProxyGone
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to fetch client offer: %v", err)
+	}
+	if result == "" {
+		return nil, nil
+	}
+
+	var offer Offer
+	if err := json.Unmarshal([]byte(result), &offer); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal client offer: %v", err)
+	}
+	return &offer, nil
+}
+
+// ClaimProxy goes through the pools in order, handing the least loaded proxies
+// of each to the claim script a batch at a time, so that the script is given
+// the keys of every proxy it may claim.
+func (s *RedisStore) ClaimProxy(ctx context.Context, natType string) (*Proxy, error) {
+	hosts := RelayHosts(ctx)
+	for _, pool := range claimOrder(s.Policy, natType) {
+		var start int64
+		for {
+			ids, err := s.client.ZRange(ctx, pool, start, start+claimBatch-1).Result()
+			if err != nil {
+				return nil, fmt.Errorf("failed to claim proxy: %v", err)
+			}
+			if len(ids) == 0 {
+				break
+			}
+			keys := []string{pool}
+			args := []interface{}{s.expirationSeconds(), len(ids)}
+			for _, id := range ids {
+				keys = append(keys, proxyKey(id))
+				args = append(args, id)
+			}
+			for _, host := range hosts {
+				args = append(args, host)
+			}
+			result, err := claim.Run(ctx, s.client, keys, args...).Result()
+			if err != nil {
+				return nil, fmt.Errorf("failed to claim proxy: %v", err)
+			}
+			switch result := result.(type) {
+			case []interface{}:
+				return claimedProxy(result), nil
+			case int64:
+				// The candidates still waiting were passed over.
+				start += result
+			}
+			if len(ids) < claimBatch {
+				break
+			}
+		}
+	}
+	return nil, nil
+}
+
+// claimedProxy returns the proxy whose id and poll fields the claim script
+// returned.
+func claimedProxy(reply []interface{}) *Proxy {
+	fields := make([]string, len(reply))
+	for i, field := range reply {
+		fields[i], _ = field.(string)
+	}
+	clients, _ := strconv.Atoi(fields[3])
+	return &Proxy{
+		ID:           fields[0],
+		ProxyType:    fields[1],
+		NATType:      fields[2],
+		Clients:      clients,
+		Addr:         fields[4],
+		RelayPattern: fields[5],
+	}
+}
+
+func (s *RedisStore) DeliverOffer(ctx context.Context, proxy *Proxy, offer *Offer) error {
+	offerJSON, err := json.Marshal(offer)
+	if err != nil {
+		return fmt.Errorf("failed to marshal client offer: %v", err)
+	}
+
+	delivered, err := deliverOffer.Run(ctx, s.client,
+		[]string{proxyKey(proxy.ID), offerQueueKey(proxy.ID)},
+		offerJSON, s.expirationSeconds()).Int()
+	if err != nil {
+		return fmt.Errorf("failed to deliver offer to proxy %s: %v", proxy.ID, err)
+	}
+	if delivered == 0 {
+		return ErrProxyGone
+	}
+	return nil
+}
+
+func (s *RedisStore) WaitForAnswer(ctx context.Context, proxy *Proxy) (string, error) {
+	result, err := s.client.BLPop(ctx, s.AnswerTimeout, answerQueueKey(proxy.ID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrTimeout
+	} else if err != nil {
+		return "", fmt.Errorf("failed to retrieve proxy answer: %v", err)
+	}
+	return result[1], nil
+}
+
+func (s *RedisStore) DeliverAnswer(ctx context.Context, id string, answer string) error {
+	delivered, err := deliverAnswer.Run(ctx, s.client,
+		[]string{proxyKey(id), answerQueueKey(id)},
+		answer, s.expirationSeconds()).Int()
+	if err != nil {
+		return fmt.Errorf("failed to deliver answer of proxy %s: %v", id, err)
+	}
+	if delivered == 0 {
+		return ErrClientGone
+	}
+	return nil
+}
+
+func (s *RedisStore) Expire(ctx context.Context, proxy *Proxy) error {
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, proxyKey(proxy.ID), offerQueueKey(proxy.ID), answerQueueKey(proxy.ID))
+		pipe.ZRem(ctx, waitingProxiesKey(proxy.NATType), proxy.ID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to expire proxy %s: %v", proxy.ID, err)
+	}
+	return nil
+}
+
+// expirationSeconds is the Expiration as a script argument.
+func (s *RedisStore) expirationSeconds() int64 {
+	return int64(s.Expiration / time.Second)
+}
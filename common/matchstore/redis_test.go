@@ -0,0 +1,561 @@
+package matchstore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestStore returns a store on a miniredis server, which runs the Lua
+// scripts of the store.
+func newTestStore(t *testing.T) (*RedisStore, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	// Each proxy waiting for a client holds a connection.
+	client := redis.NewClient(&redis.Options{Addr: server.Addr(), PoolSize: 128})
+	t.Cleanup(func() { client.Close() })
+
+	store := NewRedisStore(client)
+	store.ProxyTimeout = time.Second
+	store.AnswerTimeout = time.Second
+	return store, server
+}
+
+// waitForProxy waits until n proxies of the given NAT type are waiting for a
+// client.
+func waitForProxy(t *testing.T, server *miniredis.Miniredis, natType string, n int) {
+	for i := 0; i < 100; i++ {
+		// Redis deletes empty pools, which ZMembers reports as an error.
+		if members, _ := server.ZMembers(waitingProxiesKey(natType)); len(members) == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d waiting proxies", n)
+}
+
+func TestRedisStoreRendezvous(t *testing.T) {
+	store, server := newTestStore(t)
+	ctx := context.Background()
+
+	type result struct {
+		offer *Offer
+		err   error
+	}
+	polled := make(chan result)
+	go func() {
+		offer, err := store.RegisterProxy(ctx, &Proxy{ID: "sid", ProxyType: "standalone", NATType: "restricted", Clients: 2, Addr: "192.0.2.1", RelayPattern: "snowflake.torproject.net$"})
+		polled <- result{offer, err}
+	}()
+	waitForProxy(t, server, NATRestricted, 1)
+
+	proxy, err := store.ClaimProxy(ctx, "unrestricted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy == nil {
+		t.Fatal("no proxy claimed")
+	}
+	if proxy.ID != "sid" || proxy.ProxyType != "standalone" || proxy.NATType != "restricted" || proxy.Clients != 2 || proxy.Addr != "192.0.2.1" || proxy.RelayPattern != "snowflake.torproject.net$" {
+		t.Fatalf("unexpected proxy %+v", proxy)
+	}
+
+	offer := &Offer{NATType: "unrestricted", SDP: []byte("fake offer"), Fingerprint: []byte("fingerprint")}
+	if err := store.DeliverOffer(ctx, proxy, offer); err != nil {
+		t.Fatal(err)
+	}
+	r := <-polled
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.offer == nil || string(r.offer.SDP) != "fake offer" || r.offer.NATType != "unrestricted" || string(r.offer.Fingerprint) != "fingerprint" {
+		t.Fatalf("unexpected offer %+v", r.offer)
+	}
+
+	if err := store.DeliverAnswer(ctx, "sid", "fake answer"); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := store.WaitForAnswer(ctx, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != "fake answer" {
+		t.Fatalf("unexpected answer %q", answer)
+	}
+
+	if err := store.Expire(ctx, proxy); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeliverAnswer(ctx, "sid", "late answer"); err != ErrClientGone {
+		t.Fatalf("expected ErrClientGone, got %v", err)
+	}
+}
+
+func TestRedisStoreTimeouts(t *testing.T) {
+	store, server := newTestStore(t)
+	ctx := context.Background()
+
+	proxy, err := store.ClaimProxy(ctx, "unrestricted")
+	if err != nil || proxy != nil {
+		t.Fatalf("expected no proxy, got %v, %v", proxy, err)
+	}
+
+	offer, err := store.RegisterProxy(ctx, &Proxy{ID: "sid", NATType: "unrestricted"})
+	if err != nil || offer != nil {
+		t.Fatalf("expected no offer, got %v, %v", offer, err)
+	}
+	waitForProxy(t, server, NATUnrestricted, 0)
+	if server.Exists(proxyKey("sid")) {
+		t.Fatal("timed out proxy was not expired")
+	}
+
+	_, err = store.WaitForAnswer(ctx, &Proxy{ID: "sid"})
+	if err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if err := store.DeliverAnswer(ctx, "unknown", "answer"); err != ErrClientGone {
+		t.Fatalf("expected ErrClientGone, got %v", err)
+	}
+}
+
+func TestRedisStoreCancelledProxy(t *testing.T) {
+	store, server := newTestStore(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	polled := make(chan error)
+	go func() {
+		_, err := store.RegisterProxy(ctx, &Proxy{ID: "sid", NATType: NATUnrestricted})
+		polled <- err
+	}()
+	waitForProxy(t, server, NATUnrestricted, 1)
+	// Should it fail to unregister, a waiting proxy lapses soon after it
+	// stops waiting.
+	if ttl := server.TTL(proxyKey("sid")); ttl > store.ProxyTimeout+claimGracePeriod {
+		t.Errorf("waiting proxy expires in %v", ttl)
+	}
+
+	// A proxy whose request is cancelled is not handed to clients.
+	cancel()
+	if err := <-polled; err == nil {
+		t.Fatal("expected an error for a cancelled poll")
+	}
+	if server.Exists(proxyKey("sid")) {
+		t.Error("cancelled proxy is still registered")
+	}
+	proxy, err := store.ClaimProxy(context.Background(), NATUnrestricted)
+	if err != nil || proxy != nil {
+		t.Fatalf("expected no proxy, got %v, %v", proxy, err)
+	}
+}
+
+func TestRedisStoreExpiredProxy(t *testing.T) {
+	store, server := newTestStore(t)
+	ctx := context.Background()
+
+	// A proxy that gave up waiting before it was claimed is never handed out.
+	offer, err := store.RegisterProxy(ctx, &Proxy{ID: "gone", NATType: "unrestricted"})
+	if err != nil || offer != nil {
+		t.Fatalf("expected no offer, got %v, %v", offer, err)
+	}
+	server.ZAdd(waitingProxiesKey(NATUnrestricted), 0, "gone")
+	proxy, err := store.ClaimProxy(ctx, "unrestricted")
+	if err != nil || proxy != nil {
+		t.Fatalf("expected no proxy, got %v, %v", proxy, err)
+	}
+
+	// Offers to a proxy that was expired after it was claimed are refused.
+	err = store.DeliverOffer(ctx, &Proxy{ID: "gone"}, &Offer{SDP: []byte("fake offer")})
+	if err != ErrProxyGone {
+		t.Fatalf("expected ErrProxyGone, got %v", err)
+	}
+}
+
+func TestRedisStoreClaimedAsProxyTimesOut(t *testing.T) {
+	store, server := newTestStore(t)
+	ctx := context.Background()
+
+	polled := make(chan *Offer)
+	go func() {
+		offer, err := store.RegisterProxy(ctx, &Proxy{ID: "sid", NATType: "unrestricted"})
+		if err != nil {
+			t.Error(err)
+		}
+		polled <- offer
+	}()
+	waitForProxy(t, server, NATUnrestricted, 1)
+
+	proxy, err := store.ClaimProxy(ctx, "unrestricted")
+	if err != nil || proxy == nil {
+		t.Fatalf("expected a proxy, got %v, %v", proxy, err)
+	}
+	// Deliver the offer only after the proxy's poll has timed out.
+	time.Sleep(store.ProxyTimeout + claimGracePeriod/2)
+	if err := store.DeliverOffer(ctx, proxy, &Offer{SDP: []byte("fake offer")}); err != nil {
+		t.Fatal(err)
+	}
+	if offer := <-polled; offer == nil || string(offer.SDP) != "fake offer" {
+		t.Fatalf("offer was lost, got %v", offer)
+	}
+}
+
+// TestRedisStoreConcurrentMatching has clients race against proxies timing
+// out and checks that every offer a client managed to deliver reaches its
+// proxy.
+func TestRedisStoreConcurrentMatching(t *testing.T) {
+	store, _ := newTestStore(t)
+	ctx := context.Background()
+
+	const numProxies = 40
+	const numClients = 60
+
+	var wg sync.WaitGroup
+	received := make(chan string, numProxies)
+	for i := 0; i < numProxies; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("proxy%d", i)
+			offer, err := store.RegisterProxy(ctx, &Proxy{ID: id, NATType: "unrestricted"})
+			if err != nil {
+				t.Error(err)
+			}
+			if offer != nil {
+				received <- string(offer.SDP)
+			}
+		}(i)
+	}
+
+	delivered := make(chan string, numClients)
+	for i := 0; i < numClients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Spread the clients around the moment the proxies time out.
+			time.Sleep(time.Duration(i) * 2 * store.ProxyTimeout / numClients)
+			proxy, err := store.ClaimProxy(ctx, "unrestricted")
+			if err != nil {
+				t.Error(err)
+			}
+			if proxy == nil {
+				return
+			}
+			sdp := fmt.Sprintf("offer%d", i)
+			err = store.DeliverOffer(ctx, proxy, &Offer{SDP: []byte(sdp)})
+			if err == nil {
+				delivered <- sdp
+			} else if err != ErrProxyGone {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(received)
+	close(delivered)
+
+	offers := make(map[string]bool)
+	for sdp := range received {
+		offers[sdp] = true
+	}
+	n := 0
+	for sdp := range delivered {
+		n++
+		if !offers[sdp] {
+			t.Errorf("%s was delivered but never received", sdp)
+		}
+	}
+	if n != len(offers) {
+		t.Errorf("%d offers delivered, %d received", n, len(offers))
+	}
+}
+
+func TestRedisStoreNATPools(t *testing.T) {
+	for _, test := range []struct {
+		client  string
+		proxies []string
+		matched string
+	}{
+		{NATUnrestricted, []string{NATUnrestricted, NATRestricted}, NATRestricted},
+		{NATUnrestricted, []string{NATUnrestricted}, NATUnrestricted},
+		{NATUnrestricted, []string{NATUnknown}, NATUnknown},
+		{NATRestricted, []string{NATRestricted, NATUnrestricted}, NATUnrestricted},
+		{NATRestricted, []string{NATRestricted, NATUnknown}, ""},
+		{NATUnknown, []string{NATRestricted, NATUnrestricted}, NATUnrestricted},
+		{NATUnknown, []string{NATUnknown}, ""},
+	} {
+		store, server := newTestStore(t)
+		ctx := context.Background()
+
+		for _, natType := range test.proxies {
+			id := "proxy-" + natType
+			server.HSet(proxyKey(id), "natType", natType)
+			server.ZAdd(waitingProxiesKey(natType), 0, id)
+		}
+
+		proxy, err := store.ClaimProxy(ctx, test.client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.matched == "" {
+			if proxy != nil {
+				t.Errorf("%s client: expected no proxy, got %s", test.client, proxy.NATType)
+			}
+		} else if proxy == nil || proxy.NATType != test.matched {
+			t.Errorf("%s client with %v proxies: expected a %s proxy, got %+v", test.client, test.proxies, test.matched, proxy)
+		}
+	}
+}
+
+func TestRedisStoreLeastLoaded(t *testing.T) {
+	store, server := newTestStore(t)
+	ctx := context.Background()
+
+	for _, proxy := range []*Proxy{
+		{ID: "busy", NATType: NATUnrestricted, Clients: 16},
+		{ID: "idle", NATType: NATUnrestricted, Clients: 0},
+		{ID: "some", NATType: NATUnrestricted, Clients: 8},
+	} {
+		if _, err := store.AddProxy(ctx, proxy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForProxy(t, server, NATUnrestricted, 3)
+
+	for _, expected := range []string{"idle", "some", "busy"} {
+		proxy, err := store.ClaimProxy(ctx, NATRestricted)
+		if err != nil || proxy == nil {
+			t.Fatalf("expected a proxy, got %v, %v", proxy, err)
+		}
+		if proxy.ID != expected {
+			t.Errorf("expected %s proxy to be claimed, got %s", expected, proxy.ID)
+		}
+	}
+}
+
+func TestRedisStoreRelayPattern(t *testing.T) {
+	store, server := newTestStore(t)
+	ctx := context.Background()
+
+	for _, proxy := range []*Proxy{
+		{ID: "exact", NATType: NATUnrestricted, Clients: 0, RelayPattern: "^snowflake.torproject.net$"},
+		{ID: "suffix", NATType: NATUnrestricted, Clients: 1, RelayPattern: "snowflake.example$"},
+		{ID: "any", NATType: NATUnrestricted, Clients: 2},
+	} {
+		if _, err := store.AddProxy(ctx, proxy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForProxy(t, server, NATUnrestricted, 3)
+
+	// The proxies passed over stay in their pool, in the same order.
+	for _, test := range []struct {
+		hosts    []string
+		expected string
+	}{
+		{[]string{"01.snowflake.example"}, "suffix"},
+		{[]string{"snowflake.torproject.org"}, "any"},
+		{[]string{"02.snowflake.example", "snowflake.torproject.net"}, "exact"},
+	} {
+		proxy, err := store.ClaimProxy(WithRelayHosts(ctx, test.hosts), NATRestricted)
+		if err != nil || proxy == nil {
+			t.Fatalf("expected a proxy for %v, got %v, %v", test.hosts, proxy, err)
+		}
+		if proxy.ID != test.expected {
+			t.Errorf("expected %s proxy to be claimed for %v, got %s", test.expected, test.hosts, proxy.ID)
+		}
+	}
+	if proxy, err := store.ClaimProxy(ctx, NATRestricted); err != nil || proxy != nil {
+		t.Fatalf("expected no proxy left, got %v, %v", proxy, err)
+	}
+}
+
+func TestRedisStoreClaimBatches(t *testing.T) {
+	store, server := newTestStore(t)
+	ctx := context.Background()
+
+	// More proxies than a batch are passed over before the one that
+	// accepts the relay, and stay in their pool.
+	for i := 0; i < 2*claimBatch; i++ {
+		proxy := &Proxy{ID: fmt.Sprintf("other-%d", i), NATType: NATUnrestricted, RelayPattern: "^other.example$"}
+		if _, err := store.AddProxy(ctx, proxy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.AddProxy(ctx, &Proxy{ID: "accepting", NATType: NATUnrestricted, Clients: 1}); err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := store.ClaimProxy(WithRelayHosts(ctx, []string{"snowflake.torproject.net"}), NATUnrestricted)
+	if err != nil || proxy == nil || proxy.ID != "accepting" {
+		t.Fatalf("expected the accepting proxy, got %v, %v", proxy, err)
+	}
+	waitForProxy(t, server, NATUnrestricted, 2*claimBatch)
+}
+
+func TestRedisStoreKeysShareSlot(t *testing.T) {
+	// The scripts touch the pools along with the keys of proxies, which
+	// must all be in one slot of a Redis cluster.
+	for _, key := range []string{
+		waitingProxiesKey(NATUnrestricted),
+		waitingProxiesKey(NATRestricted),
+		proxyKey("sid"),
+		offerQueueKey("sid"),
+		answerQueueKey("sid"),
+	} {
+		if !strings.HasPrefix(key, "{matchstore}") {
+			t.Errorf("key %q is not in the {matchstore} slot", key)
+		}
+	}
+}
+
+// TestRedisStoreRelayPatternMatcher checks that the claim script matches relay
+// patterns as AcceptsRelay, and so namematcher, does.
+func TestRedisStoreRelayPatternMatcher(t *testing.T) {
+	ctx := context.Background()
+	for _, pattern := range []string{
+		"",
+		"$",
+		"^",
+		"^$",
+		"snowflake.torproject.net$",
+		"^snowflake.torproject.net$",
+		"torproject.net$",
+		"^torproject.net$",
+		"Snowflake.torproject.net$",
+		"snowflake.torproject.net",
+		"snowflake.torproject.net$$",
+		"a%.b$",
+	} {
+		for _, hosts := range [][]string{
+			{"snowflake.torproject.net"},
+			{"01.snowflake.torproject.net"},
+			{"snowflake.torproject.net.example"},
+			{"SNOWFLAKE.TORPROJECT.NET"},
+			{"net"},
+			{""},
+			{"a%.b", "axb"},
+			{"snowflake.example", "snowflake.torproject.net"},
+		} {
+			store, _ := newTestStore(t)
+			if _, err := store.AddProxy(ctx, &Proxy{ID: "sid", NATType: NATUnrestricted, RelayPattern: pattern}); err != nil {
+				t.Fatal(err)
+			}
+			proxy, err := store.ClaimProxy(WithRelayHosts(ctx, hosts), NATUnrestricted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := AcceptsRelay(pattern, hosts); (proxy != nil) != expected {
+				t.Errorf("pattern %q, hosts %q: expected the proxy to be claimed: %v, got %v", pattern, hosts, expected, proxy != nil)
+			}
+		}
+	}
+}
+
+func TestRedisStoreDuplicateSession(t *testing.T) {
+	store, server := newTestStore(t)
+	ctx := context.Background()
+
+	polled := make(chan *Offer)
+	go func() {
+		offer, err := store.RegisterProxy(ctx, &Proxy{ID: "sid", NATType: NATUnrestricted})
+		if err != nil {
+			t.Error(err)
+		}
+		polled <- offer
+	}()
+	waitForProxy(t, server, NATUnrestricted, 1)
+
+	// A second poll of the same session can neither wait alongside the
+	// first one nor take over its registration.
+	if _, err := store.RegisterProxy(ctx, &Proxy{ID: "sid", NATType: NATUnrestricted}); err != ErrProxyBusy {
+		t.Fatalf("expected ErrProxyBusy, got %v", err)
+	}
+	if _, err := store.AddProxy(ctx, &Proxy{ID: "sid", NATType: NATRestricted}); err != ErrProxyBusy {
+		t.Fatalf("expected ErrProxyBusy, got %v", err)
+	}
+
+	proxy, err := store.ClaimProxy(ctx, NATRestricted)
+	if err != nil || proxy == nil {
+		t.Fatalf("expected a proxy, got %v, %v", proxy, err)
+	}
+	if err := store.DeliverOffer(ctx, proxy, &Offer{SDP: []byte("fake offer")}); err != nil {
+		t.Fatal(err)
+	}
+	if offer := <-polled; offer == nil {
+		t.Fatal("offer was lost")
+	}
+
+	// Nor can it while the session is matched.
+	if _, err := store.AddProxy(ctx, &Proxy{ID: "sid", NATType: NATUnrestricted}); err != ErrProxyBusy {
+		t.Fatalf("expected ErrProxyBusy, got %v", err)
+	}
+	go store.DeliverAnswer(ctx, "sid", "fake answer")
+	if answer, err := store.WaitForAnswer(ctx, proxy); err != nil || answer != "fake answer" {
+		t.Fatalf("expected the answer, got %q, %v", answer, err)
+	}
+
+	// Once the rendezvous is over, the id can be used again.
+	if err := store.Expire(ctx, proxy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AddProxy(ctx, &Proxy{ID: "sid", NATType: NATUnrestricted}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisStoreNonBlocking(t *testing.T) {
+	store, server := newTestStore(t)
+	ctx := context.Background()
+	var _ NonBlockingStore = store
+
+	token, err := store.AddProxy(ctx, &Proxy{ID: "sid", ProxyType: "standalone", NATType: NATUnrestricted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := store.FetchOffer(ctx, "sid", token)
+	if err != nil || offer != nil {
+		t.Fatalf("expected no offer yet, got %v, %v", offer, err)
+	}
+	if _, err := store.FetchOffer(ctx, "sid", "wrong token"); err != ErrProxyGone {
+		t.Fatalf("expected ErrProxyGone for a wrong token, got %v", err)
+	}
+
+	proxy, err := store.ClaimProxy(ctx, NATRestricted)
+	if err != nil || proxy == nil || proxy.ID != "sid" {
+		t.Fatalf("expected to claim the proxy, got %v, %v", proxy, err)
+	}
+	// The registration outlives its timeout once it is claimed.
+	if ttl := server.TTL(proxyKey("sid")); ttl <= store.ProxyTimeout {
+		t.Fatalf("claimed proxy expires in %v", ttl)
+	}
+	if err := store.DeliverOffer(ctx, proxy, &Offer{SDP: []byte("fake offer")}); err != nil {
+		t.Fatal(err)
+	}
+	offer, err = store.FetchOffer(ctx, "sid", token)
+	if err != nil || offer == nil || string(offer.SDP) != "fake offer" {
+		t.Fatalf("expected the offer, got %v, %v", offer, err)
+	}
+
+	go store.DeliverAnswer(ctx, "sid", "fake answer")
+	answer, err := store.WaitForAnswer(ctx, proxy)
+	if err != nil || answer != "fake answer" {
+		t.Fatalf("expected the answer, got %q, %v", answer, err)
+	}
+
+	// Unclaimed registrations lapse after the proxy timeout.
+	token, err = store.AddProxy(ctx, &Proxy{ID: "lapsed", NATType: NATUnrestricted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// miniredis only expires keys when its clock is moved.
+	server.FastForward(store.ProxyTimeout)
+	if _, err := store.FetchOffer(ctx, "lapsed", token); err != ErrProxyGone {
+		t.Fatalf("expected ErrProxyGone, got %v", err)
+	}
+	if proxy, err := store.ClaimProxy(ctx, NATRestricted); err != nil || proxy != nil {
+		t.Fatalf("expected no proxy, got %v, %v", proxy, err)
+	}
+}
@@ -0,0 +1,155 @@
+package matchstore
+
+import "github.com/go-redis/redis/v8"
+
+// The steps of a rendezvous that involve both a proxy and a client run as Lua
+// scripts, so that Redis carries each of them out atomically: a proxy that has
+// given up waiting can no longer be claimed, and a claimed proxy no longer gives
+// up. The proxy hash gets a "claimed" field once a client has taken it out of
+// its pool, and a "matched" field once its offer has been delivered.
+//
+// The scripts only touch the keys they are given, and all the keys of the
+// store share a hash tag, so that they also run on a Redis cluster.
+
+// registerScript adds a proxy to its pool, unless a proxy with the same id is
+// already registered. The proxy is scored by its number of clients.
+//
+// KEYS[1]: proxy hash, KEYS[2]: pool. ARGV[1]: proxy id, ARGV[2]: proxy type,
+// ARGV[3]: NAT type, ARGV[4]: clients, ARGV[5]: registration token or empty,
+// ARGV[6]: lifetime in seconds, ARGV[7]: proxy address, ARGV[8]: relay
+// pattern.
+const registerScript = `
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'proxyType', ARGV[2], 'natType', ARGV[3], 'clients', ARGV[4], 'addr', ARGV[7], 'relayPattern', ARGV[8])
+if ARGV[5] ~= '' then
+	redis.call('HSET', KEYS[1], 'token', ARGV[5])
+end
+redis.call('EXPIRE', KEYS[1], ARGV[6])
+redis.call('ZADD', KEYS[2], ARGV[4], ARGV[1])
+return 1
+`
+
+// claimScript claims the first of the candidate proxies of a pool, in order,
+// that is still waiting and accepts one of the relay host names, if any are
+// given: it takes the proxy out of its pool, marks it as claimed and returns
+// its id and poll fields. Candidates that are no longer registered, or were
+// claimed already, are taken out of the pool; those passed over for their
+// relay pattern stay in it. If no candidate is claimed, it returns the number
+// of candidates that are still waiting. Relay patterns are matched as by
+// namematcher.NameMatcher.IsMember.
+//
+// KEYS[1]: pool, KEYS[2:]: proxy hashes of the candidates. ARGV[1]:
+// expiration in seconds, ARGV[2]: number n of candidates, ARGV[3:n+2]: ids of
+// the candidates, ARGV[n+3:]: relay host names.
+const claimScript = `
+local n = tonumber(ARGV[2])
+
+local function accepts(pattern)
+	if #ARGV < n + 3 then
+		return true
+	end
+	pattern = string.gsub(pattern, '%$$', '')
+	local exact = string.sub(pattern, 1, 1) == '^'
+	if exact then
+		pattern = string.sub(pattern, 2)
+	end
+	for i = n + 3, #ARGV do
+		local host = ARGV[i]
+		if host == pattern or (not exact and (pattern == '' or string.sub(host, -#pattern) == pattern)) then
+			return true
+		end
+	end
+	return false
+end
+
+local waiting = 0
+for i = 1, n do
+	local id = ARGV[i + 2]
+	local key = KEYS[i + 1]
+	if redis.call('ZSCORE', KEYS[1], id) then
+		if redis.call('EXISTS', key) == 0 or redis.call('HEXISTS', key, 'claimed') == 1 then
+			redis.call('ZREM', KEYS[1], id)
+		else
+			local fields = redis.call('HMGET', key, 'proxyType', 'natType', 'clients', 'addr', 'relayPattern')
+			if accepts(fields[5] or '') then
+				redis.call('ZREM', KEYS[1], id)
+				redis.call('HSET', key, 'claimed', '1')
+				redis.call('EXPIRE', key, ARGV[1])
+				return {id, fields[1] or '', fields[2] or '', fields[3] or '', fields[4] or '', fields[5] or ''}
+			end
+			waiting = waiting + 1
+		end
+	end
+end
+return waiting
+`
+
+// deliverOfferScript queues a client offer for a proxy, unless the proxy was
+// not claimed or has been expired since.
+//
+// KEYS[1]: proxy hash, KEYS[2]: offer queue. ARGV[1]: offer, ARGV[2]:
+// expiration in seconds.
+const deliverOfferScript = `
+if redis.call('HEXISTS', KEYS[1], 'claimed') == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'matched', '1')
+redis.call('EXPIRE', KEYS[1], ARGV[2])
+redis.call('RPUSH', KEYS[2], ARGV[1])
+redis.call('EXPIRE', KEYS[2], ARGV[2])
+return 1
+`
+
+// unregisterScript removes a proxy that has timed out from its pool, unless a
+// client has claimed it in the meantime.
+//
+// KEYS[1]: proxy hash, KEYS[2]: pool. ARGV[1]: proxy id.
+const unregisterScript = `
+if redis.call('HEXISTS', KEYS[1], 'claimed') == 1 then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+return 1
+`
+
+// deliverAnswerScript queues a proxy answer for the client, unless the client
+// has stopped waiting for it.
+//
+// KEYS[1]: proxy hash, KEYS[2]: answer queue. ARGV[1]: answer, ARGV[2]:
+// expiration in seconds.
+const deliverAnswerScript = `
+if redis.call('HEXISTS', KEYS[1], 'matched') == 0 then
+	return 0
+end
+redis.call('RPUSH', KEYS[2], ARGV[1])
+redis.call('EXPIRE', KEYS[2], ARGV[2])
+return 1
+`
+
+// fetchOfferScript pops the offer queued for a registered proxy, if any.
+// It returns false if the registration is gone or the token does not match,
+// and an empty string if no offer was delivered yet.
+//
+// KEYS[1]: proxy hash, KEYS[2]: offer queue. ARGV[1]: registration token.
+const fetchOfferScript = `
+if redis.call('HGET', KEYS[1], 'token') ~= ARGV[1] then
+	return false
+end
+local offer = redis.call('LPOP', KEYS[2])
+if not offer then
+	return ''
+end
+return offer
+`
+
+var (
+	register      = redis.NewScript(registerScript)
+	claim         = redis.NewScript(claimScript)
+	deliverOffer  = redis.NewScript(deliverOfferScript)
+	unregister    = redis.NewScript(unregisterScript)
+	deliverAnswer = redis.NewScript(deliverAnswerScript)
+	fetchOffer    = redis.NewScript(fetchOfferScript)
+)
@@ -22,6 +22,9 @@ var (
 	ErrBadRequest = errors.New("bad request")
 	ErrInternal   = errors.New("internal error")
 	ErrExtraInfo  = errors.New("client sent extra info")
+	// ErrRateLimited is returned for requests beyond the rate limit of
+	// their endpoint.
+	ErrRateLimited = errors.New("rate limited")
 
 	StrTimedOut  = "timed out waiting for answer!"
 	StrNoProxies = "no snowflake proxies currently available"
@@ -222,6 +222,94 @@ func TestEncodeProxyPollResponseWithProxyURL(t *testing.T) {
 		So(err.Error(), ShouldContainSubstring, "test error reason")
 	})
 }
+
+func TestProxyPollRegistration(t *testing.T) {
+	Convey("Context", t, func() {
+		b, err := EncodeProxyPollRequestWithToken("ymbcCMto7KHNGYlp", "standalone", "restricted", 8, "snowflake.torproject.net$", "")
+		So(err, ShouldBeNil)
+		sid, proxyType, natType, clients, relayPattern, _, err := DecodeProxyPollRequestWithRelayPrefix(b)
+		So(err, ShouldBeNil)
+		So(sid, ShouldEqual, "ymbcCMto7KHNGYlp")
+		So(proxyType, ShouldEqual, "standalone")
+		So(natType, ShouldEqual, "restricted")
+		So(clients, ShouldEqual, 8)
+		So(relayPattern, ShouldEqual, "snowflake.torproject.net$")
+		registration, token, err := DecodeProxyPollToken(b)
+		So(err, ShouldBeNil)
+		So(registration, ShouldBeTrue)
+		So(token, ShouldEqual, "")
+
+		b, err = EncodeProxyPollRequestWithToken("ymbcCMto7KHNGYlp", "standalone", "restricted", 8, "", "fake token")
+		So(err, ShouldBeNil)
+		registration, token, err = DecodeProxyPollToken(b)
+		So(err, ShouldBeNil)
+		So(registration, ShouldBeTrue)
+		So(token, ShouldEqual, "fake token")
+
+		// Older proxies only understand offers
+		b, err = EncodeProxyPollRequestWithRelayPrefix("ymbcCMto7KHNGYlp", "standalone", "restricted", 8, "")
+		So(err, ShouldBeNil)
+		registration, _, err = DecodeProxyPollToken(b)
+		So(err, ShouldBeNil)
+		So(registration, ShouldBeFalse)
+		registration, _, err = DecodeProxyPollToken([]byte(`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.10"}`))
+		So(err, ShouldBeNil)
+		So(registration, ShouldBeTrue)
+
+		b, err = EncodePollResponseWithToken("fake token")
+		So(err, ShouldBeNil)
+		offer, _, _, token, err := DecodePollResponseWithToken(b)
+		So(err, ShouldBeNil)
+		So(offer, ShouldEqual, "")
+		So(token, ShouldEqual, "fake token")
+
+		b, err = EncodePollResponseWithRelayURL("fake offer", true, "restricted", "wss://test/", "")
+		So(err, ShouldBeNil)
+		offer, natType, relay, token, err := DecodePollResponseWithToken(b)
+		So(err, ShouldBeNil)
+		So(offer, ShouldEqual, "fake offer")
+		So(natType, ShouldEqual, "restricted")
+		So(relay, ShouldEqual, "wss://test/")
+		So(token, ShouldEqual, "")
+
+		b, err = EncodePollResponse("", false, "unknown")
+		So(err, ShouldBeNil)
+		offer, _, _, token, err = DecodePollResponseWithToken(b)
+		So(err, ShouldBeNil)
+		So(offer, ShouldEqual, "")
+		So(token, ShouldEqual, "")
+
+		_, _, _, _, err = DecodePollResponseWithToken([]byte(`{"Status":"registered"}`))
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestProxySignalingMessage(t *testing.T) {
+	Convey("Context", t, func() {
+		poll, err := EncodeProxyPollRequestWithRelayPrefix("ymbcCMto7KHNGYlp", "standalone", "restricted", 8, "")
+		So(err, ShouldBeNil)
+		b, err := EncodeProxySignalingMessage(ProxySignalingPoll, poll, nil)
+		So(err, ShouldBeNil)
+		kind, body, err := DecodeProxySignalingMessage(b)
+		So(err, ShouldBeNil)
+		So(kind, ShouldEqual, ProxySignalingPoll)
+		So(body, ShouldResemble, poll)
+
+		b, err = EncodeProxySignalingMessage(ProxySignalingAnswer, nil, ErrBadRequest)
+		So(err, ShouldBeNil)
+		kind, body, err = DecodeProxySignalingMessage(b)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, ErrBadRequest.Error())
+		So(kind, ShouldEqual, ProxySignalingAnswer)
+		So(body, ShouldBeNil)
+
+		_, _, err = DecodeProxySignalingMessage([]byte(`{"Type":"offer","Body":{}}`))
+		So(err, ShouldNotBeNil)
+		_, _, err = DecodeProxySignalingMessage([]byte(`not json`))
+		So(err, ShouldNotBeNil)
+	})
+}
+
 func TestDecodeProxyAnswerRequest(t *testing.T) {
 	Convey("Context", t, func() {
 		for _, test := range []struct {
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
 
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/nat"
@@ -16,6 +17,10 @@ import (
 const (
 	version      = "1.3"
 	ProxyUnknown = "unknown"
+
+	// versionRegistration is the first version of ProxyPollRequest whose
+	// senders accept a registration token in place of a client offer.
+	versionRegistration = "1.4"
 )
 
 var KnownProxyTypes = map[string]bool{
@@ -91,6 +96,36 @@ HTTP 400 BadRequest
 
 */
 
+/* Version 1.4 specification:
+
+Proxies may register with the broker and fetch their offer later, instead of
+holding the poll request open until a client is matched.
+
+== ProxyPollRequest ==
+As in version 1.3, with one more field when fetching an offer:
+{
+  ...
+  Version: 1.4,
+  Token: [registration token received from the broker]
+}
+
+== ProxyPollResponse ==
+In addition to the version 1.3 responses, a broker that supports registration
+may answer a version 1.4 poll right away:
+
+4) If the proxy is registered but no client is matched yet:
+HTTP 200 OK
+{
+  Status: "registered",
+  Token: [registration token]
+}
+
+The proxy then repeats its poll with the token until a client is matched
+("client match") or the registration expires ("no match"). Brokers that do not
+support registration answer version 1.4 polls like version 1.3 polls.
+
+*/
+
 type ProxyPollRequest struct {
 	Sid     string
 	Version string
@@ -99,6 +134,8 @@ type ProxyPollRequest struct {
 	Clients int
 
 	AcceptedRelayPattern *string
+
+	Token string `json:",omitempty"`
 }
 
 func EncodeProxyPollRequest(sid string, proxyType string, natType string, clients int) ([]byte, error) {
@@ -116,6 +153,21 @@ func EncodeProxyPollRequestWithRelayPrefix(sid string, proxyType string, natType
 	})
 }
 
+// EncodeProxyPollRequestWithToken encodes a version 1.4 poll, which registers
+// the proxy if token is empty and otherwise fetches the offer for the
+// registration identified by token.
+func EncodeProxyPollRequestWithToken(sid string, proxyType string, natType string, clients int, relayPattern string, token string) ([]byte, error) {
+	return json.Marshal(ProxyPollRequest{
+		Sid:                  sid,
+		Version:              versionRegistration,
+		Type:                 proxyType,
+		NAT:                  natType,
+		Clients:              clients,
+		AcceptedRelayPattern: &relayPattern,
+		Token:                token,
+	})
+}
+
 func DecodeProxyPollRequest(data []byte) (sid string, proxyType string, natType string, clients int, err error) {
 	var relayPrefix string
 	sid, proxyType, natType, clients, relayPrefix, _, err = DecodeProxyPollRequestWithRelayPrefix(data)
@@ -184,12 +236,42 @@ func DecodeProxyPollRequestWithRelayPrefix(data []byte) (
 		acceptedRelayPattern, message.AcceptedRelayPattern != nil, nil
 }
 
+// DecodeProxyPollToken returns whether the proxy that sent a poll accepts a
+// registration token instead of an offer, and the token it is fetching its
+// offer with, if any. The rest of the poll is decoded by
+// DecodeProxyPollRequestWithRelayPrefix.
+func DecodeProxyPollToken(data []byte) (registration bool, token string, err error) {
+	var message ProxyPollRequest
+	if err = json.Unmarshal(data, &message); err != nil {
+		return
+	}
+	return versionAtLeast(message.Version, versionRegistration), message.Token, nil
+}
+
+// versionAtLeast compares two version 1.x strings.
+func versionAtLeast(v string, min string) bool {
+	minor := func(v string) int {
+		parts := strings.SplitN(v, ".", 2)
+		if len(parts) != 2 || parts[0] != "1" {
+			return -1
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	return minor(v) >= minor(min) && minor(min) >= 0
+}
+
 type ProxyPollResponse struct {
 	Status string
 	Offer  string
 	NAT    string
 
 	RelayURL string
+
+	Token string `json:",omitempty"`
 }
 
 func EncodePollResponse(offer string, success bool, natType string) ([]byte, error) {
@@ -211,6 +293,16 @@ func EncodePollResponseWithRelayURL(offer string, success bool, natType, relayUR
 		Status: failReason,
 	})
 }
+
+// EncodePollResponseWithToken tells a proxy it is registered and may fetch its
+// offer with token.
+func EncodePollResponseWithToken(token string) ([]byte, error) {
+	return json.Marshal(ProxyPollResponse{
+		Status: "registered",
+		Token:  token,
+	})
+}
+
 func DecodePollResponse(data []byte) (string, string, error) {
 	offer, natType, relayURL, err := DecodePollResponseWithRelayURL(data)
 	if relayURL != "" {
@@ -252,6 +344,24 @@ func DecodePollResponseWithRelayURL(data []byte) (string, string, string, error)
 	return message.Offer, natType, message.RelayURL, err
 }
 
+// DecodePollResponseWithToken is like DecodePollResponseWithRelayURL, but also
+// accepts the "registered" response of version 1.4, in which case the returned
+// offer is empty and the token is the one to fetch the offer with.
+func DecodePollResponseWithToken(data []byte) (offer string, natType string, relayURL string, token string, err error) {
+	var message ProxyPollResponse
+	if err = json.Unmarshal(data, &message); err != nil {
+		return
+	}
+	if message.Status == "registered" {
+		if message.Token == "" {
+			err = fmt.Errorf("no supplied token")
+		}
+		return "", "", "", message.Token, err
+	}
+	offer, natType, relayURL, err = DecodePollResponseWithRelayURL(data)
+	return
+}
+
 type ProxyAnswerRequest struct {
 	Version string
 	Sid     string
@@ -321,3 +431,65 @@ func DecodeAnswerResponse(data []byte) (bool, error) {
 
 	return success, nil
 }
+
+/* WebSocket signaling:
+
+Instead of sending each poll and answer in its own HTTP request, proxies may
+keep a WebSocket connection to the broker and send them, one at a time, as
+text messages. Each message wraps a ProxyPollRequest or ProxyAnswerRequest and
+is followed by a message from the broker that wraps the response to it:
+
+== ProxySignalingMessage ==
+{
+  Type: ["poll"|"answer"],
+  Body: [ProxyPollRequest or ProxyAnswerRequest, or the response to it],
+  Error: [set instead of Body if the request failed, e.g. "bad request"]
+}
+
+A poll is answered as soon as a client is matched or the proxy times out, so
+offers reach the proxy without the cost of a new connection. The broker closes
+the connection on a message it cannot decode, as it has no type to answer it
+with, and the proxy falls back to HTTP.
+
+*/
+
+const (
+	ProxySignalingPoll   = "poll"
+	ProxySignalingAnswer = "answer"
+)
+
+type ProxySignalingMessage struct {
+	Type  string
+	Body  json.RawMessage `json:",omitempty"`
+	Error string          `json:",omitempty"`
+}
+
+// EncodeProxySignalingMessage wraps a request or response body, or the error
+// that prevented a response, for a WebSocket signaling connection.
+func EncodeProxySignalingMessage(kind string, body []byte, reqErr error) ([]byte, error) {
+	message := ProxySignalingMessage{Type: kind}
+	if reqErr != nil {
+		message.Error = reqErr.Error()
+	} else {
+		message.Body = body
+	}
+	return json.Marshal(message)
+}
+
+// DecodeProxySignalingMessage unwraps a WebSocket signaling message. An Error
+// set by the broker is returned as err.
+func DecodeProxySignalingMessage(data []byte) (kind string, body []byte, err error) {
+	var message ProxySignalingMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return "", nil, err
+	}
+	switch message.Type {
+	case ProxySignalingPoll, ProxySignalingAnswer:
+	default:
+		return "", nil, fmt.Errorf("unknown signaling message type %q", message.Type)
+	}
+	if message.Error != "" {
+		return message.Type, nil, errors.New(message.Error)
+	}
+	return message.Type, message.Body, nil
+}
@@ -0,0 +1,56 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often MemoryStore forgets the buckets that have
+// filled up again.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+// MemoryStore keeps the token buckets of a single broker.
+type MemoryStore struct {
+	lock      sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket)}
+}
+
+func (s *MemoryStore) Take(_ context.Context, name string, budget Budget, now time.Time) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		for name, b := range s.buckets {
+			if !now.Before(b.full) {
+				delete(s.buckets, name)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[name]
+	if !ok {
+		b = &bucket{tokens: float64(budget.Burst), last: now}
+		s.buckets[name] = b
+	}
+	b.tokens = budget.refill(b.tokens, now.Sub(b.last))
+	b.last = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	b.full = now.Add(budget.fillTime())
+	return allowed, nil
+}
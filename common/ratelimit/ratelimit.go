@@ -0,0 +1,154 @@
+/*
+Package ratelimit limits how often a host may use each endpoint of the broker.
+
+Each endpoint has its own budget, and each host its own token bucket for that
+endpoint: the bucket holds up to Burst tokens, one is taken by each request,
+and it is refilled at Rate tokens per second. Hosts are keyed by IP address;
+IPv6 addresses are aggregated to their /64 prefix, since a single host
+usually has a whole /64 to pick addresses from.
+
+The buckets are kept in memory by MemoryStore, or in Redis by RedisStore, so
+that several brokers or Lambda functions share them.
+*/
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The endpoints requests are limited on.
+const (
+	EndpointClient = "client"
+	EndpointProxy  = "proxy"
+	EndpointAnswer = "answer"
+	// EndpointAmp is the AMP cache endpoint. Its requests come from the
+	// cache rather than from clients, so it is not limited along with
+	// EndpointClient.
+	EndpointAmp = "amp"
+)
+
+// Budget is the rate at which a host may make requests to an endpoint.
+type Budget struct {
+	// Rate is the number of requests per second allowed in the long run.
+	Rate float64
+	// Burst is the number of requests allowed at once.
+	Burst int
+}
+
+// refill returns the tokens in a bucket that held tokens elapsed ago.
+func (b Budget) refill(tokens float64, elapsed time.Duration) float64 {
+	if elapsed > 0 {
+		tokens += elapsed.Seconds() * b.Rate
+	}
+	return math.Min(tokens, float64(b.Burst))
+}
+
+// fillTime is how long an empty bucket takes to fill up. A bucket left alone
+// for that long is the same as a new one.
+func (b Budget) fillTime() time.Duration {
+	return time.Duration(float64(b.Burst) / b.Rate * float64(time.Second))
+}
+
+// Budgets maps endpoints to their budgets. Endpoints without a budget are not
+// limited.
+type Budgets map[string]Budget
+
+// ParseBudgets parses a comma-separated list of endpoint=rate:burst budgets,
+// such as "client=0.5:10,proxy=2:20", with rates in requests per second.
+func ParseBudgets(s string) (Budgets, error) {
+	budgets := make(Budgets)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		endpoint, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid budget %q: expected endpoint=rate:burst", item)
+		}
+		rateString, burstString, ok := strings.Cut(value, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid budget %q: expected endpoint=rate:burst", item)
+		}
+		rate, err := strconv.ParseFloat(rateString, 64)
+		if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+			return nil, fmt.Errorf("invalid rate in budget %q", item)
+		}
+		burst, err := strconv.Atoi(burstString)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("invalid burst in budget %q", item)
+		}
+		budgets[endpoint] = Budget{Rate: rate, Burst: burst}
+	}
+	return budgets, nil
+}
+
+// Key returns the key of the host at addr, an IP address with or without a
+// port. IPv6 addresses are truncated to their /64 prefix. Addresses that
+// cannot be parsed are their own key.
+func Key(addr string) string {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return addr
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	prefix := &net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}
+	return prefix.String()
+}
+
+// Store keeps the token buckets.
+type Store interface {
+	// Take takes a token from the bucket named bucket, filled according
+	// to budget, and reports whether there was one.
+	Take(ctx context.Context, bucket string, budget Budget, now time.Time) (bool, error)
+}
+
+// Limiter checks requests against the budgets of their endpoints. A nil
+// *Limiter allows every request.
+type Limiter struct {
+	store   Store
+	budgets Budgets
+	now     func() time.Time
+}
+
+// NewLimiter returns a Limiter keeping its buckets in store.
+func NewLimiter(store Store, budgets Budgets) *Limiter {
+	return &Limiter{store: store, budgets: budgets, now: time.Now}
+}
+
+// Allow reports whether a request of the host at addr to endpoint is within
+// the budget of the endpoint. Requests are allowed if the store fails, so
+// that the broker keeps working without its limits, and if addr is empty,
+// since all the hosts whose address is unknown would share a bucket.
+func (l *Limiter) Allow(ctx context.Context, endpoint, addr string) bool {
+	if l == nil {
+		return true
+	}
+	budget, ok := l.budgets[endpoint]
+	if !ok {
+		return true
+	}
+	if addr == "" {
+		log.Printf("Not rate limiting a request to %s without an address", endpoint)
+		return true
+	}
+	allowed, err := l.store.Take(ctx, endpoint+":"+Key(addr), budget, l.now())
+	if err != nil {
+		log.Printf("Error checking rate limit of %s: %v", endpoint, err)
+		return true
+	}
+	return allowed
+}
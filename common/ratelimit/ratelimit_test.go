@@ -0,0 +1,127 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestKey(t *testing.T) {
+	for _, test := range []struct {
+		addr, key string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1:443", "192.0.2.1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"[2001:db8:1:2::7]:443", "2001:db8:1:2::/64"},
+		{"not an address", "not an address"},
+	} {
+		if key := Key(test.addr); key != test.key {
+			t.Errorf("Key(%q): expected %q, got %q", test.addr, test.key, key)
+		}
+	}
+}
+
+func TestParseBudgets(t *testing.T) {
+	budgets, err := ParseBudgets("client=0.5:10, proxy=2:20,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(budgets) != 2 || budgets["client"] != (Budget{0.5, 10}) || budgets["proxy"] != (Budget{2, 20}) {
+		t.Errorf("unexpected budgets %v", budgets)
+	}
+	if budgets, err := ParseBudgets(""); err != nil || len(budgets) != 0 {
+		t.Errorf("expected no budgets, got %v, %v", budgets, err)
+	}
+	for _, s := range []string{"client", "client=1", "client=x:1", "client=0:1", "client=1:0", "client=1:x"} {
+		if _, err := ParseBudgets(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
+
+func testLimiter(t *testing.T, store Store) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewLimiter(store, Budgets{EndpointClient: {Rate: 1, Burst: 3}})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow(ctx, EndpointClient, "192.0.2.1") {
+			t.Fatalf("request %d within the burst was refused", i)
+		}
+	}
+	if l.Allow(ctx, EndpointClient, "192.0.2.1:1234") {
+		t.Error("request beyond the burst was allowed")
+	}
+	// Other hosts and endpoints have their own buckets.
+	if !l.Allow(ctx, EndpointClient, "192.0.2.2") {
+		t.Error("request of another host was refused")
+	}
+	for i := 0; i < 10; i++ {
+		if !l.Allow(ctx, EndpointProxy, "192.0.2.1") {
+			t.Fatal("request to an endpoint without budget was refused")
+		}
+	}
+
+	// Tokens come back at the rate of the budget.
+	now = now.Add(1500 * time.Millisecond)
+	if !l.Allow(ctx, EndpointClient, "192.0.2.1") {
+		t.Error("request after refill was refused")
+	}
+	if l.Allow(ctx, EndpointClient, "192.0.2.1") {
+		t.Error("request beyond the refill was allowed")
+	}
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !l.Allow(ctx, EndpointClient, "192.0.2.1") {
+			t.Fatalf("request %d after a full refill was refused", i)
+		}
+	}
+
+	// IPv6 hosts share the bucket of their /64.
+	for i, addr := range []string{"2001:db8::1", "2001:db8::2", "2001:db8::3"} {
+		if !l.Allow(ctx, EndpointClient, addr) {
+			t.Fatalf("IPv6 request %d within the burst was refused", i)
+		}
+	}
+	if l.Allow(ctx, EndpointClient, "2001:db8::4") {
+		t.Error("IPv6 request beyond the burst of the /64 was allowed")
+	}
+	if !l.Allow(ctx, EndpointClient, "2001:db8:0:1::1") {
+		t.Error("request of another /64 was refused")
+	}
+
+	// Hosts without an address do not share a bucket.
+	for i := 0; i < 10; i++ {
+		if !l.Allow(ctx, EndpointClient, "") {
+			t.Fatal("request without an address was refused")
+		}
+	}
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	testLimiter(t, NewMemoryStore())
+}
+
+func TestRedisLimiter(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	testLimiter(t, NewRedisStore(client))
+	if ttl := server.TTL(bucketKey("client:2001:db8:0:1::/64")); ttl <= 0 || ttl > 3*time.Second {
+		t.Errorf("expected the bucket to expire once full, in 3s, got %v", ttl)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	if !l.Allow(context.Background(), EndpointClient, "192.0.2.1") {
+		t.Error("nil limiter refused a request")
+	}
+}
@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// takeScript takes a token from a bucket, a hash holding the tokens left and
+// when they were counted, in milliseconds. The hash expires once the bucket
+// has filled up again, which is the same as a new bucket.
+//
+// KEYS[1]: bucket hash. ARGV[1]: rate per second, ARGV[2]: burst, ARGV[3]:
+// time in milliseconds, ARGV[4]: fill time in milliseconds.
+const takeScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local tokens = tonumber(redis.call('HGET', KEYS[1], 'tokens'))
+local last = tonumber(redis.call('HGET', KEYS[1], 'time'))
+if tokens == nil or last == nil then
+	tokens = burst
+	last = now
+end
+if now > last then
+	tokens = math.min(burst, tokens + (now - last) * rate / 1000)
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'time', ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return allowed
+`
+
+var take = redis.NewScript(takeScript)
+
+// bucketKey is the hash of a token bucket.
+func bucketKey(name string) string {
+	return "ratelimit:" + name
+}
+
+// RedisStore keeps the token buckets in Redis, shared by all the brokers or
+// functions using the server.
+type RedisStore struct {
+	client redis.UniversalClient
+}
+
+func NewRedisStore(client redis.UniversalClient) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+func (s *RedisStore) Take(ctx context.Context, name string, budget Budget, now time.Time) (bool, error) {
+	fillTime := int64(math.Ceil(float64(budget.fillTime()) / float64(time.Millisecond)))
+	allowed, err := take.Run(ctx, s.client, []string{bucketKey(name)},
+		strconv.FormatFloat(budget.Rate, 'g', -1, 64), budget.Burst,
+		now.UnixMilli(), fillTime).Int()
+	if err != nil {
+		return false, err
+	}
+	return allowed == 1, nil
+}
@@ -6,10 +6,13 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strconv"
 	"strings"
 	"testing"
 
+	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
 	. "github.com/smartystreets/goconvey/convey"
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
@@ -32,6 +35,24 @@ func (m *MockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return r, nil
 }
 
+// Set up a mock transport that answers successive requests with successive
+// bodies
+type MockSequenceTransport struct {
+	bodies [][]byte
+}
+
+func (m *MockSequenceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := m.bodies[0]
+	if len(m.bodies) > 1 {
+		m.bodies = m.bodies[1:]
+	}
+	r := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}
+	return r, nil
+}
+
 // Set up a mock faulty transport
 type FaultyTransport struct {
 	statusOverride int
@@ -368,6 +389,62 @@ func TestBrokerInteractions(t *testing.T) {
 			expectedSDP, _ := strconv.Unquote(sampleSDP)
 			So(sdp.SDP, ShouldResemble, expectedSDP)
 		})
+		Convey("fetches offer after registering with broker", func() {
+			registered, err := messages.EncodePollResponseWithToken("token")
+			So(err, ShouldBeNil)
+			matched, err := messages.EncodePollResponse(sampleOffer, true, "unknown")
+			So(err, ShouldBeNil)
+			broker.transport = &MockSequenceTransport{
+				[][]byte{registered, registered, matched},
+			}
+
+			sdp, _ := broker.pollOffer(sampleOffer, DefaultProxyType, "")
+			expectedSDP, _ := strconv.Unquote(sampleSDP)
+			So(sdp.SDP, ShouldResemble, expectedSDP)
+		})
+		Convey("polls broker over WebSocket", func() {
+			b, err := messages.EncodePollResponse(sampleOffer, true, "unknown")
+			So(err, ShouldBeNil)
+			upgrader := websocket.Upgrader{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				_, message, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				kind, _, _ := messages.DecodeProxySignalingMessage(message)
+				reply, _ := messages.EncodeProxySignalingMessage(kind, b, nil)
+				conn.WriteMessage(websocket.TextMessage, reply)
+			}))
+			defer server.Close()
+			broker.webSocketURL, err = url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+			So(err, ShouldBeNil)
+			// HTTP polls fail
+			broker.transport = &MockTransport{http.StatusOK, []byte("test")}
+
+			sdp, _ := broker.pollOffer(sampleOffer, DefaultProxyType, "")
+			expectedSDP, _ := strconv.Unquote(sampleSDP)
+			So(sdp.SDP, ShouldResemble, expectedSDP)
+		})
+		Convey("falls back to HTTP polling without WebSocket", func() {
+			var err error
+			b, err := messages.EncodePollResponse(sampleOffer, true, "unknown")
+			So(err, ShouldBeNil)
+			server := httptest.NewServer(http.NotFoundHandler())
+			defer server.Close()
+			broker.webSocketURL, err = url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+			So(err, ShouldBeNil)
+			broker.transport = &MockTransport{http.StatusOK, b}
+
+			sdp, _ := broker.pollOffer(sampleOffer, DefaultProxyType, "")
+			expectedSDP, _ := strconv.Unquote(sampleSDP)
+			So(sdp.SDP, ShouldResemble, expectedSDP)
+			So(broker.webSocket, ShouldBeNil)
+		})
 		Convey("handles poll error", func() {
 			var err error
 
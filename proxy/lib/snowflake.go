@@ -29,6 +29,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -84,8 +85,22 @@ const (
 	readLimit = 100000
 
 	sessionIDLength = 16
+
+	// How often, and for how long at most, the proxy fetches its offer from a
+	// broker that registered it instead of holding the poll open
+	offerFetchInterval = 1 * time.Second
+	offerFetchTimeout  = 30 * time.Second
+
+	// How long to wait for the broker to respond over the WebSocket signaling
+	// connection, and before connecting again after the connection failed
+	webSocketResponseTimeout = 30 * time.Second
+	webSocketRetryInterval   = 1 * time.Minute
 )
 
+// errNoWebSocket is returned when the WebSocket signaling connection cannot be
+// used, and the broker has to be reached over HTTP instead.
+var errNoWebSocket = errors.New("no WebSocket connection to broker")
+
 const bufferedAmountLowThreshold uint64 = 256 * 1024 // 256 KB
 
 var broker *SignalingServer
@@ -127,6 +142,10 @@ type SnowflakeProxy struct {
 	STUNURL string
 	// BrokerURL is the URL of the Snowflake broker
 	BrokerURL string
+	// BrokerWebSocketURL is the URL of the broker's WebSocket signaling
+	// endpoint. If set, polls and answers are sent over a persistent WebSocket
+	// connection, and over HTTP to BrokerURL only while it cannot be used.
+	BrokerWebSocketURL string
 	// KeepLocalAddresses indicates whether local SDP candidates will be sent to the broker
 	KeepLocalAddresses bool
 	// RelayURL is the default `URL` of the server (relay)
@@ -196,6 +215,13 @@ type SignalingServer struct {
 	url                *url.URL
 	transport          http.RoundTripper
 	keepLocalAddresses bool
+
+	// webSocketURL is set if polls and answers are to be sent over a
+	// WebSocket connection
+	webSocketURL   *url.URL
+	webSocketLock  sync.Mutex
+	webSocket      *websocket.Conn
+	webSocketRetry time.Time
 }
 
 func newSignalingServer(rawURL string, keepLocalAddresses bool) (*SignalingServer, error) {
@@ -232,28 +258,118 @@ func (s *SignalingServer) Post(path string, payload io.Reader) ([]byte, error) {
 	return limitedRead(resp.Body, readLimit)
 }
 
+// signal sends a poll or answer to the broker, over the WebSocket signaling
+// connection if there is one and over HTTP to path otherwise, and returns the
+// broker's response
+func (s *SignalingServer) signal(kind string, path string, body []byte) ([]byte, error) {
+	if s.webSocketURL != nil {
+		resp, err := s.exchange(kind, body)
+		if !errors.Is(err, errNoWebSocket) {
+			return resp, err
+		}
+	}
+	brokerPath := s.url.ResolveReference(&url.URL{Path: path})
+	return s.Post(brokerPath.String(), bytes.NewBuffer(body))
+}
+
+// exchange sends a poll or answer over the WebSocket signaling connection,
+// connecting first if needed, and waits for the broker's response
+func (s *SignalingServer) exchange(kind string, body []byte) ([]byte, error) {
+	s.webSocketLock.Lock()
+	defer s.webSocketLock.Unlock()
+
+	if s.webSocket == nil {
+		if time.Now().Before(s.webSocketRetry) {
+			return nil, errNoWebSocket
+		}
+		conn, _, err := websocket.DefaultDialer.Dial(s.webSocketURL.String(), nil)
+		if err != nil {
+			log.Printf("error connecting to broker WebSocket, falling back to HTTP: %s", err.Error())
+			s.webSocketRetry = time.Now().Add(webSocketRetryInterval)
+			return nil, errNoWebSocket
+		}
+		conn.SetReadLimit(readLimit)
+		s.webSocket = conn
+	}
+
+	message, err := messages.EncodeProxySignalingMessage(kind, body, nil)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(webSocketResponseTimeout)
+	s.webSocket.SetWriteDeadline(deadline)
+	s.webSocket.SetReadDeadline(deadline)
+	err = s.webSocket.WriteMessage(websocket.TextMessage, message)
+	var reply []byte
+	if err == nil {
+		_, reply, err = s.webSocket.ReadMessage()
+	}
+	if err != nil {
+		log.Printf("error on broker WebSocket, falling back to HTTP: %s", err.Error())
+		s.closeWebSocket()
+		s.webSocketRetry = time.Now().Add(webSocketRetryInterval)
+		return nil, errNoWebSocket
+	}
+
+	replyKind, resp, err := messages.DecodeProxySignalingMessage(reply)
+	if err != nil {
+		return nil, fmt.Errorf("broker returned error: %w", err)
+	}
+	if replyKind != kind {
+		return nil, fmt.Errorf("broker responded to %s with %s", kind, replyKind)
+	}
+	return resp, nil
+}
+
+// closeWebSocket closes the WebSocket signaling connection, if any. The caller
+// must hold webSocketLock.
+func (s *SignalingServer) closeWebSocket() {
+	if s.webSocket != nil {
+		s.webSocket.Close()
+		s.webSocket = nil
+	}
+}
+
 // pollOffer communicates the proxy's capabilities with broker
 // and retrieves a compatible SDP offer and relay URL.
 func (s *SignalingServer) pollOffer(sid string, proxyType string, acceptedRelayPattern string) (*webrtc.SessionDescription, string) {
-	brokerPath := s.url.ResolveReference(&url.URL{Path: "proxy"})
-
 	numClients := int((tokens.count() / 8) * 8) // Round down to 8
 	currentNATTypeLoaded := getCurrentNATType()
-	body, err := messages.EncodeProxyPollRequestWithRelayPrefix(sid, proxyType, currentNATTypeLoaded, numClients, acceptedRelayPattern)
-	if err != nil {
-		log.Printf("Error encoding poll message: %s", err.Error())
-		return nil, ""
-	}
+	poll := func(token string) (offer string, relayURL string, nextToken string, err error) {
+		body, err := messages.EncodeProxyPollRequestWithToken(sid, proxyType, currentNATTypeLoaded, numClients, acceptedRelayPattern, token)
+		if err != nil {
+			log.Printf("Error encoding poll message: %s", err.Error())
+			return "", "", "", err
+		}
 
-	resp, err := s.Post(brokerPath.String(), bytes.NewBuffer(body))
-	if err != nil {
-		log.Printf("error polling broker: %s", err.Error())
+		resp, err := s.signal(messages.ProxySignalingPoll, "proxy", body)
+		if err != nil {
+			log.Printf("error polling broker: %s", err.Error())
+		}
+
+		offer, _, relayURL, nextToken, err = messages.DecodePollResponseWithToken(resp)
+		if err != nil {
+			log.Printf("Error reading broker response: %s", err.Error())
+			log.Printf("body: %s", resp)
+		}
+		return
 	}
 
-	offer, _, relayURL, err := messages.DecodePollResponseWithRelayURL(resp)
+	// Brokers that support it register the proxy and answer right away, in
+	// which case the offer is fetched with the registration token until a
+	// client is matched or the registration expires. Other brokers hold the
+	// poll open until a client is matched.
+	offer, relayURL, token, err := poll("")
+	deadline := time.Now().Add(offerFetchTimeout)
+	for err == nil && offer == "" && token != "" {
+		if time.Now().After(deadline) {
+			log.Printf("Gave up fetching offer from broker")
+			return nil, ""
+		}
+		time.Sleep(offerFetchInterval)
+		offer, relayURL, token, err = poll(token)
+	}
 	if err != nil {
-		log.Printf("Error reading broker response: %s", err.Error())
-		log.Printf("body: %s", resp)
 		return nil, ""
 	}
 	if offer != "" {
@@ -288,8 +404,7 @@ func (s *SignalingServer) sendAnswer(sid string, pc *webrtc.PeerConnection) erro
 		return err
 	}
 
-	brokerPath := s.url.ResolveReference(&url.URL{Path: "answer"})
-	resp, err := s.Post(brokerPath.String(), bytes.NewBuffer(body))
+	resp, err := s.signal(messages.ProxySignalingAnswer, "answer", body)
 	if err != nil {
 		return fmt.Errorf("error sending answer to broker: %s", err.Error())
 	}
@@ -723,6 +838,12 @@ func (sf *SnowflakeProxy) Start() error {
 	if err != nil {
 		return fmt.Errorf("error configuring broker: %s", err)
 	}
+	if sf.BrokerWebSocketURL != "" {
+		broker.webSocketURL, err = url.Parse(sf.BrokerWebSocketURL)
+		if err != nil {
+			return fmt.Errorf("invalid broker websocket url: %s", err)
+		}
+	}
 
 	_, err = url.Parse(sf.STUNURL)
 	if err != nil {
@@ -776,6 +897,9 @@ func (sf *SnowflakeProxy) Start() error {
 	for ; true; <-ticker.C {
 		select {
 		case <-sf.shutdown:
+			broker.webSocketLock.Lock()
+			broker.closeWebSocket()
+			broker.webSocketLock.Unlock()
 			return nil
 		default:
 			tokens.get()
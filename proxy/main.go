@@ -26,6 +26,7 @@ func main() {
 	stunURL := flag.String("stun", sf.DefaultSTUNURL, "Comma-separated STUN server `URL`s that this proxy will use will use to, among some other things, determine its public IP address")
 	logFilename := flag.String("log", "", "log `filename`. If not specified, logs will be output to stderr (console).")
 	rawBrokerURL := flag.String("broker", sf.DefaultBrokerURL, "The `URL` of the broker server that the proxy will be using to find clients")
+	rawBrokerWebSocketURL := flag.String("broker-websocket", "", "The `URL` of the broker's WebSocket signaling endpoint, e.g. \"wss://snowflake-broker.example.net/proxy-ws\".\nIf given, the proxy stays connected to it to find clients, and only polls the -broker URL while it cannot connect")
 	unsafeLogging := flag.Bool("unsafe-logging", false, "keep IP addresses and other sensitive info in the logs")
 	logLocalTime := flag.Bool("log-local-time", false, "Use local time for logging (default: UTC)")
 	keepLocalAddresses := flag.Bool("keep-local-addresses", false, "keep local LAN address ICE candidates.\nThis is usually pointless because Snowflake clients don't usually reside on the same local network as the proxy.")
@@ -97,6 +98,7 @@ func main() {
 		Capacity:           uint(*capacity),
 		STUNURL:            *stunURL,
 		BrokerURL:          *rawBrokerURL,
+		BrokerWebSocketURL: *rawBrokerWebSocketURL,
 		KeepLocalAddresses: *keepLocalAddresses,
 		RelayURL:           *defaultRelayURL,
 		NATProbeURL:        *probeURL,